@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	KLINES_PAGE_LIMIT      = 1000
+	KLINES_MAX_PAGES       = 10
+	ANALYTICS_CANDIDATES   = 20
+	ANALYTICS_CONCURRENCY  = 4
+	VOLUME_PROFILE_BUCKETS = 10
+	VOLUME_PROFILE_MAX     = 1000
+
+	RANK_BY_VOLATILITY   = "volatility"
+	RANK_BY_VWAP         = "vwap"
+	RANK_BY_RETURN       = "return"
+	RANK_BY_VOLUME       = "volume"
+	RANK_BY_QUOTE_VOLUME = "quote_volume"
+	RANK_BY_TRADE_COUNT  = "trade_count"
+)
+
+var klineIntervals = map[string]time.Duration{
+	"1m":  time.Minute,
+	"3m":  3 * time.Minute,
+	"5m":  5 * time.Minute,
+	"15m": 15 * time.Minute,
+	"30m": 30 * time.Minute,
+	"1h":  time.Hour,
+	"2h":  2 * time.Hour,
+	"4h":  4 * time.Hour,
+	"6h":  6 * time.Hour,
+	"8h":  8 * time.Hour,
+	"12h": 12 * time.Hour,
+	"1d":  24 * time.Hour,
+	"3d":  3 * 24 * time.Hour,
+	"1w":  7 * 24 * time.Hour,
+}
+
+type AnalyticsQuery struct {
+	Interval  string
+	StartTime time.Time
+	EndTime   time.Time
+	Buckets   int
+}
+
+type SymbolAnalytics struct {
+	Symbol             string          `json:"symbol"`
+	Interval           string          `json:"interval"`
+	StartTime          time.Time       `json:"startTime"`
+	EndTime            time.Time       `json:"endTime"`
+	Candles            int             `json:"candles"`
+	Open               decimal.Decimal `json:"open"`
+	Close              decimal.Decimal `json:"close"`
+	High               decimal.Decimal `json:"high"`
+	Low                decimal.Decimal `json:"low"`
+	Return             float64         `json:"return"`
+	RealizedVolatility float64         `json:"realizedVolatility"`
+	Vwap               decimal.Decimal `json:"vwap"`
+	Volume             decimal.Decimal `json:"volume"`
+	QuoteVolume        decimal.Decimal `json:"quoteVolume"`
+	TradeCount         int             `json:"tradeCount"`
+	VolumeProfile      []*VolumeLevel  `json:"volumeProfile,omitempty"`
+}
+
+// SymbolRanking holds the ranked analytics of the symbols, the symbols
+// failed to be analyzed are reported apart with the reason
+type SymbolRanking struct {
+	By       string             `json:"by"`
+	Results  []*SymbolAnalytics `json:"results"`
+	Failures []*SymbolFailure   `json:"failures"`
+}
+
+type VolumeLevel struct {
+	PriceLow  decimal.Decimal `json:"priceLow"`
+	PriceHigh decimal.Decimal `json:"priceHigh"`
+	Volume    decimal.Decimal `json:"volume"`
+}
+
+type AnalyticsService interface {
+	GetSymbolAnalytics(ctx context.Context, symbol string, q *AnalyticsQuery) (*SymbolAnalytics, error)
+	RankSymbols(ctx context.Context, symbols []string, by string, limit int, q *AnalyticsQuery) (*SymbolRanking, error)
+	GetCandidates(ctx context.Context, quoteAsset string) ([]string, error)
+}
+
+type analytics struct {
+	client  ApiClient
+	service MarketDataService
+}
+
+func NewAnalyticsService(c *ApiClient, s *MarketDataService) AnalyticsService {
+	return &analytics{
+		client:  *c,
+		service: *s,
+	}
+}
+
+func (a *analytics) GetSymbolAnalytics(ctx context.Context, symbol string, q *AnalyticsQuery) (*SymbolAnalytics, error) {
+	ctx, span := tracer.Start(ctx, "AnalyticsService.GetSymbolAnalytics",
+		trace.WithAttributes(attribute.String("symbol", symbol), attribute.String("interval", q.Interval)))
+	defer span.End()
+
+	klines, err := a.getKlines(ctx, symbol, q)
+	if err != nil {
+		recordError(span, err)
+		loggerFromContext(ctx).WithField("symbol", symbol).Errorf(
+			"Error occurred while getting klines for %s", symbol)
+		return nil, err
+	}
+
+	return analyze(symbol, q, klines), nil
+}
+
+func (a *analytics) RankSymbols(
+	ctx context.Context, symbols []string, by string, limit int, q *AnalyticsQuery,
+) (*SymbolRanking, error) {
+	ctx, span := tracer.Start(ctx, "AnalyticsService.RankSymbols",
+		trace.WithAttributes(attribute.StringSlice("symbols", symbols), attribute.String("by", by)))
+	defer span.End()
+
+	less, err := rankOrder(by)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]*SymbolAnalytics, len(symbols))
+	errs := make([]error, len(symbols))
+	fanOut(len(symbols), ANALYTICS_CONCURRENCY, func(i int) {
+		values[i], errs[i] = a.GetSymbolAnalytics(ctx, symbols[i], q)
+	})
+
+	// the symbols failed to be analyzed are reported apart and the rest
+	// is ranked, only a ranking without any result fails as a whole
+	ranking := &SymbolRanking{By: by, Results: []*SymbolAnalytics{}, Failures: []*SymbolFailure{}}
+	var aerr error
+	for i, err := range errs {
+		if err != nil {
+			aerr = err
+			ranking.Failures = append(ranking.Failures, newSymbolFailure(symbols[i], OPERATION_ANALYTICS, err))
+			continue
+		}
+		ranking.Results = append(ranking.Results, values[i])
+	}
+
+	if failed := len(ranking.Failures); failed > 0 {
+		span.SetAttributes(attribute.Int("failed", failed))
+		loggerFromContext(ctx).Errorf("Error occurred while ranking %d symbols", failed)
+		if len(ranking.Results) == 0 {
+			recordError(span, aerr)
+			return nil, aerr
+		}
+	}
+
+	results := ranking.Results
+	sort.SliceStable(results, func(i, j int) bool { return less(results[i], results[j]) })
+	if limit > 0 && len(results) > limit {
+		ranking.Results = results[:limit]
+	}
+
+	return ranking, nil
+}
+
+// GetCandidates limits the ranking universe of the quote asset to the
+// most traded symbols to keep the klines requests within the weight budget
+func (a *analytics) GetCandidates(ctx context.Context, quoteAsset string) ([]string, error) {
+	top, err := a.service.GetTopSymbols(ctx, quoteAsset, ANALYTICS_CANDIDATES, ByQuoteVolume)
+	if err != nil {
+		return nil, err
+	}
+
+	var symbols []string
+	for _, v := range top {
+		symbols = append(symbols, v.Symbol)
+	}
+	return symbols, nil
+}
+
+func (a *analytics) getKlines(ctx context.Context, symbol string, q *AnalyticsQuery) ([]*Kline, error) {
+	var klines []*Kline
+	start := q.StartTime
+	for page := 0; page < KLINES_MAX_PAGES; page++ {
+		batch, err := a.client.GetKlines(ctx, &KlinesQuery{
+			Symbol:    symbol,
+			Interval:  q.Interval,
+			StartTime: start,
+			EndTime:   q.EndTime,
+			Limit:     KLINES_PAGE_LIMIT,
+		})
+		if err != nil {
+			return nil, err
+		}
+		klines = append(klines, batch...)
+
+		if len(batch) < KLINES_PAGE_LIMIT {
+			return klines, nil
+		}
+		start = fromMillis(batch[len(batch)-1].CloseTime + 1)
+		if !q.EndTime.IsZero() && !start.Before(q.EndTime) {
+			return klines, nil
+		}
+	}
+
+	return nil, fmt.Errorf("window exceeds %d klines of %s interval", KLINES_PAGE_LIMIT*KLINES_MAX_PAGES, q.Interval)
+}
+
+func analyze(symbol string, q *AnalyticsQuery, klines []*Kline) *SymbolAnalytics {
+	result := &SymbolAnalytics{
+		Symbol:    symbol,
+		Interval:  q.Interval,
+		StartTime: q.StartTime,
+		EndTime:   q.EndTime,
+		Candles:   len(klines),
+	}
+	if len(klines) == 0 {
+		return result
+	}
+
+	result.Open = klines[0].Open
+	result.Close = klines[len(klines)-1].Close
+	result.High = klines[0].High
+	result.Low = klines[0].Low
+
+	var sumSquares float64
+	for i, k := range klines {
+		result.High = decimal.Max(result.High, k.High)
+		result.Low = decimal.Min(result.Low, k.Low)
+		result.Volume = result.Volume.Add(k.Volume)
+		result.QuoteVolume = result.QuoteVolume.Add(k.QuoteVolume)
+		result.TradeCount += k.TradeCount
+
+		prev := k.Open
+		if i > 0 {
+			prev = klines[i-1].Close
+		}
+		if r := logReturn(prev, k.Close); !math.IsNaN(r) {
+			sumSquares += r * r
+		}
+	}
+
+	result.RealizedVolatility = math.Sqrt(sumSquares)
+	if !result.Open.IsZero() {
+		result.Return, _ = result.Close.Sub(result.Open).Div(result.Open).Float64()
+	}
+	// quote volume of the kline is the sum of price * qty of its trades,
+	// so the ratio of the totals is the exact volume weighted average price
+	if !result.Volume.IsZero() {
+		result.Vwap = result.QuoteVolume.Div(result.Volume)
+	}
+	result.VolumeProfile = volumeProfile(klines, result.Low, result.High, q.Buckets)
+
+	return result
+}
+
+func logReturn(from, to decimal.Decimal) float64 {
+	f, _ := from.Float64()
+	t, _ := to.Float64()
+	if f <= 0 || t <= 0 {
+		return math.NaN()
+	}
+	return math.Log(t / f)
+}
+
+// volumeProfile distributes the volume of every kline to the price bucket
+// of its typical price (high + low + close) / 3
+func volumeProfile(klines []*Kline, low, high decimal.Decimal, buckets int) []*VolumeLevel {
+	if buckets <= 0 || !high.GreaterThan(low) {
+		return nil
+	}
+
+	step := high.Sub(low).Div(decimal.NewFromInt(int64(buckets)))
+	levels := make([]*VolumeLevel, buckets)
+	for i := range levels {
+		levels[i] = &VolumeLevel{
+			PriceLow:  low.Add(step.Mul(decimal.NewFromInt(int64(i)))),
+			PriceHigh: low.Add(step.Mul(decimal.NewFromInt(int64(i + 1)))),
+		}
+	}
+
+	three := decimal.NewFromInt(3)
+	for _, k := range klines {
+		typical := k.High.Add(k.Low).Add(k.Close).Div(three)
+		i := int(typical.Sub(low).Div(step).IntPart())
+		if i >= buckets {
+			i = buckets - 1
+		}
+		if i < 0 {
+			i = 0
+		}
+		levels[i].Volume = levels[i].Volume.Add(k.Volume)
+	}
+
+	return levels
+}
+
+func rankOrder(by string) (func(a, b *SymbolAnalytics) bool, error) {
+	switch by {
+	case RANK_BY_VOLATILITY:
+		return func(a, b *SymbolAnalytics) bool { return a.RealizedVolatility > b.RealizedVolatility }, nil
+	case RANK_BY_VWAP:
+		return func(a, b *SymbolAnalytics) bool { return a.Vwap.GreaterThan(b.Vwap) }, nil
+	case RANK_BY_RETURN:
+		return func(a, b *SymbolAnalytics) bool { return a.Return > b.Return }, nil
+	case RANK_BY_VOLUME:
+		return func(a, b *SymbolAnalytics) bool { return a.Volume.GreaterThan(b.Volume) }, nil
+	case RANK_BY_QUOTE_VOLUME:
+		return func(a, b *SymbolAnalytics) bool { return a.QuoteVolume.GreaterThan(b.QuoteVolume) }, nil
+	case RANK_BY_TRADE_COUNT:
+		return func(a, b *SymbolAnalytics) bool { return a.TradeCount > b.TradeCount }, nil
+	}
+	return nil, fmt.Errorf("unknown ranking %q", by)
+}
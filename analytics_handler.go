@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_KLINE_INTERVAL   = "1h"
+	DEFAULT_ANALYTICS_WINDOW = 24 * time.Hour
+)
+
+func (c *controller) symbolAnalytics(w http.ResponseWriter, req *http.Request) {
+	q, err := parseAnalyticsQuery(req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	symbols := parseSymbols(req.URL.Query().Get("symbol"))
+	if len(symbols) != 1 {
+		writeJSONError(w, http.StatusBadRequest, errors.New("exactly one symbol is required"))
+		return
+	}
+
+	result, err := c.analytics.GetSymbolAnalytics(req.Context(), symbols[0], q)
+	if err != nil {
+		writeJSONError(w, upstreamStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (c *controller) rankAnalytics(w http.ResponseWriter, req *http.Request) {
+	q, err := parseAnalyticsQuery(req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	params := req.URL.Query()
+	by := params.Get("by")
+	if by == "" {
+		by = RANK_BY_VOLATILITY
+	}
+	limit := TOP_LIMIT
+	if v := params.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+			return
+		}
+	}
+
+	symbols := parseSymbols(params.Get("symbols"))
+	if len(symbols) == 0 {
+		quote := params.Get("quote")
+		if quote == "" {
+			writeJSONError(w, http.StatusBadRequest, errors.New("either symbols or quote is required"))
+			return
+		}
+		if symbols, err = c.analytics.GetCandidates(req.Context(), quote); err != nil {
+			writeJSONError(w, upstreamStatus(err), err)
+			return
+		}
+	}
+	if len(symbols) > ANALYTICS_CANDIDATES {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("at most %d symbols can be ranked", ANALYTICS_CANDIDATES))
+		return
+	}
+
+	ranking, err := c.analytics.RankSymbols(req.Context(), symbols, by, limit, q)
+	if err != nil {
+		writeJSONError(w, upstreamStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ranking)
+}
+
+func parseAnalyticsQuery(req *http.Request) (*AnalyticsQuery, error) {
+	params := req.URL.Query()
+	q := &AnalyticsQuery{
+		Interval: DEFAULT_KLINE_INTERVAL,
+		EndTime:  time.Now(),
+		Buckets:  VOLUME_PROFILE_BUCKETS,
+	}
+
+	if v := params.Get("interval"); v != "" {
+		if _, ok := klineIntervals[v]; !ok {
+			return nil, fmt.Errorf("unsupported interval %q", v)
+		}
+		q.Interval = v
+	}
+
+	var err error
+	if v := params.Get("end"); v != "" {
+		if q.EndTime, err = parseTime(v); err != nil {
+			return nil, fmt.Errorf("invalid end %q", v)
+		}
+	}
+
+	window := DEFAULT_ANALYTICS_WINDOW
+	if v := params.Get("window"); v != "" {
+		if window, err = time.ParseDuration(v); err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid window %q", v)
+		}
+	}
+	q.StartTime = q.EndTime.Add(-window)
+	if v := params.Get("start"); v != "" {
+		if q.StartTime, err = parseTime(v); err != nil {
+			return nil, fmt.Errorf("invalid start %q", v)
+		}
+	}
+	if !q.StartTime.Before(q.EndTime) {
+		return nil, errors.New("start must be before end")
+	}
+
+	if v := params.Get("buckets"); v != "" {
+		if q.Buckets, err = strconv.Atoi(v); err != nil || q.Buckets < 0 {
+			return nil, fmt.Errorf("invalid buckets %q", v)
+		}
+		if q.Buckets > VOLUME_PROFILE_MAX {
+			return nil, fmt.Errorf("at most %d buckets are allowed", VOLUME_PROFILE_MAX)
+		}
+	}
+
+	return q, nil
+}
+
+// upstreamStatus maps the exchange errors by the status they were returned
+// with: the rejected requests are bad requests, the rate limits and the bans
+// make the service unavailable and the rest is a bad gateway
+func upstreamStatus(err error) int {
+	var apierr *ApiError
+	if !errors.As(err, &apierr) {
+		return http.StatusBadGateway
+	}
+	switch {
+	case apierr.Status == http.StatusTooManyRequests || apierr.Status == http.StatusTeapot:
+		return http.StatusServiceUnavailable
+	case apierr.Status >= 400 && apierr.Status < 500:
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
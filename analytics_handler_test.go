@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpstreamStatus(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{"invalid symbol", &ApiError{Code: -1121, Status: http.StatusBadRequest}, http.StatusBadRequest, ""},
+		{"rate limited", &ApiError{Code: -1003, Status: http.StatusTooManyRequests, RetryAfter: 1500 * time.Millisecond},
+			http.StatusServiceUnavailable, "2"},
+		{"banned", fmt.Errorf("klines: %w", &ApiError{Code: -1003, Status: http.StatusTeapot, RetryAfter: 2 * time.Minute}),
+			http.StatusServiceUnavailable, "120"},
+		{"exchange failure", &ApiError{Code: -1001, Status: http.StatusServiceUnavailable}, http.StatusBadGateway, ""},
+		{"network", errors.New("connection refused"), http.StatusBadGateway, ""},
+	} {
+		rec := httptest.NewRecorder()
+		writeJSONError(rec, upstreamStatus(tt.err), tt.err)
+		if rec.Code != tt.status || rec.Header().Get("Retry-After") != tt.retryAfter {
+			t.Errorf("%s: got status %d retry after %q, want %d and %q",
+				tt.name, rec.Code, rec.Header().Get("Retry-After"), tt.status, tt.retryAfter)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestRankSymbolsPartial ranks the symbols analyzed and reports
+// the one the exchange rejected apart
+func TestRankSymbolsPartial(t *testing.T) {
+	closes := map[string]string{"ETHBTC": "110", "BNBBTC": "105"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		price, found := closes[req.URL.Query().Get("symbol")]
+		if !found {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code":-1121,"msg":"Invalid symbol."}`))
+			return
+		}
+		fmt.Fprintf(w, `[[1767225600000,"100","100","100","100","1",1767229199999,"100",1,"0","0","0"],`+
+			`[1767229200000,"100","%[1]s","100","%[1]s","1",1767232799999,"%[1]s",1,"0","0","0"]]`, price)
+	}))
+	defer srv.Close()
+
+	var c ApiClient = newTestClient(srv.URL)
+	var s MarketDataService
+	a := NewAnalyticsService(&c, &s)
+	q := &AnalyticsQuery{Interval: "1h", StartTime: time.Unix(1767225600, 0), EndTime: time.Unix(1767232800, 0)}
+
+	ranking, err := a.RankSymbols(context.Background(), []string{"BNBBTC", "BADBTC", "ETHBTC"}, RANK_BY_RETURN, 1, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranking.Results) != 1 || ranking.Results[0].Symbol != "ETHBTC" {
+		t.Errorf("got %d results, want ETHBTC ranked first", len(ranking.Results))
+	}
+	if len(ranking.Failures) != 1 || ranking.Failures[0].Symbol != "BADBTC" || ranking.Failures[0].Reason != "api_-1121" {
+		t.Errorf("got failures %+v, want BADBTC rejected", ranking.Failures)
+	}
+
+	// a ranking without any result fails with the error of the exchange
+	_, err = a.RankSymbols(context.Background(), []string{"BADBTC"}, RANK_BY_RETURN, 1, q)
+	var apierr *ApiError
+	if !errors.As(err, &apierr) || apierr.Status != http.StatusBadRequest {
+		t.Errorf("got %v, want the rejected request", err)
+	}
+}
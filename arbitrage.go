@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// the opportunities are ranked by return, only the best ones are published
+const ARBITRAGE_MAX_OPPORTUNITIES = 50
+
+var ErrNoArbitrageScan = errors.New("the arbitrage scan has not run yet")
+
+// ArbitrageConfig lists the assets the triangles start from, the taker fee
+// paid on every leg and the min round trip return of the published ones
+type ArbitrageConfig struct {
+	StartAssets  []string
+	FeeBps       float64
+	MinReturnBps float64
+}
+
+// ArbitrageLeg converts the from asset to the to asset at the top of the book,
+// selling the base asset at the best bid or buying it at the best ask
+type ArbitrageLeg struct {
+	Symbol string          `json:"symbol"`
+	Side   string          `json:"side"`
+	From   string          `json:"from"`
+	To     string          `json:"to"`
+	Price  decimal.Decimal `json:"price"`
+	Qty    decimal.Decimal `json:"qty"`
+}
+
+// ArbitrageOpportunity is the fee adjusted round trip of the triangle,
+// the max size and the profit are in the start asset
+type ArbitrageOpportunity struct {
+	Path      []string        `json:"path"`
+	Legs      []*ArbitrageLeg `json:"legs"`
+	ReturnBps decimal.Decimal `json:"returnBps"`
+	MaxSize   decimal.Decimal `json:"maxSize"`
+	Profit    decimal.Decimal `json:"profit"`
+}
+
+type ArbitrageScan struct {
+	Time          time.Time               `json:"time"`
+	FeeBps        float64                 `json:"feeBps"`
+	MinReturnBps  float64                 `json:"minReturnBps"`
+	Triangles     int                     `json:"triangles"`
+	Opportunities []*ArbitrageOpportunity `json:"opportunities"`
+}
+
+type ArbitrageScanner interface {
+	Scan(ctx context.Context) error
+	GetScan() (*ArbitrageScan, error)
+}
+
+type arbitrage struct {
+	client ApiClient
+	clock  ExchangeClock
+	config ArbitrageConfig
+	fee    decimal.Decimal
+	min    decimal.Decimal
+
+	mu   sync.RWMutex
+	last *ArbitrageScan
+}
+
+func NewArbitrageScanner(c *ApiClient, clock ExchangeClock, config ArbitrageConfig) ArbitrageScanner {
+	return &arbitrage{
+		client: *c,
+		clock:  clock,
+		config: config,
+		fee:    decimal.NewFromFloat(config.FeeBps).Div(basisPoints),
+		min:    decimal.NewFromFloat(config.MinReturnBps),
+	}
+}
+
+func (c ArbitrageConfig) validate() error {
+	if len(c.StartAssets) == 0 {
+		return errors.New("at least one arbitrage start asset is required")
+	}
+	if c.FeeBps < 0 || c.FeeBps >= 10000 {
+		return fmt.Errorf("invalid arbitrage fee %v bps", c.FeeBps)
+	}
+	return nil
+}
+
+func (a *arbitrage) GetScan() (*ArbitrageScan, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.last == nil {
+		return nil, ErrNoArbitrageScan
+	}
+	return a.last, nil
+}
+
+// Scan walks the triangles of the start assets over the book tickers of
+// all the trading symbols taken from a single call, a triangle containing
+// one of the previous start assets was already walked from it
+func (a *arbitrage) Scan(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "ArbitrageScanner.Scan")
+	defer span.End()
+
+	info, err := a.client.GetExchangeInfo(ctx)
+	if err != nil {
+		recordError(span, err)
+		return err
+	}
+	tickers, err := a.client.GetBookTicker(ctx, nil)
+	if err != nil {
+		recordError(span, err)
+		return err
+	}
+	now := a.clock.Now()
+
+	legs := arbitrageLegs(info, tickers)
+	order := make(map[string]int, len(a.config.StartAssets))
+	for i, asset := range a.config.StartAssets {
+		order[asset] = i
+	}
+	walked := func(asset string, start int) bool {
+		i, found := order[asset]
+		return found && i < start
+	}
+
+	scan := &ArbitrageScan{
+		Time:          now,
+		FeeBps:        a.config.FeeBps,
+		MinReturnBps:  a.config.MinReturnBps,
+		Opportunities: []*ArbitrageOpportunity{},
+	}
+	for i, first := range a.config.StartAssets {
+		for second, ab := range legs[first] {
+			if walked(second, i) {
+				continue
+			}
+			for third, bc := range legs[second] {
+				if third == first || walked(third, i) {
+					continue
+				}
+				ca, found := legs[third][first]
+				if !found {
+					continue
+				}
+				scan.Triangles++
+
+				o := a.roundTrip([]*ArbitrageLeg{ab, bc, ca})
+				if o.ReturnBps.GreaterThanOrEqual(a.min) {
+					scan.Opportunities = append(scan.Opportunities, o)
+				}
+			}
+		}
+	}
+
+	sort.Slice(scan.Opportunities, func(i, j int) bool {
+		return scan.Opportunities[i].ReturnBps.GreaterThan(scan.Opportunities[j].ReturnBps)
+	})
+	if len(scan.Opportunities) > ARBITRAGE_MAX_OPPORTUNITIES {
+		scan.Opportunities = scan.Opportunities[:ARBITRAGE_MAX_OPPORTUNITIES]
+	}
+
+	a.mu.Lock()
+	a.last = scan
+	a.mu.Unlock()
+
+	loggerFromContext(ctx).Debugf("Scanned %d triangles, %d above %v bps",
+		scan.Triangles, len(scan.Opportunities), a.config.MinReturnBps)
+	return nil
+}
+
+// roundTrip converts one unit of the start asset along the legs, the max
+// size is the smallest top of book size of the legs in the start asset
+func (a *arbitrage) roundTrip(legs []*ArbitrageLeg) *ArbitrageOpportunity {
+	keep := one.Sub(a.fee)
+	amount := one
+	var maxSize decimal.Decimal
+	path := []string{legs[0].From}
+	for i, leg := range legs {
+		// the size and the rate of the leg in its from asset
+		size := leg.Qty
+		rate := leg.Price.Mul(keep)
+		if leg.Side == SIDE_BUY {
+			size = leg.Qty.Mul(leg.Price)
+			rate = keep.Div(leg.Price)
+		}
+		if size = size.Div(amount); i == 0 || size.LessThan(maxSize) {
+			maxSize = size
+		}
+		amount = amount.Mul(rate)
+		path = append(path, leg.To)
+	}
+
+	ret := amount.Sub(one)
+	return &ArbitrageOpportunity{
+		Path:      path,
+		Legs:      legs,
+		ReturnBps: ret.Mul(basisPoints).Round(4),
+		MaxSize:   maxSize.Round(8),
+		Profit:    maxSize.Mul(ret).Round(8),
+	}
+}
+
+func (o *ArbitrageOpportunity) Name() string {
+	return strings.Join(o.Path, ">")
+}
+
+// arbitrageLegs indexes the executable legs of the trading symbols
+// by their from and to assets, in both directions of every symbol
+func arbitrageLegs(info *ExchangeInfoResponse, tickers []*BookTicker) map[string]map[string]*ArbitrageLeg {
+	symbols := make(map[string]Symbol, len(info.Symbols))
+	for _, s := range info.Symbols {
+		if s.Status == SYMBOL_STATUS_TRADING {
+			symbols[s.Symbol] = s
+		}
+	}
+
+	legs := make(map[string]map[string]*ArbitrageLeg)
+	add := func(leg *ArbitrageLeg) {
+		if legs[leg.From] == nil {
+			legs[leg.From] = make(map[string]*ArbitrageLeg)
+		}
+		legs[leg.From][leg.To] = leg
+	}
+	for _, t := range tickers {
+		s, found := symbols[t.Symbol]
+		if !found {
+			continue
+		}
+		spread, err := validateBookTicker(t)
+		if err != nil {
+			continue
+		}
+		add(&ArbitrageLeg{Symbol: t.Symbol, Side: SIDE_SELL, From: s.Baseasset, To: s.Quoteasset,
+			Price: spread.HighestBid, Qty: spread.BidQty})
+		add(&ArbitrageLeg{Symbol: t.Symbol, Side: SIDE_BUY, From: s.Quoteasset, To: s.Baseasset,
+			Price: spread.LowestAsk, Qty: spread.AskQty})
+	}
+	return legs
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"net/http"
+)
+
+func (c *controller) arbitrage(w http.ResponseWriter, req *http.Request) {
+	scan, err := c.scanner.GetScan()
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, scan)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// newFakeExchange serves the canned exchange info and book tickers
+func newFakeExchange(t *testing.T, symbols []Symbol, tickers []*BookTicker) *httptest.Server {
+	srv := httptest.NewServer(fakeExchangeHandler(symbols, tickers))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func fakeExchangeHandler(symbols []Symbol, tickers []*BookTicker) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var response interface{}
+		switch req.URL.Path {
+		case "/api/v3/exchangeInfo":
+			response = &ExchangeInfoResponse{Symbols: symbols}
+		case "/api/v3/ticker/bookTicker":
+			response = tickers
+		default:
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func testSymbol(symbol, base, quote, status string) Symbol {
+	return Symbol{Symbol: symbol, Status: status, Baseasset: base, Quoteasset: quote}
+}
+
+// TestArbitrageScan walks both directions of the USDT>BTC>ETH triangle,
+// the ETH is cheaper in BTC than in USDT so only buying it with BTC pays
+// off the three 10 bps fees; the BNB triangle has a symbol not trading
+func TestArbitrageScan(t *testing.T) {
+	srv := newFakeExchange(t, []Symbol{
+		testSymbol("BTCUSDT", "BTC", "USDT", SYMBOL_STATUS_TRADING),
+		testSymbol("ETHBTC", "ETH", "BTC", SYMBOL_STATUS_TRADING),
+		testSymbol("ETHUSDT", "ETH", "USDT", SYMBOL_STATUS_TRADING),
+		testSymbol("BNBBTC", "BNB", "BTC", SYMBOL_STATUS_TRADING),
+		testSymbol("BNBUSDT", "BNB", "USDT", "BREAK"),
+	}, []*BookTicker{
+		{Symbol: "BTCUSDT", BidPrice: "49999", BidQty: "3", AskPrice: "50000", AskQty: "2"},
+		{Symbol: "ETHBTC", BidPrice: "0.0499", BidQty: "8", AskPrice: "0.05", AskQty: "10"},
+		{Symbol: "ETHUSDT", BidPrice: "2600", BidQty: "100", AskPrice: "2601", AskQty: "150"},
+		{Symbol: "BNBBTC", BidPrice: "0.01", BidQty: "5", AskPrice: "0.0101", AskQty: "5"},
+		{Symbol: "BNBUSDT", BidPrice: "1", BidQty: "5", AskPrice: "1000", AskQty: "5"},
+	})
+
+	type expected struct {
+		path      string
+		returnBps string
+		maxSize   string
+		profit    string
+	}
+	profitable := expected{"USDT>BTC>ETH>USDT", "368.8312", "25025.02502503", "923.00097497"}
+	unprofitable := expected{"USDT>ETH>BTC>USDT", "-436.4755", "20828.82882883", "-909.12727083"}
+
+	tests := []struct {
+		name         string
+		minReturnBps float64
+		want         []expected
+	}{
+		{"above zero", 0, []expected{profitable}},
+		{"all", -1000, []expected{profitable, unprofitable}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c ApiClient = newTestClient(srv.URL)
+			scanner := NewArbitrageScanner(&c, &fixedClock{now: time.Unix(1767225600, 0)}, ArbitrageConfig{
+				StartAssets:  []string{"USDT"},
+				FeeBps:       10,
+				MinReturnBps: tt.minReturnBps,
+			})
+			if err := scanner.Scan(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			scan, err := scanner.GetScan()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if scan.Triangles != 2 {
+				t.Errorf("walked %d triangles, want 2", scan.Triangles)
+			}
+			if len(scan.Opportunities) != len(tt.want) {
+				t.Fatalf("got %d opportunities, want %d", len(scan.Opportunities), len(tt.want))
+			}
+			for i, want := range tt.want {
+				o := scan.Opportunities[i]
+				if o.Name() != want.path {
+					t.Errorf("opportunity %d is %s, want %s", i, o.Name(), want.path)
+				}
+				for _, f := range []struct {
+					name string
+					got  decimal.Decimal
+					want string
+				}{
+					{"return", o.ReturnBps, want.returnBps},
+					{"max size", o.MaxSize, want.maxSize},
+					{"profit", o.Profit, want.profit},
+				} {
+					if !f.got.Equal(decimal.RequireFromString(f.want)) {
+						t.Errorf("%s %s is %s, want %s", want.path, f.name, f.got, f.want)
+					}
+				}
+			}
+		})
+	}
+}
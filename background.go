@@ -1,7 +1,9 @@
 package main
 
 import (
-	"sort"
+	"context"
+	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/jasonlvhit/gocron"
@@ -19,69 +21,204 @@ var topTradeCountCache = cache.New(time.Duration(5)*time.Minute, time.Duration(5
 
 type background struct {
 	service MarketDataService
+	history HistoryStore
+	store   StateStore
+	watch   WatchLists
+	clock   ExchangeClock
 	state   map[string]*SpreadMetric
+	running int32
+	sampler *logSampler
+	jobs    []*backgroundJob
+}
+
+// backgroundJob is a task scheduled next to the spreads refresh,
+// a run is skipped while the previous one is still in progress
+type backgroundJob struct {
+	name    string
+	every   time.Duration
+	task    func(ctx context.Context) error
+	running int32
 }
 
 type BackgroundService interface {
 	Start()
+	Schedule(name string, every time.Duration, task func(ctx context.Context) error)
 }
 
-func NewBackgroundService(s *MarketDataService) BackgroundService {
+func NewBackgroundService(
+	s *MarketDataService, h *HistoryStore, st StateStore, w WatchLists, clock ExchangeClock, logSampleEvery int,
+) BackgroundService {
 	return &background{
 		service: *s,
+		history: *h,
+		store:   st,
+		watch:   w,
+		clock:   clock,
 		state:   make(map[string]*SpreadMetric),
+		sampler: newLogSampler(logSampleEvery),
 	}
 }
 
+// Schedule adds the task to the scheduler, it must be called before Start
+func (b *background) Schedule(name string, every time.Duration, task func(ctx context.Context) error) {
+	b.jobs = append(b.jobs, &backgroundJob{name: name, every: every, task: task})
+}
+
 func (b *background) Start() {
 	b.backgroundTask()
 	gocron.Every(10).Second().Do(b.backgroundTask)
+	for _, job := range b.jobs {
+		b.runJob(job)
+		gocron.Every(uint64(job.every.Seconds())).Seconds().Do(b.runJob, job)
+	}
 	<-gocron.Start()
 }
 
+func (b *background) runJob(job *backgroundJob) {
+	if !atomic.CompareAndSwapInt32(&job.running, 0, 1) {
+		log.WithField("job", job.name).Warn("Skipped background job, previous run is still in progress")
+		return
+	}
+	defer atomic.StoreInt32(&job.running, 0)
+
+	ctx, span := tracer.Start(context.Background(), "background."+job.name)
+	defer span.End()
+	ctx = withLogger(ctx, log.WithField("job", job.name))
+
+	if err := job.task(ctx); err != nil {
+		recordError(span, err)
+		backgroundJobErrors.WithLabelValues(job.name).Inc()
+		loggerFromContext(ctx).WithError(err).Error("Error occurred while running background job")
+		return
+	}
+	backgroundJobLastSuccess.WithLabelValues(job.name).SetToCurrentTime()
+}
+
 func (b *background) backgroundTask() {
+	// gocron runs every job in its own goroutine,
+	// so skip the tick while the previous one is still running
+	if !atomic.CompareAndSwapInt32(&b.running, 0, 1) {
+		backgroundTicksSkipped.Inc()
+		log.Warn("Skipped background task, previous run is still in progress")
+		return
+	}
+	defer atomic.StoreInt32(&b.running, 0)
+
+	ctx, span := tracer.Start(context.Background(), "background.refreshSpreads")
+	defer span.End()
+	ctx = withLogger(ctx, log.WithField("job", "background"))
+
+	start := time.Now()
+	err := b.refreshSpreads(ctx)
+	backgroundTickDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		recordError(span, err)
+		backgroundTickErrors.Inc()
+		loggerFromContext(ctx).WithError(err).Error("Error occurred while running background task")
+		return
+	}
+	backgroundLastSuccess.SetToCurrentTime()
+}
+
+func (b *background) refreshSpreads(ctx context.Context) error {
 	// get top number of trades
 	// cached or fetch from api
 	var topNumberOfTrades []*SymbolData
 	if x, found := topTradeCountCache.Get(TOP_TRADE_COUNT_KEY); found {
 		topNumberOfTrades = x.([]*SymbolData)
 	} else {
-		byTradeCountSort := func(symbols []*SymbolData) {
-			sort.Sort(ByTradeCount{symbols: symbols})
+		var err error
+		topNumberOfTrades, err = b.service.GetTopSymbols(ctx,
+			SPREAD_METRICS_QUOTE_ASSET, TOP_LIMIT, ByTradeCount)
+		if err != nil {
+			return err
 		}
-		topNumberOfTrades, _ = b.service.GetTopSymbols(
-			SPREAD_METRICS_QUOTE_ASSET, TOP_LIMIT, byTradeCountSort)
 
 		topTradeCountCache.SetDefault(TOP_TRADE_COUNT_KEY, topNumberOfTrades)
 	}
 
-	// get spreds
+	// get spreds of the top symbols and the watch-lists
 	var spreadTargets []string
+	targeted := make(map[string]bool)
 	for _, v := range topNumberOfTrades {
 		spreadTargets = append(spreadTargets, v.Symbol)
+		targeted[v.Symbol] = true
+	}
+	for _, symbol := range b.watch.Symbols() {
+		if !targeted[symbol] {
+			spreadTargets = append(spreadTargets, symbol)
+			targeted[symbol] = true
+		}
+	}
+	// the order books are only fetched for the notional values,
+	// the spreads of all the targets are taken from the book tickers
+	notionals := make(map[string]*TotalNotionalValue)
+	values, notionalFailures := splitNotionalResults(b.service.GetTotalNotionalValues(ctx, spreadTargets, NOTIONAL_DEPTH))
+	for _, v := range values {
+		notionals[v.Symbol] = v
+	}
+
+	spreads, failures := splitSpreadResults(b.service.GetSpreads(ctx, spreadTargets))
+	if len(spreads) == 0 && len(failures) > 0 {
+		return fmt.Errorf("no spreads of %d symbols: %s", len(failures), failures[0].Error)
+	}
+	failures = append(failures, notionalFailures...)
+	timestamp := b.clock.Now()
+
+	// get fresh 24h stats to enrich the spread metrics
+	tickers := make(map[string]*SymbolData)
+	if data, err := b.service.GetSymbolsData(ctx, spreadTargets); err == nil {
+		for _, v := range data {
+			tickers[v.Symbol] = v
+		}
+	}
+
+	// the failed symbols keep their last good value in the state,
+	// so the delta is taken from it once they recover, and it's
+	// reported by the readers according to the staleness policy
+	for symbol := range b.state {
+		if !targeted[symbol] {
+			delete(b.state, symbol)
+		}
 	}
-	spreads, _ := b.service.GetSpreads(spreadTargets)
 
-	var delta decimal.Decimal
-	newState := make(map[string]*SpreadMetric)
+	var samples []*SpreadSample
 	for _, spread := range spreads {
+		delta := decimal.Zero
 		if old, found := b.state[spread.Symbol]; found {
-			delta = spread.Value.Add(old.spread.Value.Neg())
-			b.printSpreadData(spread, delta)
-		} else {
-			b.printSpreadData(spread, decimal.Zero)
+			delta = spread.Value.Sub(old.spread.Value)
 		}
-		newState[spread.Symbol] = &SpreadMetric{spread, delta}
+		b.printSpreadData(ctx, spread, delta)
+		metric := &SpreadMetric{
+			spread:    spread,
+			delta:     delta,
+			notional:  notionals[spread.Symbol],
+			ticker:    tickers[spread.Symbol],
+			timestamp: spread.Time,
+		}
+		b.state[spread.Symbol] = metric
+		samples = append(samples, newSpreadSample(metric))
 	}
-	b.state = newState
+	b.history.Add(samples)
+	b.watch.Publish(ctx, timestamp, samples)
 
-	// use a cache with auto-expire as a communication channel
-	// so prometheus collector will report spread data or none
+	// the readers get the results of the whole run at once,
+	// so prometheus collector reports the same spread data
 	// regardless of its scrape interval
-	MetricsCache.SetDefault(SPREAD_METRICS_KEY, newState)
+	published := make(map[string]*SpreadMetric, len(b.state))
+	for symbol, metric := range b.state {
+		published[symbol] = metric
+	}
+	b.store.Publish(published, failures)
+
+	return nil
 }
 
-func (b *background) printSpreadData(spread *Spread, delta decimal.Decimal) {
+func (b *background) printSpreadData(ctx context.Context, spread *Spread, delta decimal.Decimal) {
+	if !b.sampler.Sample(spread.Symbol) {
+		return
+	}
+
 	// print to logger out
 	var deltaSign string
 	switch delta.Sign() {
@@ -92,5 +229,22 @@ func (b *background) printSpreadData(spread *Spread, delta decimal.Decimal) {
 	case 0:
 		deltaSign = "="
 	}
-	log.Infof("%s: %s (%s%s)", spread.Symbol, spread.Value, deltaSign, delta.Abs())
+	loggerFromContext(ctx).WithField("symbol", spread.Symbol).Infof(
+		"%s: %s (%s%s)", spread.Symbol, spread.Value, deltaSign, delta.Abs())
+}
+
+func newSpreadSample(m *SpreadMetric) *SpreadSample {
+	sample := &SpreadSample{
+		Time:       m.timestamp,
+		Symbol:     m.spread.Symbol,
+		HighestBid: m.spread.HighestBid,
+		LowestAsk:  m.spread.LowestAsk,
+		Spread:     m.spread.Value,
+		Delta:      m.delta,
+	}
+	if m.notional != nil {
+		sample.BidsNotional = &m.notional.BidsTotal
+		sample.AsksNotional = &m.notional.AsksTotal
+	}
+	return sample
 }
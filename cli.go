@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	EXIT_OK      = 0
+	EXIT_ERROR   = 1
+	EXIT_USAGE   = 2
+	EXIT_PARTIAL = 3
+
+	OUTPUT_TABLE = "table"
+	OUTPUT_JSON  = "json"
+
+	TOP_BY_VOLUME       = "volume"
+	TOP_BY_QUOTE_VOLUME = "quote_volume"
+	TOP_BY_TRADES       = "trades"
+)
+
+// subcommands run one-shot queries without starting the HTTP server,
+// each of them returns the process exit code
+var subcommands = map[string]func(args []string) int{
+	"top":      runTop,
+	"notional": runNotional,
+	"spread":   runSpread,
+	"info":     runInfo,
+	"export":   runExport,
+	"account":  runAccount,
+}
+
+var topOrders = map[string]SymbolOrder{
+	TOP_BY_VOLUME:       ByVolume,
+	TOP_BY_QUOTE_VOLUME: ByQuoteVolume,
+	TOP_BY_TRADES:       ByTradeCount,
+}
+
+type command struct {
+	flags      *flag.FlagSet
+	apiBaseUrl string
+	output     string
+	logLevel   string
+	clock      ExchangeClock
+}
+
+type topRow struct {
+	Symbol      string          `json:"symbol"`
+	Volume      decimal.Decimal `json:"volume"`
+	QuoteVolume decimal.Decimal `json:"quoteVolume"`
+	TradeCount  int             `json:"tradeCount"`
+}
+
+type notionalRow struct {
+	Symbol    string           `json:"symbol"`
+	BidsTotal *decimal.Decimal `json:"bidsTotal,omitempty"`
+	AsksTotal *decimal.Decimal `json:"asksTotal,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+type spreadRow struct {
+	Symbol     string           `json:"symbol"`
+	HighestBid *decimal.Decimal `json:"highestBid,omitempty"`
+	LowestAsk  *decimal.Decimal `json:"lowestAsk,omitempty"`
+	Spread     *decimal.Decimal `json:"spread,omitempty"`
+	Delta      *decimal.Decimal `json:"delta,omitempty"`
+	Error      string           `json:"error,omitempty"`
+}
+
+type spreadRound struct {
+	Time    time.Time    `json:"time"`
+	Spreads []*spreadRow `json:"spreads"`
+}
+
+type symbolInfo struct {
+	Symbol *Symbol              `json:"symbol"`
+	Ticker *TickerChangeStatics `json:"ticker,omitempty"`
+}
+
+func newCommand(name string) *command {
+	c := &command{flags: flag.NewFlagSet(name, flag.ContinueOnError)}
+	c.flags.StringVar(&c.apiBaseUrl, "api-base-url", "https://api.binance.com", "public Rest API for Binance")
+	c.flags.StringVar(&c.output, "output", OUTPUT_TABLE, "output format: table or json")
+	c.flags.StringVar(&c.logLevel, "log-level", "warn", "minimum logging level, logs are written to stderr")
+	return c
+}
+
+func (c *command) parse(args []string) bool {
+	if err := c.flags.Parse(args); err != nil {
+		return false
+	}
+	if c.output != OUTPUT_TABLE && c.output != OUTPUT_JSON {
+		fmt.Fprintf(os.Stderr, "unsupported output %q\n", c.output)
+		return false
+	}
+	if err := configureLogging(c.logLevel, LOG_FORMAT_TEXT); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	return true
+}
+
+// print writes the value as json or the rows as a table, the first row is the header
+func (c *command) print(v interface{}, rows [][]string) {
+	if c.output == OUTPUT_JSON {
+		json.NewEncoder(os.Stdout).Encode(v)
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	tw.Flush()
+}
+
+// service returns the market data service with the exchange clock left
+// unsynced, the commands printing the sample time sync it on their own
+func (c *command) service() MarketDataService {
+	client := NewApiClient(c.apiBaseUrl)
+	c.clock = NewExchangeClock(client)
+	return NewMarketDataService(&client, c.clock)
+}
+
+func (c *command) symbols(name string, value string) ([]string, bool) {
+	symbols := parseSymbols(value)
+	if len(symbols) == 0 {
+		fmt.Fprintf(os.Stderr, "-%s is required\n", name)
+		return nil, false
+	}
+	return symbols, true
+}
+
+func runTop(args []string) int {
+	cmd := newCommand("top")
+	quote := cmd.flags.String("quote", "BTC", "quote asset of the symbols")
+	by := cmd.flags.String("by", TOP_BY_VOLUME, "sort by volume, quote_volume or trades over the last 24h")
+	limit := cmd.flags.Int("limit", TOP_LIMIT, "number of symbols")
+	if !cmd.parse(args) {
+		return EXIT_USAGE
+	}
+	order, ok := topOrders[*by]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unsupported sort %q\n", *by)
+		return EXIT_USAGE
+	}
+	if *limit <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid limit %d\n", *limit)
+		return EXIT_USAGE
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	symbols, err := cmd.service().GetTopSymbols(ctx, strings.ToUpper(*quote), *limit, order)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_ERROR
+	}
+
+	result := make([]*topRow, len(symbols))
+	table := [][]string{{"SYMBOL", "VOLUME", "QUOTE VOLUME", "TRADES"}}
+	for i, s := range symbols {
+		result[i] = &topRow{Symbol: s.Symbol, Volume: s.Volume, QuoteVolume: s.QuoteVolume, TradeCount: s.TradeCount}
+		table = append(table, []string{s.Symbol, s.Volume.String(), s.QuoteVolume.String(), strconv.Itoa(s.TradeCount)})
+	}
+	cmd.print(result, table)
+
+	return EXIT_OK
+}
+
+func runNotional(args []string) int {
+	cmd := newCommand("notional")
+	symbolsFlag := cmd.flags.String("symbols", "", "symbols, e.g. ETHBTC,BNBBTC")
+	depth := cmd.flags.Int("depth", NOTIONAL_DEPTH, "number of the top bids and asks to sum up")
+	if !cmd.parse(args) {
+		return EXIT_USAGE
+	}
+	symbols, ok := cmd.symbols("symbols", *symbolsFlag)
+	if !ok {
+		return EXIT_USAGE
+	}
+	if max := orderBookLimits[len(orderBookLimits)-1]; *depth <= 0 || *depth > max {
+		fmt.Fprintf(os.Stderr, "depth must be between 1 and %d\n", max)
+		return EXIT_USAGE
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	results := cmd.service().GetTotalNotionalValues(ctx, symbols, *depth)
+
+	rows := make([]*notionalRow, len(results))
+	table := [][]string{{"SYMBOL", "TOTAL BIDS", "TOTAL ASKS"}}
+	failed := 0
+	for i, r := range results {
+		if r.Err != nil {
+			failed++
+			rows[i] = &notionalRow{Symbol: r.Symbol, Error: r.Err.Error()}
+			table = append(table, []string{r.Symbol, "error: " + r.Err.Error(), ""})
+			continue
+		}
+		rows[i] = &notionalRow{Symbol: r.Symbol, BidsTotal: &r.Value.BidsTotal, AsksTotal: &r.Value.AsksTotal}
+		table = append(table, []string{r.Symbol, r.Value.BidsTotal.String(), r.Value.AsksTotal.String()})
+	}
+	cmd.print(rows, table)
+
+	return failuresExitCode(failed, len(results))
+}
+
+// runSpread prints the spreads once or, with -watch, every interval
+// with the delta from the previous value until interrupted
+func runSpread(args []string) int {
+	cmd := newCommand("spread")
+	symbolsFlag := cmd.flags.String("symbols", "", "symbols, e.g. BTCUSDT,ETHUSDT")
+	watch := cmd.flags.Duration("watch", 0, "print the spreads every interval until interrupted, e.g. 10s")
+	if !cmd.parse(args) {
+		return EXIT_USAGE
+	}
+	symbols, ok := cmd.symbols("symbols", *symbolsFlag)
+	if !ok {
+		return EXIT_USAGE
+	}
+	if *watch < 0 {
+		fmt.Fprintf(os.Stderr, "invalid watch interval %s\n", *watch)
+		return EXIT_USAGE
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	service := cmd.service()
+	if err := cmd.clock.Sync(ctx); err != nil {
+		log.WithError(err).Warn("Error occurred while syncing exchange clock, using the local time")
+	}
+	previous := make(map[string]decimal.Decimal)
+	round := func() int {
+		results := service.GetSpreads(ctx, symbols)
+		r := &spreadRound{Time: cmd.clock.Now()}
+		table := [][]string{{"SYMBOL", "HIGHEST BID", "LOWEST ASK", "SPREAD", "DELTA"}}
+		failed := 0
+		for _, res := range results {
+			if res.Err != nil {
+				failed++
+				r.Spreads = append(r.Spreads, &spreadRow{Symbol: res.Symbol, Error: res.Err.Error()})
+				table = append(table, []string{res.Symbol, "error: " + res.Err.Error(), "", "", ""})
+				continue
+			}
+			row := &spreadRow{
+				Symbol:     res.Symbol,
+				HighestBid: &res.Spread.HighestBid,
+				LowestAsk:  &res.Spread.LowestAsk,
+				Spread:     &res.Spread.Value,
+			}
+			delta := ""
+			if old, found := previous[res.Symbol]; found {
+				d := res.Spread.Value.Sub(old)
+				row.Delta = &d
+				delta = d.String()
+			}
+			previous[res.Symbol] = res.Spread.Value
+			r.Spreads = append(r.Spreads, row)
+			table = append(table, []string{res.Symbol, res.Spread.HighestBid.String(),
+				res.Spread.LowestAsk.String(), res.Spread.Value.String(), delta})
+		}
+
+		if *watch > 0 && cmd.output == OUTPUT_TABLE {
+			fmt.Println(r.Time.Format(time.RFC3339))
+		}
+		cmd.print(r, table)
+		return failuresExitCode(failed, len(results))
+	}
+
+	code := round()
+	if *watch == 0 {
+		return code
+	}
+
+	ticker := time.NewTicker(*watch)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return EXIT_OK
+		case <-ticker.C:
+			if cmd.output == OUTPUT_TABLE {
+				fmt.Println()
+			}
+			round()
+		}
+	}
+}
+
+func runInfo(args []string) int {
+	cmd := newCommand("info")
+	symbolFlag := cmd.flags.String("symbol", "", "symbol, e.g. ETHBTC")
+	if !cmd.parse(args) {
+		return EXIT_USAGE
+	}
+	symbols, ok := cmd.symbols("symbol", *symbolFlag)
+	if !ok {
+		return EXIT_USAGE
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client := NewApiClient(cmd.apiBaseUrl)
+	exchangeInfo, err := client.GetExchangeInfo(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_ERROR
+	}
+	info := &symbolInfo{}
+	for i := range exchangeInfo.Symbols {
+		if exchangeInfo.Symbols[i].Symbol == symbols[0] {
+			info.Symbol = &exchangeInfo.Symbols[i]
+		}
+	}
+	if info.Symbol == nil {
+		fmt.Fprintf(os.Stderr, "unknown symbol %s\n", symbols[0])
+		return EXIT_ERROR
+	}
+
+	// the symbol metadata is still printed when the statistics fail
+	code := EXIT_OK
+	if stats, err := client.GetTickerChangeStatistics(ctx, info.Symbol.Symbol); err == nil && len(stats) > 0 {
+		info.Ticker = stats[0]
+	} else {
+		log.WithError(err).Warn("Error occurred while getting ticker change statistics")
+		code = EXIT_PARTIAL
+	}
+
+	s := info.Symbol
+	table := [][]string{
+		{"Symbol", s.Symbol},
+		{"Status", s.Status},
+		{"Base asset", fmt.Sprintf("%s (precision %d)", s.Baseasset, s.Baseassetprecision)},
+		{"Quote asset", fmt.Sprintf("%s (precision %d)", s.Quoteasset, s.Quoteassetprecision)},
+		{"Order types", strings.Join(s.Ordertypes, ", ")},
+		{"Permissions", strings.Join(s.Permissions, ", ")},
+	}
+	for _, f := range s.Filters {
+		switch f.Filtertype {
+		case "PRICE_FILTER":
+			table = append(table, []string{"Tick size", f.Ticksize})
+		case "LOT_SIZE":
+			table = append(table, []string{"Step size", f.Stepsize})
+		case "MIN_NOTIONAL", "NOTIONAL":
+			table = append(table, []string{"Min notional", f.Minnotional})
+		}
+	}
+	if t := info.Ticker; t != nil {
+		table = append(table,
+			[]string{"Last price", t.Lastprice},
+			[]string{"Price change 24h", t.Pricechangepercent + "%"},
+			[]string{"Volume 24h", t.Volume},
+			[]string{"Quote volume 24h", t.Quotevolume},
+			[]string{"Trades 24h", strconv.Itoa(t.Tradecount)},
+		)
+	}
+	cmd.print(info, table)
+
+	return code
+}
+
+// runAccount prints the non-zero balances of the account,
+// the api key and the secret are required
+func runAccount(args []string) int {
+	cmd := newCommand("account")
+	var config CredentialsConfig
+	credentialsFlags(cmd.flags, &config)
+	if !cmd.parse(args) {
+		return EXIT_USAGE
+	}
+	creds, err := LoadCredentials(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_USAGE
+	}
+	if creds == nil {
+		fmt.Fprintf(os.Stderr, "api credentials are required, set -api-key-file and -api-secret-file or %s and %s\n",
+			ENV_API_KEY, ENV_API_SECRET)
+		return EXIT_USAGE
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// the request timestamp must be within the recv window of the exchange time
+	client := NewApiClient(cmd.apiBaseUrl)
+	clock := NewExchangeClock(client)
+	if err := clock.Sync(ctx); err != nil {
+		log.WithError(err).Warn("Error occurred while syncing exchange clock, using the local time")
+	}
+	client.SetCredentials(creds, clock)
+
+	account, err := client.GetAccount(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_ERROR
+	}
+
+	table := [][]string{{"ASSET", "FREE", "LOCKED"}}
+	for _, b := range account.Balances {
+		table = append(table, []string{b.Asset, b.Free, b.Locked})
+	}
+	cmd.print(account, table)
+
+	return EXIT_OK
+}
+
+func credentialsFlags(flags *flag.FlagSet, c *CredentialsConfig) {
+	flags.StringVar(&c.KeyType, "api-key-type", KEY_TYPE_HMAC, "api key type: hmac or ed25519")
+	flags.StringVar(&c.KeyFile, "api-key-file", "", "file with the api key, "+ENV_API_KEY+" env when empty")
+	flags.StringVar(&c.SecretFile, "api-secret-file", "", "file with the hmac secret or the ed25519 private key, "+ENV_API_SECRET+" env when empty")
+	flags.DurationVar(&c.RecvWindow, "recv-window", DEFAULT_RECV_WINDOW, "validity window of the signed requests")
+}
+
+// failuresExitCode tells apart the partial failure of a batch,
+// so the scripts may still use the results of the healthy symbols
+func failuresExitCode(failed int, total int) int {
+	switch {
+	case failed == 0:
+		return EXIT_OK
+	case failed < total:
+		return EXIT_PARTIAL
+	}
+	return EXIT_ERROR
+}
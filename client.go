@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"io/ioutil"
@@ -13,7 +14,10 @@ import (
 	"time"
 
 	"github.com/patrickmn/go-cache"
-	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -24,15 +28,54 @@ var (
 const EXCHANGE_INFO_KEY = "exchangeInfo"
 
 type ApiClient interface {
-	GetExchangeInfo() (*ExchangeInfoResponse, error)
-	GetTickerChangeStatistics(symbol string) ([]*TickerChangeStatics, error)
-	GetOrderBook(symbol string, limit int) (*OrderBook, error)
+	GetExchangeInfo(ctx context.Context) (*ExchangeInfoResponse, error)
+	GetServerTime(ctx context.Context) (time.Time, error)
+	GetTickerChangeStatistics(ctx context.Context, symbol string) ([]*TickerChangeStatics, error)
+	GetTickerRows(ctx context.Context, keep func(symbol string) bool) ([]*TickerRow, error)
+	GetOrderBook(ctx context.Context, symbol string, limit int) (*OrderBook, error)
+	GetBookTicker(ctx context.Context, symbols []string) ([]*BookTicker, error)
+	GetKlines(ctx context.Context, query *KlinesQuery) ([]*Kline, error)
+	GetRecentTrades(ctx context.Context, symbol string, limit int) ([]*Trade, error)
+	GetAggTrades(ctx context.Context, query *AggTradesQuery) ([]*AggTrade, error)
+	GetAccount(ctx context.Context) (*Account, error)
+	GetPublic(ctx context.Context, path string, params url.Values) ([]byte, error)
+	SetCredentials(creds *Credentials, clock ExchangeClock)
+	UsedWeight() (used int, limit int, at time.Time)
+	ExchangeInfoUpdatedAt() time.Time
+}
+
+type KlinesQuery struct {
+	Symbol    string
+	Interval  string
+	StartTime time.Time
+	EndTime   time.Time
+	Limit     int
+}
+
+type AggTradesQuery struct {
+	Symbol    string
+	FromID    int64
+	StartTime time.Time
+	EndTime   time.Time
+	Limit     int
 }
 
 type client struct {
 	apiBaseUrl  string
 	infoCache   *cache.Cache
 	tickerCache *cache.Cache
+	klineCache  *cache.Cache
+	books       *orderBookFetcher
+
+	// the request weight used in the current minute as reported by
+	// the last response, the limit and the time of the exchange info
+	mu            sync.Mutex
+	credentials   *Credentials
+	clock         ExchangeClock
+	usedWeight    int
+	weightLimit   int
+	weightAt      time.Time
+	infoUpdatedAt time.Time
 }
 
 func NewApiClient(baseUrl string) ApiClient {
@@ -42,36 +85,92 @@ func NewApiClient(baseUrl string) ApiClient {
 			apiBaseUrl:  baseUrl,
 			infoCache:   cache.New(time.Duration(10)*time.Minute, time.Duration(10)*time.Minute),
 			tickerCache: cache.New(time.Duration(1)*time.Second, time.Duration(1)*time.Second),
+			klineCache:  cache.New(time.Duration(10)*time.Second, time.Duration(1)*time.Minute),
 		}
+		instance.books = newOrderBookFetcher(instance.fetchOrderBook)
 	})
 
 	return instance
 }
 
-func (c *client) GetExchangeInfo() (*ExchangeInfoResponse, error) {
+func (c *client) GetExchangeInfo(ctx context.Context) (*ExchangeInfoResponse, error) {
 	var info *ExchangeInfoResponse
-	if x, found := c.infoCache.Get(EXCHANGE_INFO_KEY); found {
+	x, found := c.infoCache.Get(EXCHANGE_INFO_KEY)
+	observeCache("exchange_info", found)
+	if found {
 		info = x.(*ExchangeInfoResponse)
-		log.Debug("Used cache to get exchange info")
+		loggerFromContext(ctx).Debug("Used cache to get exchange info")
 		return info, nil
 	}
 
-	err := c.restRequest(http.MethodGet, "/api/v3/exchangeInfo", nil, &info, nil)
+	err := c.restRequest(ctx, http.MethodGet, "/api/v3/exchangeInfo", nil, &info, nil)
 	if err != nil {
-		log.Error(err.Error())
+		loggerFromContext(ctx).Error(err.Error())
 		return nil, err
 	}
 
 	c.infoCache.SetDefault(EXCHANGE_INFO_KEY, info)
+	c.mu.Lock()
+	c.infoUpdatedAt = time.Now()
+	for _, l := range info.RateLimits {
+		if l.RateLimitType == "REQUEST_WEIGHT" && l.Interval == "MINUTE" && l.IntervalNum == 1 {
+			c.weightLimit = l.Limit
+		}
+	}
+	c.mu.Unlock()
 
 	return info, nil
 }
 
-func (c *client) GetTickerChangeStatistics(symbol string) ([]*TickerChangeStatics, error) {
+func (c *client) GetServerTime(ctx context.Context) (time.Time, error) {
+	var res ServerTimeResponse
+	err := c.restRequest(ctx, http.MethodGet, "/api/v3/time", nil, &res, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return fromMillis(res.ServerTime), nil
+}
+
+func (c *client) ExchangeInfoUpdatedAt() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.infoUpdatedAt
+}
+
+// UsedWeight returns the request weight used in the current minute, the time
+// of the response it was reported by and the limit, zero until it's known
+func (c *client) UsedWeight() (used int, limit int, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.usedWeight, c.weightLimit, c.weightAt
+}
+
+func (c *client) observeWeight(header http.Header) {
+	weight := header.Get("x-mbx-used-weight-1m")
+	if weight == "" {
+		weight = header.Get("x-mbx-used-weight")
+	}
+	used, err := strconv.Atoi(weight)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.usedWeight = used
+	c.weightAt = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *client) GetTickerChangeStatistics(ctx context.Context, symbol string) ([]*TickerChangeStatics, error) {
 	var stats []*TickerChangeStatics
-	if x, found := c.tickerCache.Get(symbol); found {
+	x, found := c.tickerCache.Get(symbol)
+	observeCache("ticker", found)
+	if found {
 		stats = x.([]*TickerChangeStatics)
-		log.Debug("Used cache to get ticker change statistics")
+		loggerFromContext(ctx).Debug("Used cache to get ticker change statistics")
 		return stats, nil
 	}
 
@@ -79,16 +178,16 @@ func (c *client) GetTickerChangeStatistics(symbol string) ([]*TickerChangeStatic
 		v := url.Values{}
 		v.Set("symbol", symbol)
 		var item TickerChangeStatics
-		err := c.restRequest(http.MethodGet, "/api/v3/ticker/24hr", nil, &item, v)
+		err := c.restRequest(ctx, http.MethodGet, "/api/v3/ticker/24hr", nil, &item, v)
 		if err != nil {
-			log.Error(err.Error())
+			loggerFromContext(ctx).Error(err.Error())
 			return nil, err
 		}
 		stats = []*TickerChangeStatics{&item}
 	} else {
-		err := c.restRequest(http.MethodGet, "/api/v3/ticker/24hr", nil, &stats, nil)
+		err := c.restRequest(ctx, http.MethodGet, "/api/v3/ticker/24hr", nil, &stats, nil)
 		if err != nil {
-			log.Error(err.Error())
+			loggerFromContext(ctx).Error(err.Error())
 			return nil, err
 		}
 	}
@@ -98,13 +197,47 @@ func (c *client) GetTickerChangeStatistics(symbol string) ([]*TickerChangeStatic
 	return stats, nil
 }
 
-func (c *client) GetOrderBook(symbol string, limit int) (*OrderBook, error) {
+// GetTickerRows decodes the 24hr statistics of all the symbols row by row
+// from the response stream, only the rows of the kept symbols are returned,
+// so the multi-megabyte payload is never held in memory as a whole
+func (c *client) GetTickerRows(ctx context.Context, keep func(symbol string) bool) ([]*TickerRow, error) {
+	var rows []*TickerRow
+	err := c.restStream(ctx, http.MethodGet, "/api/v3/ticker/24hr", nil, "", nil, func(body io.Reader) error {
+		dec := json.NewDecoder(body)
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		for dec.More() {
+			var row TickerRow
+			if err := dec.Decode(&row); err != nil {
+				return err
+			}
+			if keep(row.Symbol) {
+				rows = append(rows, &row)
+			}
+		}
+		_, err := dec.Token()
+		return err
+	})
+	if err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func (c *client) GetOrderBook(ctx context.Context, symbol string, limit int) (*OrderBook, error) {
+	return c.books.Get(ctx, symbol, limit)
+}
+
+func (c *client) fetchOrderBook(ctx context.Context, symbol string, limit int) (*OrderBook, error) {
 	v := url.Values{}
 	v.Set("limit", strconv.Itoa(limit))
 	v.Set("symbol", symbol)
 
 	var orderBook OrderBook
-	err := c.restRequest(http.MethodGet, "/api/v3/depth", nil, &orderBook, v)
+	err := c.restRequest(ctx, http.MethodGet, "/api/v3/depth", nil, &orderBook, v)
 	if err != nil {
 		return nil, err
 	}
@@ -112,12 +245,232 @@ func (c *client) GetOrderBook(symbol string, limit int) (*OrderBook, error) {
 	return &orderBook, nil
 }
 
-func (c *client) restRequest(verb string, path string, payload interface{},
+// GetBookTicker returns the best price and quantity on the order books
+// of the symbols, all the symbols are returned when none is given
+func (c *client) GetBookTicker(ctx context.Context, symbols []string) ([]*BookTicker, error) {
+	v := url.Values{}
+	switch len(symbols) {
+	case 0:
+	case 1:
+		v.Set("symbol", symbols[0])
+		var ticker BookTicker
+		err := c.restRequest(ctx, http.MethodGet, "/api/v3/ticker/bookTicker", nil, &ticker, v)
+		if err != nil {
+			return nil, err
+		}
+		return []*BookTicker{&ticker}, nil
+	default:
+		list, err := json.Marshal(symbols)
+		if err != nil {
+			return nil, err
+		}
+		v.Set("symbols", string(list))
+	}
+
+	var tickers []*BookTicker
+	err := c.restRequest(ctx, http.MethodGet, "/api/v3/ticker/bookTicker", nil, &tickers, v)
+	if err != nil {
+		return nil, err
+	}
+
+	return tickers, nil
+}
+
+// GetKlines moves the start and the end of the query to the open times of the
+// klines, which selects the same klines, so the queries ending now share the
+// cache key until the next kline opens
+func (c *client) GetKlines(ctx context.Context, q *KlinesQuery) ([]*Kline, error) {
+	start, end := q.StartTime, q.EndTime
+	if interval, found := klineIntervals[q.Interval]; found {
+		if !start.IsZero() {
+			start = klineOpenTime(start, interval, true)
+		}
+		if !end.IsZero() {
+			end = klineOpenTime(end, interval, false)
+		}
+		// no kline opens within the window
+		if !start.IsZero() && !end.IsZero() && start.After(end) {
+			return []*Kline{}, nil
+		}
+	}
+
+	v := url.Values{}
+	v.Set("symbol", q.Symbol)
+	v.Set("interval", q.Interval)
+	if !start.IsZero() {
+		v.Set("startTime", strconv.FormatInt(toMillis(start), 10))
+	}
+	if !end.IsZero() {
+		v.Set("endTime", strconv.FormatInt(toMillis(end), 10))
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	key := v.Encode()
+	var klines []*Kline
+	x, found := c.klineCache.Get(key)
+	observeCache("kline", found)
+	if found {
+		klines = x.([]*Kline)
+		loggerFromContext(ctx).Debug("Used cache to get klines")
+		return klines, nil
+	}
+
+	err := c.restRequest(ctx, http.MethodGet, "/api/v3/klines", nil, &klines, v)
+	if err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+		return nil, err
+	}
+
+	// closed klines never change, so the historical windows
+	// are kept much longer than the ones including the current kline
+	ttl := cache.DefaultExpiration
+	if n := len(klines); n > 0 && fromMillis(klines[n-1].CloseTime).Before(time.Now()) &&
+		!q.EndTime.IsZero() && q.EndTime.Before(time.Now()) {
+		ttl = time.Duration(1) * time.Hour
+	}
+	c.klineCache.Set(key, klines, ttl)
+
+	return klines, nil
+}
+
+func (c *client) GetRecentTrades(ctx context.Context, symbol string, limit int) ([]*Trade, error) {
+	v := url.Values{}
+	v.Set("symbol", symbol)
+	if limit > 0 {
+		v.Set("limit", strconv.Itoa(limit))
+	}
+
+	var trades []*Trade
+	err := c.restRequest(ctx, http.MethodGet, "/api/v3/trades", nil, &trades, v)
+	if err != nil {
+		return nil, err
+	}
+
+	return trades, nil
+}
+
+func (c *client) GetAggTrades(ctx context.Context, q *AggTradesQuery) ([]*AggTrade, error) {
+	v := url.Values{}
+	v.Set("symbol", q.Symbol)
+	if q.FromID > 0 {
+		v.Set("fromId", strconv.FormatInt(q.FromID, 10))
+	}
+	if !q.StartTime.IsZero() {
+		v.Set("startTime", strconv.FormatInt(toMillis(q.StartTime), 10))
+	}
+	if !q.EndTime.IsZero() {
+		v.Set("endTime", strconv.FormatInt(toMillis(q.EndTime), 10))
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	var trades []*AggTrade
+	err := c.restRequest(ctx, http.MethodGet, "/api/v3/aggTrades", nil, &trades, v)
+	if err != nil {
+		return nil, err
+	}
+
+	return trades, nil
+}
+
+// SetCredentials enables the signed endpoints, the request timestamps
+// are taken from the exchange clock
+func (c *client) SetCredentials(creds *Credentials, clock ExchangeClock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.credentials = creds
+	c.clock = clock
+}
+
+func (c *client) GetAccount(ctx context.Context) (*Account, error) {
+	var account Account
+	v := url.Values{}
+	v.Set("omitZeroBalances", "true")
+	err := c.signedRequest(ctx, http.MethodGet, "/api/v3/account", &account, v)
+	if err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+// GetPublic returns the raw body of the public endpoint, it's not cached
+func (c *client) GetPublic(ctx context.Context, path string, params url.Values) ([]byte, error) {
+	var body []byte
+	err := c.restStream(ctx, http.MethodGet, path, nil, params.Encode(), nil, func(r io.Reader) error {
+		var err error
+		body, err = ioutil.ReadAll(r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (c *client) restRequest(ctx context.Context, verb string, path string, payload interface{},
+	response interface{}, params url.Values) error {
+
+	return c.restStream(ctx, verb, path, payload, params.Encode(), nil, decodeJSON(response))
+}
+
+// signedRequest adds the timestamp in the exchange time and the recv window
+// to the params, the signature of the query string goes last as it's sent
+func (c *client) signedRequest(ctx context.Context, verb string, path string,
 	response interface{}, params url.Values) error {
 
+	c.mu.Lock()
+	creds, clock := c.credentials, c.clock
+	c.mu.Unlock()
+	if creds == nil {
+		return ErrNoCredentials
+	}
+
+	v := url.Values{}
+	for key, values := range params {
+		v[key] = values
+	}
+	v.Set("timestamp", strconv.FormatInt(toMillis(clock.Now()), 10))
+	if creds.RecvWindow > 0 {
+		v.Set("recvWindow", strconv.FormatInt(creds.RecvWindow.Milliseconds(), 10))
+	}
+	query := v.Encode()
+	query += "&signature=" + url.QueryEscape(creds.sign(query))
+
+	header := http.Header{}
+	header.Set(API_KEY_HEADER, creds.ApiKey)
+	return c.restStream(ctx, verb, path, nil, query, header, decodeJSON(response))
+}
+
+func decodeJSON(response interface{}) func(body io.Reader) error {
+	return func(body io.Reader) error {
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, &response)
+	}
+}
+
+// restStream hands the body of the successful response to decode,
+// the error responses are decoded to the ApiError
+func (c *client) restStream(ctx context.Context, verb string, path string, payload interface{},
+	query string, header http.Header, decode func(body io.Reader) error) (err error) {
+
+	ctx, span := tracer.Start(ctx, verb+" "+path, trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		recordError(span, err)
+		span.End()
+	}()
+
 	url := c.apiBaseUrl + path
-	if len(params) != 0 {
-		url = updateUri(url, params)
+	if query != "" {
+		url = updateUri(url, query)
 	}
 
 	var body io.Reader
@@ -129,47 +482,110 @@ func (c *client) restRequest(verb string, path string, payload interface{},
 		body = bytes.NewBuffer(jsonStr)
 	}
 
-	req, err := http.NewRequest(verb, url, body)
+	req, err := http.NewRequestWithContext(ctx, verb, url, body)
 	if err != nil {
 		return err
 	}
 
+	for key := range header {
+		req.Header.Set(key, header.Get(key))
+	}
 	req.Header.Set("Content-Type", "application/json")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	span.SetAttributes(semconv.HTTPClientAttributesFromHTTPRequest(req)...)
 
-	log.Debugf("Starting request %s %s", verb, url)
+	loggerFromContext(ctx).Debugf("Starting request %s %s", verb, url)
+	start := time.Now()
 	res, err := http.DefaultClient.Do(req)
 
 	if err != nil {
+		apiRequestDuration.WithLabelValues(path, "error").Observe(time.Since(start).Seconds())
 		return err
 	}
+	defer res.Body.Close()
 
+	c.observeWeight(res.Header)
 	if weight := res.Header.Get("x-mbx-used-weight"); weight != "" {
-		log.WithField("weight-used", weight).Debugf("Completed request %s %s", verb, url)
+		loggerFromContext(ctx).WithField("weight-used", weight).Debugf("Completed request %s %s", verb, url)
 	} else {
-		log.Debugf("Completed request %s %s", verb, url)
+		loggerFromContext(ctx).Debugf("Completed request %s %s", verb, url)
+	}
+
+	span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(res.StatusCode)...)
+
+	if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		err = decode(res.Body)
+		apiRequestDuration.WithLabelValues(path, strconv.Itoa(res.StatusCode)).Observe(time.Since(start).Seconds())
+		return err
 	}
 
 	data, err := ioutil.ReadAll(res.Body)
+	apiRequestDuration.WithLabelValues(path, strconv.Itoa(res.StatusCode)).Observe(time.Since(start).Seconds())
 	if err != nil {
 		return err
 	}
 
-	if res.StatusCode < 200 || res.StatusCode > 299 {
-		var apierr ApiError
-		if err = json.Unmarshal(data, &apierr); err != nil {
-			return err
+	var apierr ApiError
+	if err = json.Unmarshal(data, &apierr); err != nil {
+		apiErrors.WithLabelValues(path, "unknown").Inc()
+		return err
+	}
+	apiErrors.WithLabelValues(path, strconv.Itoa(apierr.Code)).Inc()
+	apierr.Status = res.StatusCode
+	apierr.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+	return &apierr
+}
+
+// parseRetryAfter reads the delay in seconds the API sends, or the date
+// the header may also have; zero when it's absent or already passed
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
 		}
-		return &apierr
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// klineOpenTime returns the open time of the kline of the interval the time
+// is in, or of the next one when up is set and the time is not an open time;
+// the klines open at the multiples of the interval since the epoch, and the
+// weekly ones on Mondays
+func klineOpenTime(t time.Time, interval time.Duration, up bool) time.Time {
+	var offset int64
+	if interval == klineIntervals["1w"] {
+		// the epoch was on a Thursday
+		offset = int64(4 * 24 * time.Hour / time.Millisecond)
 	}
+	step := int64(interval / time.Millisecond)
+	ms := toMillis(t) - offset
+	open := ms - ms%step
+	if up && open != ms {
+		open += step
+	}
+	return fromMillis(open + offset)
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
 
-	return json.Unmarshal(data, &response)
+func fromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
 }
 
-func updateUri(uri string, params url.Values) string {
+func updateUri(uri string, query string) string {
 	if strings.Contains(uri, "?") {
 		uri += "&"
 	} else {
 		uri += "?"
 	}
-	return uri + params.Encode()
+	return uri + query
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// newTestClient builds a client of the base url, NewApiClient returns
+// the process wide instance of the first url it was called with
+func newTestClient(baseUrl string) *client {
+	c := &client{
+		apiBaseUrl:  baseUrl,
+		infoCache:   cache.New(time.Duration(10)*time.Minute, time.Duration(10)*time.Minute),
+		tickerCache: cache.New(time.Duration(1)*time.Second, time.Duration(1)*time.Second),
+		klineCache:  cache.New(time.Duration(10)*time.Second, time.Duration(1)*time.Minute),
+	}
+	c.books = newOrderBookFetcher(c.fetchOrderBook)
+	return c
+}
+
+// tickerPayload builds the 24hr statistics of n symbols in the format and
+// the size of the payload of all the symbols the API returns, a quarter of
+// them are quoted in USDT
+func tickerPayload(n int) []byte {
+	quotes := []string{"USDT", "BTC", "ETH", "FDUSD"}
+	closeTime := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano() / int64(time.Millisecond)
+	stats := make([]*TickerChangeStatics, n)
+	for i := range stats {
+		price := fmt.Sprintf("%d.%08d", 1+i%5000, i*7919%100000000)
+		stats[i] = &TickerChangeStatics{
+			Symbol:             fmt.Sprintf("A%04d%s", i, quotes[i%len(quotes)]),
+			Pricechange:        "-0.12300000",
+			Pricechangepercent: "-1.234",
+			Weightedavgprice:   price,
+			Prevcloseprice:     price,
+			Lastprice:          price,
+			Lastqty:            "0.01000000",
+			Bidprice:           price,
+			Askprice:           price,
+			Openprice:          price,
+			Highprice:          price,
+			Lowprice:           price,
+			Volume:             fmt.Sprintf("%d.%08d", i*31%1000000, i),
+			Quotevolume:        fmt.Sprintf("%d.%08d", i*17%10000000, i),
+			Opentime:           closeTime - int64(24*time.Hour/time.Millisecond),
+			Closetime:          closeTime,
+			Firsttradeid:       i * 1000,
+			Lasttradeid:        i*1000 + i%997,
+			Tradecount:         i % 997,
+		}
+	}
+	data, _ := json.Marshal(stats)
+	return data
+}
+
+// BenchmarkGetTickerRows compares the row by row decode of the tickers of one
+// quote asset with the decode of all the full statistics it replaced
+func BenchmarkGetTickerRows(b *testing.B) {
+	payload := tickerPayload(2500)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(payload)
+	}))
+	defer srv.Close()
+	c := newTestClient(srv.URL)
+	ctx := context.Background()
+	usdt := func(symbol string) bool { return strings.HasSuffix(symbol, "USDT") }
+
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(payload)))
+		for i := 0; i < b.N; i++ {
+			rows, err := c.GetTickerRows(ctx, usdt)
+			if err != nil || len(rows) != 625 {
+				b.Fatalf("got %d rows: %v", len(rows), err)
+			}
+		}
+	})
+
+	b.Run("decode_all", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(payload)))
+		for i := 0; i < b.N; i++ {
+			var stats []*TickerChangeStatics
+			if err := c.restRequest(ctx, http.MethodGet, "/api/v3/ticker/24hr", nil, &stats, nil); err != nil {
+				b.Fatal(err)
+			}
+			var rows []*TickerRow
+			for _, s := range stats {
+				if usdt(s.Symbol) {
+					rows = append(rows, s.Row())
+				}
+			}
+			if len(rows) != 625 {
+				b.Fatalf("got %d rows", len(rows))
+			}
+		}
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-1", 0},
+		{"Thu, 01 Jan 2026 00:00:30 GMT", 30 * time.Second},
+		{"Wed, 31 Dec 2025 23:59:00 GMT", 0},
+		{"soon", 0},
+	} {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestKlineOpenTime(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	for _, tt := range []struct {
+		interval string
+		t        string
+		up       bool
+		want     string
+	}{
+		{"1m", "2026-01-01T12:00:10.5Z", false, "2026-01-01T12:00:00Z"},
+		{"1m", "2026-01-01T12:00:10.5Z", true, "2026-01-01T12:01:00Z"},
+		{"1m", "2026-01-01T12:00:00Z", true, "2026-01-01T12:00:00Z"},
+		{"4h", "2026-01-01T05:59:59Z", false, "2026-01-01T04:00:00Z"},
+		{"1d", "2026-01-01T23:00:00Z", true, "2026-01-02T00:00:00Z"},
+		// Monday
+		{"1w", "2026-01-01T00:00:00Z", false, "2025-12-29T00:00:00Z"},
+		{"1w", "2026-01-01T00:00:00Z", true, "2026-01-05T00:00:00Z"},
+	} {
+		got := klineOpenTime(at(tt.t), klineIntervals[tt.interval], tt.up)
+		if !got.Equal(at(tt.want)) {
+			t.Errorf("%s %s up %v: got %s, want %s", tt.interval, tt.t, tt.up, got.UTC(), tt.want)
+		}
+	}
+}
+
+// TestGetKlinesCacheKey queries the window ending now twice within a kline,
+// the second query is answered from the cache
+func TestGetKlinesCacheKey(t *testing.T) {
+	var queries []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		queries = append(queries, req.URL.Query())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+	c := newTestClient(srv.URL)
+
+	end := time.Date(2026, 1, 1, 12, 0, 10, 500000000, time.UTC)
+	for _, now := range []time.Time{end, end.Add(9 * time.Second)} {
+		_, err := c.GetKlines(context.Background(), &KlinesQuery{
+			Symbol: "BTCUSDT", Interval: "1m", StartTime: now.Add(-time.Hour), EndTime: now,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(queries) != 1 {
+		t.Fatalf("the api was called %d times, want once", len(queries))
+	}
+	for key, want := range map[string]string{
+		"startTime": "1767265260000", // 11:01, the first kline opening after the start
+		"endTime":   "1767268800000", // 12:00, the open time of the kline of the end
+	} {
+		if got := queries[0].Get(key); got != want {
+			t.Errorf("%s %s, want %s", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	CLOCK_SYNC_SAMPLES = 5
+	CLOCK_SYNC_TIMEOUT = time.Duration(5) * time.Second
+)
+
+// ClockOffset is the estimated difference of the exchange clock from
+// the local one, positive when the exchange is ahead
+type ClockOffset struct {
+	Offset    time.Duration
+	RoundTrip time.Duration
+	At        time.Time
+}
+
+// ExchangeClock tells the exchange time from the local clock and the
+// offset estimated from the server time, the local time until the first sync
+type ExchangeClock interface {
+	Now() time.Time
+	Offset() (*ClockOffset, bool)
+	Sync(ctx context.Context) error
+	Start(ctx context.Context, interval time.Duration)
+}
+
+type exchangeClock struct {
+	client ApiClient
+
+	mu     sync.RWMutex
+	offset *ClockOffset
+}
+
+func NewExchangeClock(client ApiClient) ExchangeClock {
+	return &exchangeClock{client: client}
+}
+
+func (c *exchangeClock) Now() time.Time {
+	now := time.Now()
+	if o, ok := c.Offset(); ok {
+		return now.Add(o.Offset)
+	}
+	return now
+}
+
+func (c *exchangeClock) Offset() (*ClockOffset, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.offset, c.offset != nil
+}
+
+// Sync estimates the offset the way NTP does: the server time is taken at
+// the midpoint of the round trip, and the sample with the shortest round
+// trip wins, as its midpoint has the smallest error
+func (c *exchangeClock) Sync(ctx context.Context) error {
+	var best *ClockOffset
+	var lastErr error
+	for i := 0; i < CLOCK_SYNC_SAMPLES; i++ {
+		start := time.Now()
+		serverTime, err := c.client.GetServerTime(ctx)
+		end := time.Now()
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		rtt := end.Sub(start)
+		sample := &ClockOffset{Offset: serverTime.Sub(start.Add(rtt / 2)), RoundTrip: rtt, At: end}
+		if best == nil || sample.RoundTrip < best.RoundTrip {
+			best = sample
+		}
+	}
+	if best == nil {
+		if lastErr == nil {
+			lastErr = errors.New("no server time samples")
+		}
+		return lastErr
+	}
+
+	c.mu.Lock()
+	c.offset = best
+	c.mu.Unlock()
+
+	clockOffset.Set(best.Offset.Seconds())
+	clockRoundTrip.Set(best.RoundTrip.Seconds())
+	log.WithFields(log.Fields{
+		"offset":    best.Offset,
+		"roundTrip": best.RoundTrip,
+	}).Debug("Synced exchange clock")
+	return nil
+}
+
+// Start syncs the clock every interval until the context is done,
+// a failed sync keeps the previous estimate
+func (c *exchangeClock) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		syncCtx, cancel := context.WithTimeout(ctx, CLOCK_SYNC_TIMEOUT)
+		if err := c.Sync(syncCtx); err != nil {
+			clockSyncErrors.Inc()
+			log.WithError(err).Error("Error occurred while syncing exchange clock")
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/shopspring/decimal"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	SYMBOL_STATUS_TRADING = "TRADING"
+
+	CONVERSION_GRAPH_KEY = "conversionGraph"
+	CONVERSION_GRAPH_TTL = time.Duration(10) * time.Second
+	CONVERSION_MAX_HOPS  = 3
+)
+
+var (
+	ErrUnknownAsset     = errors.New("unknown asset")
+	ErrUnknownSymbol    = errors.New("unknown symbol")
+	ErrNoConversionPath = errors.New("no conversion path")
+)
+
+// ConversionRate converts one unit of the asset to the reporting currency
+// along the path of symbols, the cost is the sum of their relative spreads
+type ConversionRate struct {
+	From    string          `json:"from"`
+	To      string          `json:"to"`
+	Rate    decimal.Decimal `json:"rate"`
+	Path    []string        `json:"path"`
+	CostBps float64         `json:"costBps"`
+	Time    time.Time       `json:"time"`
+}
+
+// Conversions are the rates of all the reachable assets to the currency
+// taken from a single snapshot of the pairs and their prices
+type Conversions struct {
+	Currency string
+	symbols  map[string]Symbol
+	rates    map[string]*ConversionRate
+}
+
+type ConversionService interface {
+	GetConversions(ctx context.Context, currency string) (*Conversions, error)
+	GetRate(ctx context.Context, from string, to string) (*ConversionRate, error)
+}
+
+// conversionEdge converts the from asset to the to asset along the symbol,
+// inverse when the from asset is the quote asset of the symbol
+type conversionEdge struct {
+	from    string
+	to      string
+	symbol  string
+	inverse bool
+	mid     decimal.Decimal
+	cost    float64
+}
+
+type conversionGraph struct {
+	symbols map[string]Symbol
+	assets  map[string]bool
+	edges   []*conversionEdge
+	at      time.Time
+
+	mu          sync.Mutex
+	conversions map[string]*Conversions
+}
+
+type conversion struct {
+	client ApiClient
+	clock  ExchangeClock
+	cache  *cache.Cache
+
+	// the requests arriving while the graph is built wait for it
+	mu sync.Mutex
+}
+
+func NewConversionService(c *ApiClient, clock ExchangeClock) ConversionService {
+	return &conversion{
+		client: *c,
+		clock:  clock,
+		cache:  cache.New(CONVERSION_GRAPH_TTL, CONVERSION_GRAPH_TTL),
+	}
+}
+
+func (s *conversion) GetConversions(ctx context.Context, currency string) (*Conversions, error) {
+	ctx, span := tracer.Start(ctx, "ConversionService.GetConversions",
+		trace.WithAttributes(attribute.String("currency", currency)))
+	defer span.End()
+
+	g, err := s.graph(ctx)
+	if err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+	conversions, err := g.conversionsTo(currency)
+	if err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+	return conversions, nil
+}
+
+func (s *conversion) GetRate(ctx context.Context, from string, to string) (*ConversionRate, error) {
+	conversions, err := s.GetConversions(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+	return conversions.Rate(from)
+}
+
+// graph builds the pairs of the trading symbols weighted by the relative
+// spread of their book tickers, all taken from a single call
+func (s *conversion) graph(ctx context.Context) (*conversionGraph, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	x, found := s.cache.Get(CONVERSION_GRAPH_KEY)
+	observeCache("conversion_graph", found)
+	if found {
+		return x.(*conversionGraph), nil
+	}
+
+	info, err := s.client.GetExchangeInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tickers, err := s.client.GetBookTicker(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &conversionGraph{
+		symbols:     make(map[string]Symbol, len(info.Symbols)),
+		assets:      make(map[string]bool),
+		at:          s.clock.Now(),
+		conversions: make(map[string]*Conversions),
+	}
+	for _, symbol := range info.Symbols {
+		if symbol.Status != SYMBOL_STATUS_TRADING {
+			continue
+		}
+		g.symbols[symbol.Symbol] = symbol
+		g.assets[symbol.Baseasset] = true
+		g.assets[symbol.Quoteasset] = true
+	}
+	// the symbols with an empty or invalid book have no price to convert at
+	for _, t := range tickers {
+		symbol, found := g.symbols[t.Symbol]
+		if !found {
+			continue
+		}
+		spread, err := validateBookTicker(t)
+		if err != nil {
+			continue
+		}
+		mid := spread.MidPrice()
+		cost, _ := spread.Value.Div(mid).Float64()
+		g.edges = append(g.edges,
+			&conversionEdge{from: symbol.Baseasset, to: symbol.Quoteasset, symbol: t.Symbol, mid: mid, cost: cost},
+			&conversionEdge{from: symbol.Quoteasset, to: symbol.Baseasset, symbol: t.Symbol, inverse: true, mid: mid, cost: cost},
+		)
+	}
+
+	s.cache.SetDefault(CONVERSION_GRAPH_KEY, g)
+	loggerFromContext(ctx).Debugf("Built conversion graph of %d assets and %d pairs", len(g.assets), len(g.edges)/2)
+	return g, nil
+}
+
+// conversionsTo finds the cheapest paths of at most CONVERSION_MAX_HOPS
+// pairs from the currency to every asset, the hop bounded Bellman-Ford
+// keeps the shorter path of the same cost
+func (g *conversionGraph) conversionsTo(currency string) (*Conversions, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if conversions, found := g.conversions[currency]; found {
+		return conversions, nil
+	}
+	if !g.assets[currency] {
+		return nil, fmt.Errorf("%w %s", ErrUnknownAsset, currency)
+	}
+
+	type route struct {
+		cost float64
+		legs []*conversionEdge
+	}
+	routes := map[string]*route{currency: {}}
+	for hop := 0; hop < CONVERSION_MAX_HOPS; hop++ {
+		next := make(map[string]*route, len(routes))
+		for asset, r := range routes {
+			next[asset] = r
+		}
+		for _, e := range g.edges {
+			r, found := routes[e.from]
+			if !found {
+				continue
+			}
+			cost := r.cost + e.cost
+			if best, found := next[e.to]; found && best.cost <= cost {
+				continue
+			}
+			legs := append(append(make([]*conversionEdge, 0, len(r.legs)+1), r.legs...), e)
+			next[e.to] = &route{cost: cost, legs: legs}
+		}
+		routes = next
+	}
+
+	conversions := &Conversions{
+		Currency: currency,
+		symbols:  g.symbols,
+		rates:    make(map[string]*ConversionRate, len(routes)),
+	}
+	for asset, r := range routes {
+		// the route converts the currency to the asset,
+		// so the rate of the asset is taken along the reversed legs
+		rate := decimal.NewFromInt(1)
+		path := make([]string, len(r.legs))
+		for i, e := range r.legs {
+			path[len(r.legs)-1-i] = e.symbol
+			if e.inverse {
+				rate = rate.Mul(e.mid)
+			} else {
+				rate = rate.Div(e.mid)
+			}
+		}
+		conversions.rates[asset] = &ConversionRate{
+			From:    asset,
+			To:      currency,
+			Rate:    rate,
+			Path:    path,
+			CostBps: r.cost * 10000,
+			Time:    g.at,
+		}
+	}
+	g.conversions[currency] = conversions
+
+	return conversions, nil
+}
+
+func (c *Conversions) Rate(asset string) (*ConversionRate, error) {
+	if rate, found := c.rates[asset]; found {
+		return rate, nil
+	}
+	return nil, fmt.Errorf("%w from %s to %s", ErrNoConversionPath, asset, c.Currency)
+}
+
+// QuoteRate converts the prices and the notional values of the symbol
+func (c *Conversions) QuoteRate(symbol string) (*ConversionRate, error) {
+	s, found := c.symbols[symbol]
+	if !found {
+		return nil, fmt.Errorf("%w %s", ErrUnknownSymbol, symbol)
+	}
+	return c.Rate(s.Quoteasset)
+}
+
+// BaseRate converts the base asset volumes of the symbol
+func (c *Conversions) BaseRate(symbol string) (*ConversionRate, error) {
+	s, found := c.symbols[symbol]
+	if !found {
+		return nil, fmt.Errorf("%w %s", ErrUnknownSymbol, symbol)
+	}
+	return c.Rate(s.Baseasset)
+}
+
+func (c *Conversions) SymbolData(d *SymbolData) (*SymbolData, error) {
+	base, err := c.BaseRate(d.Symbol)
+	if err != nil {
+		return nil, err
+	}
+	quote, err := c.QuoteRate(d.Symbol)
+	if err != nil {
+		return nil, err
+	}
+	return &SymbolData{
+		Symbol:      d.Symbol,
+		Volume:      d.Volume.Mul(base.Rate),
+		QuoteVolume: d.QuoteVolume.Mul(quote.Rate),
+		TradeCount:  d.TradeCount,
+	}, nil
+}
+
+func (c *Conversions) NotionalValue(v *TotalNotionalValue) (*TotalNotionalValue, error) {
+	quote, err := c.QuoteRate(v.Symbol)
+	if err != nil {
+		return nil, err
+	}
+	return &TotalNotionalValue{
+		Symbol:    v.Symbol,
+		AsksTotal: v.AsksTotal.Mul(quote.Rate),
+		BidsTotal: v.BidsTotal.Mul(quote.Rate),
+		Time:      v.Time,
+	}, nil
+}
+
+func (c *Conversions) Spread(s *Spread) (*Spread, error) {
+	quote, err := c.QuoteRate(s.Symbol)
+	if err != nil {
+		return nil, err
+	}
+	return &Spread{
+		Symbol:     s.Symbol,
+		HighestBid: s.HighestBid.Mul(quote.Rate),
+		LowestAsk:  s.LowestAsk.Mul(quote.Rate),
+		BidQty:     s.BidQty,
+		AskQty:     s.AskQty,
+		Value:      s.Value.Mul(quote.Rate),
+		Time:       s.Time,
+	}, nil
+}
+
+// SpreadSnapshotView converts the spreads of the view, the symbols without
+// a conversion path are reported as failed
+func (c *Conversions) SpreadSnapshotView(v *SpreadSnapshotView) *SpreadSnapshotView {
+	view := &SpreadSnapshotView{
+		Version:   v.Version,
+		UpdatedAt: v.UpdatedAt,
+		Currency:  c.Currency,
+		Spreads:   []*SpreadView{},
+		Failures:  append([]*SymbolFailure{}, v.Failures...),
+	}
+	for _, s := range v.Spreads {
+		quote, err := c.QuoteRate(s.Symbol)
+		if err != nil {
+			view.Failures = append(view.Failures, newSymbolFailure(s.Symbol, OPERATION_CONVERT, err))
+			continue
+		}
+		converted := &SpreadView{
+			Symbol:     s.Symbol,
+			Time:       s.Time,
+			HighestBid: s.HighestBid.Mul(quote.Rate),
+			LowestAsk:  s.LowestAsk.Mul(quote.Rate),
+			Spread:     s.Spread.Mul(quote.Rate),
+			Delta:      s.Delta.Mul(quote.Rate),
+		}
+		if s.BidsNotional != nil {
+			bids := s.BidsNotional.Mul(quote.Rate)
+			converted.BidsNotional = &bids
+		}
+		if s.AsksNotional != nil {
+			asks := s.AsksNotional.Mul(quote.Rate)
+			converted.AsksNotional = &asks
+		}
+		view.Spreads = append(view.Spreads, converted)
+	}
+	return view
+}
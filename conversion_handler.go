@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+func (c *controller) conversion(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	from := strings.ToUpper(strings.TrimSpace(q.Get("from")))
+	to := strings.ToUpper(strings.TrimSpace(q.Get("to")))
+	if from == "" || to == "" {
+		writeJSONError(w, http.StatusBadRequest, errors.New("both from and to assets are required"))
+		return
+	}
+
+	rate, err := c.conversions.GetRate(req.Context(), from, to)
+	if err != nil {
+		writeJSONError(w, conversionStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, rate)
+}
+
+// reportingCurrency returns the conversions to the currency of the request,
+// nil when the values are reported in the quote asset of every symbol
+func (c *controller) reportingCurrency(req *http.Request) (*Conversions, error) {
+	currency := strings.ToUpper(strings.TrimSpace(req.URL.Query().Get("currency")))
+	if currency == "" {
+		return nil, nil
+	}
+	return c.conversions.GetConversions(req.Context(), currency)
+}
+
+func conversionStatus(err error) int {
+	if errors.Is(err, ErrUnknownAsset) || errors.Is(err, ErrNoConversionPath) {
+		return http.StatusBadRequest
+	}
+	return upstreamStatus(err)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/xitongsys/parquet-go/types"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	EXPORT_FORMAT_CSV     = "csv"
+	EXPORT_FORMAT_PARQUET = "parquet"
+
+	// decimals are exported to parquet as DECIMAL(38, 18) which keeps
+	// every digit of the prices, quantities and their products
+	PARQUET_DECIMAL_PRECISION = 38
+	PARQUET_DECIMAL_SCALE     = 18
+	PARQUET_DECIMAL_LENGTH    = 16
+)
+
+var exportColumns = []string{
+	"time", "symbol", "highest_bid", "lowest_ask", "spread", "delta", "bids_notional", "asks_notional",
+}
+
+var exportContentTypes = map[string]string{
+	EXPORT_FORMAT_CSV:     "text/csv",
+	EXPORT_FORMAT_PARQUET: "application/vnd.apache.parquet",
+}
+
+type parquetSpreadRow struct {
+	Time         int64   `parquet:"name=time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Symbol       string  `parquet:"name=symbol, type=BYTE_ARRAY, convertedtype=UTF8"`
+	HighestBid   string  `parquet:"name=highest_bid, type=FIXED_LEN_BYTE_ARRAY, convertedtype=DECIMAL, precision=38, scale=18, length=16"`
+	LowestAsk    string  `parquet:"name=lowest_ask, type=FIXED_LEN_BYTE_ARRAY, convertedtype=DECIMAL, precision=38, scale=18, length=16"`
+	Spread       string  `parquet:"name=spread, type=FIXED_LEN_BYTE_ARRAY, convertedtype=DECIMAL, precision=38, scale=18, length=16"`
+	Delta        string  `parquet:"name=delta, type=FIXED_LEN_BYTE_ARRAY, convertedtype=DECIMAL, precision=38, scale=18, length=16"`
+	BidsNotional *string `parquet:"name=bids_notional, type=FIXED_LEN_BYTE_ARRAY, convertedtype=DECIMAL, precision=38, scale=18, length=16, repetitiontype=OPTIONAL"`
+	AsksNotional *string `parquet:"name=asks_notional, type=FIXED_LEN_BYTE_ARRAY, convertedtype=DECIMAL, precision=38, scale=18, length=16, repetitiontype=OPTIONAL"`
+}
+
+func writeSamples(w io.Writer, format string, samples []*SpreadSample) error {
+	switch format {
+	case EXPORT_FORMAT_CSV:
+		return writeSamplesCSV(w, samples)
+	case EXPORT_FORMAT_PARQUET:
+		return writeSamplesParquet(w, samples)
+	}
+	return fmt.Errorf("unsupported format %q", format)
+}
+
+// writeSamplesCSV writes the decimals in their exact string form,
+// the missing notional values are left empty
+func writeSamplesCSV(w io.Writer, samples []*SpreadSample) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(exportColumns); err != nil {
+		return err
+	}
+	for _, s := range samples {
+		err := cw.Write([]string{
+			s.Time.UTC().Format(time.RFC3339Nano),
+			s.Symbol,
+			s.HighestBid.String(),
+			s.LowestAsk.String(),
+			s.Spread.String(),
+			s.Delta.String(),
+			optionalString(s.BidsNotional),
+			optionalString(s.AsksNotional),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeSamplesParquet(w io.Writer, samples []*SpreadSample) error {
+	pw, err := writer.NewParquetWriterFromWriter(w, new(parquetSpreadRow), 1)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range samples {
+		row, err := newParquetSpreadRow(s)
+		if err != nil {
+			return err
+		}
+		if err := pw.Write(row); err != nil {
+			return err
+		}
+	}
+	return pw.WriteStop()
+}
+
+func newParquetSpreadRow(s *SpreadSample) (*parquetSpreadRow, error) {
+	row := &parquetSpreadRow{
+		Time:   toMillis(s.Time),
+		Symbol: s.Symbol,
+	}
+
+	var err error
+	for _, f := range []struct {
+		dst *string
+		src decimal.Decimal
+	}{
+		{&row.HighestBid, s.HighestBid},
+		{&row.LowestAsk, s.LowestAsk},
+		{&row.Spread, s.Spread},
+		{&row.Delta, s.Delta},
+	} {
+		if *f.dst, err = parquetDecimal(f.src); err != nil {
+			return nil, fmt.Errorf("%s sample at %s: %w", s.Symbol, s.Time.Format(time.RFC3339), err)
+		}
+	}
+	if row.BidsNotional, err = optionalParquetDecimal(s.BidsNotional); err != nil {
+		return nil, fmt.Errorf("%s sample at %s: %w", s.Symbol, s.Time.Format(time.RFC3339), err)
+	}
+	if row.AsksNotional, err = optionalParquetDecimal(s.AsksNotional); err != nil {
+		return nil, fmt.Errorf("%s sample at %s: %w", s.Symbol, s.Time.Format(time.RFC3339), err)
+	}
+
+	return row, nil
+}
+
+// parquetDecimal encodes the unscaled value as a big-endian two's complement
+// number, the values which don't fit the column are rejected instead of rounded
+func parquetDecimal(d decimal.Decimal) (string, error) {
+	if -d.Exponent() > PARQUET_DECIMAL_SCALE {
+		return "", fmt.Errorf("decimal %s has more than %d fractional digits", d, PARQUET_DECIMAL_SCALE)
+	}
+	unscaled := d.Shift(PARQUET_DECIMAL_SCALE).StringFixed(0)
+	digits := len(unscaled)
+	if d.IsNegative() {
+		digits--
+	}
+	if digits > PARQUET_DECIMAL_PRECISION {
+		return "", fmt.Errorf("decimal %s has more than %d digits", d, PARQUET_DECIMAL_PRECISION)
+	}
+	return types.StrIntToBinary(unscaled, "BigEndian", PARQUET_DECIMAL_LENGTH, true), nil
+}
+
+func optionalParquetDecimal(d *decimal.Decimal) (*string, error) {
+	if d == nil {
+		return nil, nil
+	}
+	v, err := parquetDecimal(*d)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func optionalString(d *decimal.Decimal) string {
+	if d == nil {
+		return ""
+	}
+	return d.String()
+}
+
+// runExport is the export subcommand, it reads the history file written
+// by the server and exports the samples to stdout or the output file
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	historyFile := fs.String("history-file", "", "spread history file written by the server")
+	symbols := fs.String("symbols", "", "symbols to export, e.g. BTCUSDT,ETHUSDT, all when empty")
+	start := fs.String("start", "", "start of the range, RFC3339 or unix milliseconds")
+	end := fs.String("end", "", "end of the range (exclusive), RFC3339 or unix milliseconds")
+	format := fs.String("format", EXPORT_FORMAT_CSV, "export format: csv or parquet")
+	output := fs.String("output", "", "output file, stdout when empty")
+	if err := fs.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+
+	if *historyFile == "" {
+		fmt.Fprintln(os.Stderr, "-history-file is required")
+		return EXIT_USAGE
+	}
+	if _, ok := exportContentTypes[*format]; !ok {
+		fmt.Fprintf(os.Stderr, "unsupported format %q\n", *format)
+		return EXIT_USAGE
+	}
+	from, to, err := parseExportRange(*start, *end)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_USAGE
+	}
+
+	samples, err := readHistoryFile(*historyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_ERROR
+	}
+	samples = filterSamples(samples, parseSymbols(*symbols), from, to)
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_ERROR
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := writeSamples(w, *format, samples); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_ERROR
+	}
+	return EXIT_OK
+}
+
+func parseExportRange(start string, end string) (time.Time, time.Time, error) {
+	var from, to time.Time
+	var err error
+	if start != "" {
+		if from, err = parseTime(start); err != nil {
+			return from, to, fmt.Errorf("invalid start %q", start)
+		}
+	}
+	if end != "" {
+		if to, err = parseTime(end); err != nil {
+			return from, to, fmt.Errorf("invalid end %q", end)
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return from, to, errors.New("start must be before end")
+	}
+	return from, to, nil
+}
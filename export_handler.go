@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+func (c *controller) exportSpreads(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	format := params.Get("format")
+	if format == "" {
+		format = EXPORT_FORMAT_CSV
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("unsupported format %q", format))
+		return
+	}
+
+	from, to, err := parseExportRange(params.Get("start"), params.Get("end"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	samples := c.history.Query(parseSymbols(params.Get("symbols")), from, to)
+
+	// the file is built in memory so the error is reported
+	// as json instead of a truncated download
+	var buf bytes.Buffer
+	if err := writeSamples(&buf, format, samples); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=spreads.%s", format))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
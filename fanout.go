@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+const (
+	FETCH_CONCURRENCY    = 5
+	OPERATION_SPREAD     = "spread"
+	OPERATION_NOTIONAL   = "notional"
+	OPERATION_CONVERT    = "conversion"
+	OPERATION_ANALYTICS  = "analytics"
+	OPERATION_TOP_VOLUME = "top_volume"
+	OPERATION_TOP_TRADES = "top_trades"
+)
+
+type SymbolFailure struct {
+	Symbol    string
+	Operation string
+	Reason    string
+	Error     string
+}
+
+// fanOut calls fn for every index from 0 to n-1 running at most
+// limit calls at once, fn stores its result by index so the
+// output order always matches the input
+func fanOut(n int, limit int, fn func(i int)) {
+	if limit <= 0 {
+		limit = 1
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, limit)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// failureReason maps the error to a short reason with bounded cardinality
+// which is safe to use as a metric label
+func failureReason(err error) string {
+	var verr *ValidationError
+	var apierr *ApiError
+	var nerr net.Error
+	switch {
+	case errors.As(err, &verr):
+		return verr.Reason
+	case errors.As(err, &apierr):
+		return "api_" + strconv.Itoa(apierr.Code)
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return "timeout"
+	case errors.As(err, &nerr):
+		return "network"
+	case errors.Is(err, ErrNoConversionPath):
+		return "no_conversion_path"
+	}
+	return "error"
+}
+
+func newSymbolFailure(symbol string, operation string, err error) *SymbolFailure {
+	return &SymbolFailure{
+		Symbol:    symbol,
+		Operation: operation,
+		Reason:    failureReason(err),
+		Error:     err.Error(),
+	}
+}
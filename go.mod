@@ -3,13 +3,19 @@ module binance/home-task
 go 1.16
 
 require (
-	github.com/golang/protobuf v1.5.1 // indirect
-	github.com/heptiolabs/healthcheck v0.0.0-20180807145615-6ff867650f40 // indirect
-	github.com/jasonlvhit/gocron v0.0.1 // indirect
-	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
-	github.com/prometheus/client_golang v1.10.0 // indirect
-	github.com/prometheus/common v0.19.0 // indirect
-	github.com/shopspring/decimal v1.2.0 // indirect
-	github.com/sirupsen/logrus v1.8.1 // indirect
-	golang.org/x/sys v0.0.0-20210320140829-1e4c9ba3b0c4 // indirect
+	github.com/gorilla/websocket v1.5.0
+	github.com/heptiolabs/healthcheck v0.0.0-20180807145615-6ff867650f40
+	github.com/jasonlvhit/gocron v0.0.1
+	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/prometheus/client_golang v1.10.0
+	github.com/prometheus/common v0.19.0
+	github.com/shopspring/decimal v1.2.0
+	github.com/sirupsen/logrus v1.8.1
+	github.com/xitongsys/parquet-go v1.6.2
+	go.opentelemetry.io/otel v1.6.3
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.6.3
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.6.3
+	go.opentelemetry.io/otel/sdk v1.6.3
+	go.opentelemetry.io/otel/trace v1.6.3
+	gopkg.in/DATA-DOG/go-sqlmock.v1 v1.3.0 // indirect; imported by the tests of github.com/heptiolabs/healthcheck, which has no go.mod
 )
@@ -1,28 +1,192 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/heptiolabs/healthcheck"
 )
 
-func healtcheck() healthcheck.Handler {
-	health := healthcheck.NewHandler()
+const (
+	CHECK_LIVENESS  = "liveness"
+	CHECK_READINESS = "readiness"
 
-	// App is not ready if can't resolve the upstream dependency in DNS.
-	health.AddReadinessCheck(
-		"upstream-dep-dns",
-		healthcheck.DNSResolveCheck(apiBaseUrl, 50*time.Millisecond))
+	CHECK_STATUS_OK      = "ok"
+	CHECK_STATUS_FAILING = "failing"
+	CHECK_STATUS_PENDING = "pending"
 
-	// Add a liveness check against the API ping endpoint
-	// The check fails if the response times out or returns a non-200 status code.
-	upstreamURL := apiBaseUrl + "/api/v3/ping"
-	health.AddLivenessCheck(
-		"upstream-dep-http",
-		healthcheck.HTTPGetCheck(upstreamURL, 500*time.Millisecond))
+	UPSTREAM_CHECK_INTERVAL = time.Duration(10) * time.Second
+	UPSTREAM_CHECK_TIMEOUT  = time.Duration(2) * time.Second
+	EXCHANGE_INFO_MAX_AGE   = time.Duration(30) * time.Minute
+	DEFAULT_WEIGHT_LIMIT    = 6000
+	MIN_WEIGHT_HEADROOM     = 0.1
+)
+
+// CheckStatus is the last result of a health check
+type CheckStatus struct {
+	Name        string     `json:"name"`
+	Kind        string     `json:"kind"`
+	Status      string     `json:"status"`
+	LatencyMs   float64    `json:"latencyMs"`
+	CheckedAt   *time.Time `json:"checkedAt,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// healthChecks registers the checks with the probe handlers and keeps
+// the result of every check run for the details endpoint
+type healthChecks struct {
+	healthcheck.Handler
+
+	mu       sync.Mutex
+	statuses []*CheckStatus
+	checks   []healthcheck.Check
+}
+
+func (h *healthChecks) add(kind, name string, check healthcheck.Check, interval time.Duration) {
+	status := &CheckStatus{Name: name, Kind: kind, Status: CHECK_STATUS_PENDING}
+	tracked := func() error {
+		start := time.Now()
+		err := check()
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		status.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+		status.CheckedAt = &start
+		status.Status, status.Error = CHECK_STATUS_OK, ""
+		if err != nil {
+			status.Status, status.Error = CHECK_STATUS_FAILING, err.Error()
+			status.LastError, status.LastErrorAt = err.Error(), &start
+		}
+		return err
+	}
+
+	// the upstream checks run in the background, so the probes
+	// don't wait for the network and don't hammer the API
+	if interval > 0 {
+		tracked = healthcheck.Async(tracked, interval)
+	}
+
+	h.mu.Lock()
+	h.statuses = append(h.statuses, status)
+	h.checks = append(h.checks, tracked)
+	h.mu.Unlock()
+
+	if kind == CHECK_LIVENESS {
+		h.AddLivenessCheck(name, tracked)
+	} else {
+		h.AddReadinessCheck(name, tracked)
+	}
+}
+
+// Details runs the checks and returns their results, the background
+// checks report the result of their last run
+func (h *healthChecks) Details() []*CheckStatus {
+	h.mu.Lock()
+	checks := append([]healthcheck.Check(nil), h.checks...)
+	h.mu.Unlock()
+
+	for _, check := range checks {
+		check()
+	}
 
-	// Our app is not happy if we've got more than 100 goroutines running.
-	health.AddLivenessCheck("goroutine-threshold", healthcheck.GoroutineCountCheck(100))
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	details := make([]*CheckStatus, 0, len(h.statuses))
+	for _, s := range h.statuses {
+		c := *s
+		details = append(details, &c)
+	}
+	sort.Slice(details, func(i, j int) bool {
+		if details[i].Kind != details[j].Kind {
+			return details[i].Kind < details[j].Kind
+		}
+		return details[i].Name < details[j].Name
+	})
+	return details
+}
+
+// healtcheck leaves the liveness without checks, so an upstream outage
+// takes the app out of the rotation rather than restarting it
+func healtcheck(
+	client ApiClient, clock ExchangeClock, state StateStore, maxAge time.Duration, maxDrift time.Duration,
+) *healthChecks {
+	health := &healthChecks{Handler: healthcheck.NewHandler()}
+
+	// App has no liveness checks, the number of goroutines grows with the
+	// served connections and streams, so no fixed threshold tells a leak from the load.
+
+	// App is not ready if the API ping endpoint times out or returns a non-200 status code.
+	health.add(CHECK_READINESS, "upstream-ping",
+		healthcheck.HTTPGetCheck(apiBaseUrl+"/api/v3/ping", UPSTREAM_CHECK_TIMEOUT), UPSTREAM_CHECK_INTERVAL)
+
+	health.add(CHECK_READINESS, "exchange-info-freshness", exchangeInfoCheck(client), 0)
+	health.add(CHECK_READINESS, "rate-limit-headroom", rateLimitCheck(client), 0)
+
+	// App is not ready while the local clock drifts from the exchange,
+	// the ages of the exchange time samples are taken by the local clock.
+	health.add(CHECK_READINESS, "clock-drift", func() error {
+		o, ok := clock.Offset()
+		if !ok {
+			return errors.New("exchange clock is not synced yet")
+		}
+		if o.Offset > maxDrift || o.Offset < -maxDrift {
+			return fmt.Errorf("exchange clock offset is %s", o.Offset)
+		}
+		return nil
+	}, 0)
+
+	// App is not ready until the background worker has published
+	// the spreads, and again when its last publish is too old.
+	health.add(CHECK_READINESS, "background-recency", func() error {
+		snapshot := state.Snapshot()
+		if snapshot.Version == 0 {
+			return errors.New("no spread data published yet")
+		}
+		if age := snapshot.Age(time.Now()); age > maxAge {
+			return fmt.Errorf("spread data is %s old", age.Truncate(time.Second))
+		}
+		return nil
+	}, 0)
 
 	return health
 }
+
+// exchangeInfoCheck fails when the exchange info, which is refreshed by
+// the background job, was last fetched too long ago
+func exchangeInfoCheck(client ApiClient) healthcheck.Check {
+	return func() error {
+		updatedAt := client.ExchangeInfoUpdatedAt()
+		if updatedAt.IsZero() {
+			return errors.New("no exchange info fetched yet")
+		}
+		if age := time.Since(updatedAt); age > EXCHANGE_INFO_MAX_AGE {
+			return fmt.Errorf("exchange info is %s old", age.Truncate(time.Second))
+		}
+		return nil
+	}
+}
+
+// rateLimitCheck fails when the request weight used in the current minute
+// leaves less than the min headroom of the limit from the exchange info
+func rateLimitCheck(client ApiClient) healthcheck.Check {
+	return func() error {
+		used, limit, at := client.UsedWeight()
+		if time.Since(at) > time.Minute {
+			return nil
+		}
+		if limit <= 0 {
+			limit = DEFAULT_WEIGHT_LIMIT
+		}
+
+		if headroom := 1 - float64(used)/float64(limit); headroom < MIN_WEIGHT_HEADROOM {
+			return fmt.Errorf("used %d of %d request weight", used, limit)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+)
+
+type healthDetailsResponse struct {
+	Status string         `json:"status"`
+	Checks []*CheckStatus `json:"checks"`
+}
+
+// healthDetails lists every check with its status, latency and last error,
+// the response is informative and always succeeds unlike the probes
+func (c *controller) healthDetails(w http.ResponseWriter, req *http.Request) {
+	res := &healthDetailsResponse{Status: CHECK_STATUS_OK, Checks: c.health.Details()}
+	for _, check := range res.Checks {
+		if check.Status != CHECK_STATUS_OK {
+			res.Status = CHECK_STATUS_FAILING
+		}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestExchangeInfoCheck only reads the time of the last fetch, the
+// exchange info is refreshed by the background job
+func TestExchangeInfoCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("the check called %s", req.URL.Path)
+	}))
+	defer srv.Close()
+	c := newTestClient(srv.URL)
+	check := exchangeInfoCheck(c)
+
+	if err := check(); err == nil {
+		t.Error("passed before the exchange info was fetched")
+	}
+	c.infoUpdatedAt = time.Now().Add(-EXCHANGE_INFO_MAX_AGE + time.Minute)
+	if err := check(); err != nil {
+		t.Errorf("failed with the fresh exchange info: %v", err)
+	}
+	c.infoUpdatedAt = time.Now().Add(-EXCHANGE_INFO_MAX_AGE - time.Minute)
+	if err := check(); err == nil {
+		t.Error("passed with the stale exchange info")
+	}
+}
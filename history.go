@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+// SpreadSample is a spread and order book notional value of the
+// symbol collected by the background worker, the notional values
+// are absent when the order book totals failed on that run
+type SpreadSample struct {
+	Time         time.Time        `json:"time"`
+	Symbol       string           `json:"symbol"`
+	HighestBid   decimal.Decimal  `json:"highestBid"`
+	LowestAsk    decimal.Decimal  `json:"lowestAsk"`
+	Spread       decimal.Decimal  `json:"spread"`
+	Delta        decimal.Decimal  `json:"delta"`
+	BidsNotional *decimal.Decimal `json:"bidsNotional,omitempty"`
+	AsksNotional *decimal.Decimal `json:"asksNotional,omitempty"`
+}
+
+type HistoryStore interface {
+	Add(samples []*SpreadSample)
+	Query(symbols []string, from time.Time, to time.Time) []*SpreadSample
+}
+
+// history keeps the samples of the retention period in memory and,
+// when the path is set, appends them to a JSON lines file which is
+// loaded on startup and compacted once the expired lines pile up
+type history struct {
+	path      string
+	retention time.Duration
+
+	mu       sync.RWMutex
+	samples  []*SpreadSample
+	appended int
+}
+
+func NewHistoryStore(path string, retention time.Duration) (HistoryStore, error) {
+	h := &history{path: path, retention: retention}
+	if path == "" {
+		return h, nil
+	}
+
+	samples, err := readHistoryFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	h.samples = samples
+	h.prune(time.Now())
+	if err := h.compact(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (h *history) Add(samples []*SpreadSample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.samples = append(h.samples, samples...)
+	h.prune(time.Now())
+	if h.path == "" {
+		return
+	}
+
+	if err := h.append(samples); err != nil {
+		log.WithError(err).WithField("path", h.path).Error("Error occurred while appending spread history")
+		return
+	}
+	if h.appended > len(h.samples) {
+		if err := h.compact(); err != nil {
+			log.WithError(err).WithField("path", h.path).Error("Error occurred while compacting spread history")
+		}
+	}
+}
+
+func (h *history) Query(symbols []string, from time.Time, to time.Time) []*SpreadSample {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return filterSamples(h.samples, symbols, from, to)
+}
+
+// prune must be called with the write lock held, the samples
+// are appended in time order so the expired ones are at the head
+func (h *history) prune(now time.Time) {
+	if h.retention <= 0 {
+		return
+	}
+	cutoff := now.Add(-h.retention)
+	i := sort.Search(len(h.samples), func(i int) bool { return !h.samples[i].Time.Before(cutoff) })
+	h.samples = h.samples[i:]
+}
+
+func (h *history) append(samples []*SpreadSample) error {
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	for _, s := range samples {
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	h.appended += len(samples)
+	return nil
+}
+
+// compact rewrites the file with the retained samples only
+func (h *history) compact() error {
+	tmp := h.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, s := range h.samples {
+		if err = enc.Encode(s); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, h.path); err != nil {
+		return err
+	}
+	h.appended = len(h.samples)
+	return nil
+}
+
+// readHistoryFile loads the samples line by line, a torn last line left by
+// a crash in the middle of an append is skipped and dropped by the compaction
+// which follows, the unparseable lines before the last one fail the load
+func readHistoryFile(path string) ([]*SpreadSample, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var samples []*SpreadSample
+	var torn error
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		if torn != nil {
+			return nil, torn
+		}
+		var s SpreadSample
+		if err := json.Unmarshal(data, &s); err != nil {
+			torn = fmt.Errorf("%s:%d: %w", path, line, err)
+			continue
+		}
+		samples = append(samples, &s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if torn != nil {
+		log.WithError(torn).Warn("Skipped the torn last line of the history file")
+	}
+	return samples, nil
+}
+
+// filterSamples returns the samples of the symbols (all when empty)
+// within the [from, to) range, zero bounds are open
+func filterSamples(samples []*SpreadSample, symbols []string, from time.Time, to time.Time) []*SpreadSample {
+	wanted := make(map[string]bool, len(symbols))
+	for _, s := range symbols {
+		wanted[s] = true
+	}
+
+	var result []*SpreadSample
+	for _, s := range samples {
+		if len(wanted) > 0 && !wanted[s.Symbol] {
+			continue
+		}
+		if (!from.IsZero() && s.Time.Before(from)) || (!to.IsZero() && !s.Time.Before(to)) {
+			continue
+		}
+		result = append(result, s)
+	}
+	return result
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func historyLine(t *testing.T, symbol string, at time.Time) string {
+	data, err := json.Marshal(&SpreadSample{Time: at, Symbol: symbol})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data) + "\n"
+}
+
+// TestHistoryTornLastLine loads the samples before a line torn by a crash
+// mid-append and drops the torn line from the file
+func TestHistoryTornLastLine(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	torn := historyLine(t, "BNBUSDT", now)
+	path := writeTestFile(t, "history.jsonl", []byte(
+		historyLine(t, "BTCUSDT", now.Add(-time.Minute))+historyLine(t, "ETHUSDT", now)+torn[:len(torn)/2]))
+
+	store, err := NewHistoryStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range store.Query(nil, time.Time{}, time.Time{}) {
+		got = append(got, s.Symbol)
+	}
+	if strings.Join(got, ",") != "BTCUSDT,ETHUSDT" {
+		t.Errorf("got the samples of %v, want BTCUSDT and ETHUSDT", got)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "BNBUSDT") {
+		t.Errorf("the torn line was kept in the file: %s", data)
+	}
+}
+
+// TestHistoryCorruptLine refuses to load a file with a corrupt line
+// followed by others, it's not the trace of an interrupted append
+func TestHistoryCorruptLine(t *testing.T) {
+	now := time.Now().UTC()
+	data := historyLine(t, "BTCUSDT", now) + "{\"time\":\n" + historyLine(t, "ETHUSDT", now)
+	path := writeTestFile(t, "history.jsonl", []byte(data))
+
+	if _, err := NewHistoryStore(path, time.Hour); err == nil || !strings.Contains(err.Error(), path+":2:") {
+		t.Errorf("got %v, want the error of line 2", err)
+	}
+	kept, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(kept) != data {
+		t.Errorf("the corrupt file was rewritten: %s", kept)
+	}
+}
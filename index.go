@@ -4,8 +4,6 @@ import (
 	"net/http"
 	"text/template"
 	"time"
-
-	log "github.com/sirupsen/logrus"
 )
 
 type SymbolsSection struct {
@@ -15,12 +13,24 @@ type SymbolsSection struct {
 
 type NotionalValuesSection struct {
 	Title  string
-	Values []*TotalNotionalValue
+	Values []*NotionalValueResult
 }
 
 type SpreadsSection struct {
 	Title  string
-	Values []*Spread
+	Values []*SpreadResult
+}
+
+type BackgroundSection struct {
+	Title     string
+	Version   uint64
+	UpdatedAt string
+	Values    []*SpreadView
+}
+
+type FailuresSection struct {
+	Title  string
+	Values []*SymbolFailure
 }
 
 type PageData struct {
@@ -29,6 +39,8 @@ type PageData struct {
 	TopNumberOfTrades   SymbolsSection
 	TotalNotionalValues NotionalValuesSection
 	SpreadValues        SpreadsSection
+	BackgroundSpreads   BackgroundSection
+	Failures            FailuresSection
 }
 
 func (c *controller) index(w http.ResponseWriter, req *http.Request) {
@@ -37,27 +49,51 @@ func (c *controller) index(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	logger := loggerFromContext(req.Context())
 	defer func(t time.Time) {
-		log.Debugf("Executed index handler in %s", time.Since(t))
+		logger.Debugf("Executed index handler in %s", time.Since(t))
 	}(time.Now())
 
-	log.Debug("Executing index handler")
+	logger.Debug("Executing index handler")
+
+	conversions, err := c.reportingCurrency(req)
+	if err != nil {
+		http.Error(w, err.Error(), conversionStatus(err))
+		return
+	}
 
 	client := NewApiClient(apiBaseUrl)
-	service := NewMarketDataService(&client)
+	service := NewMarketDataService(&client, c.clock)
 
-	marketData, _ := service.GetMarketData(
+	marketData, _ := service.GetMarketData(req.Context(),
 		&MarketDataQuery{
 			VolumeQuoteAsset:     "BTC",
 			TradeCountQuoteAsset: "USDT",
 		})
 
+	snapshot := c.state.Snapshot().View()
+	// the prices, volumes and notional values are in the quote asset
+	// of every symbol unless the reporting currency is requested
+	unit := ""
+	if conversions != nil {
+		marketData = convertMarketData(conversions, marketData)
+		converted := conversions.SpreadSnapshotView(snapshot)
+		// only the conversion failures are added to the ones of the page
+		marketData.Failures = append(marketData.Failures, converted.Failures[len(snapshot.Failures):]...)
+		snapshot = converted
+		unit = " in " + conversions.Currency
+	}
+	updatedAt := "never"
+	if snapshot.Version > 0 {
+		updatedAt = snapshot.UpdatedAt.Format(time.RFC3339)
+	}
+
 	tmpl := template.Must(template.ParseFiles("index.html"))
 
 	data := PageData{
 		PageTitle: "Binance Market Data",
 		TopVolumes: SymbolsSection{
-			Title:  "Top 5 highest volume over the last 24h for quote asset BTC",
+			Title:  "Top 5 highest volume over the last 24h for quote asset BTC" + unit,
 			Values: marketData.TopVolumes,
 		},
 		TopNumberOfTrades: SymbolsSection{
@@ -65,13 +101,59 @@ func (c *controller) index(w http.ResponseWriter, req *http.Request) {
 			Values: marketData.TopNumberOfTrades,
 		},
 		TotalNotionalValues: NotionalValuesSection{
-			Title:  "Total notional value of the top 200 bids and asks",
+			Title:  "Total notional value of the top 200 bids and asks" + unit,
 			Values: marketData.TotalNotionalValues,
 		},
 		SpreadValues: SpreadsSection{
-			Title:  "Bid-Ask spread",
+			Title:  "Bid-Ask spread" + unit,
 			Values: marketData.Spreads,
 		},
+		BackgroundSpreads: BackgroundSection{
+			Title:     "Bid-Ask spread and delta from the background worker" + unit,
+			Version:   snapshot.Version,
+			UpdatedAt: updatedAt,
+			Values:    snapshot.Spreads,
+		},
+		Failures: FailuresSection{
+			Title:  "Failed symbols",
+			Values: marketData.Failures,
+		},
 	}
 	tmpl.Execute(w, data)
 }
+
+// convertMarketData reports the market data of the page in the currency,
+// the symbols without a conversion path are moved to the failures
+func convertMarketData(conversions *Conversions, data *MarketData) *MarketData {
+	converted := &MarketData{Failures: append([]*SymbolFailure{}, data.Failures...)}
+	convertSymbols := func(values []*SymbolData) []*SymbolData {
+		var result []*SymbolData
+		for _, v := range values {
+			d, err := conversions.SymbolData(v)
+			if err != nil {
+				converted.Failures = append(converted.Failures, newSymbolFailure(v.Symbol, OPERATION_CONVERT, err))
+				continue
+			}
+			result = append(result, d)
+		}
+		return result
+	}
+	converted.TopVolumes = convertSymbols(data.TopVolumes)
+	converted.TopNumberOfTrades = convertSymbols(data.TopNumberOfTrades)
+
+	for _, r := range data.TotalNotionalValues {
+		result := &NotionalValueResult{Symbol: r.Symbol, Err: r.Err}
+		if r.Err == nil {
+			result.Value, result.Err = conversions.NotionalValue(r.Value)
+		}
+		converted.TotalNotionalValues = append(converted.TotalNotionalValues, result)
+	}
+	for _, r := range data.Spreads {
+		result := &SpreadResult{Symbol: r.Symbol, Err: r.Err}
+		if r.Err == nil {
+			result.Spread, result.Err = conversions.Spread(r.Spread)
+		}
+		converted.Spreads = append(converted.Spreads, result)
+	}
+	return converted
+}
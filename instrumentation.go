@@ -0,0 +1,237 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	apiRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "api",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of the Binance API requests by endpoint and response status",
+			Buckets:   []float64{.025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"endpoint", "status"},
+	)
+	apiErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "api",
+			Name:      "errors_total",
+			Help:      "Errors returned by the Binance API by endpoint and error code",
+		},
+		[]string{"endpoint", "code"},
+	)
+	apiCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "api",
+			Name:      "cache_requests_total",
+			Help:      "Lookups of the API client caches by cache and result (hit or miss)",
+		},
+		[]string{"cache", "result"},
+	)
+	orderBookRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "order_book",
+			Name:      "requests_total",
+			Help:      "Order book requests by result (fetched, coalesced with an in-flight call or answered from a snapshot)",
+		},
+		[]string{"result"},
+	)
+	orderBookQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "order_book",
+			Name:      "fetch_queue_depth",
+			Help:      "Order book calls waiting for a free slot of the global concurrency cap",
+		},
+	)
+	backgroundTickDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "background",
+			Name:      "tick_duration_seconds",
+			Help:      "Duration of the background task runs",
+			Buckets:   []float64{.1, .25, .5, 1, 2.5, 5, 10, 20},
+		},
+	)
+	backgroundTicksSkipped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "background",
+			Name:      "ticks_skipped_total",
+			Help:      "Background task runs skipped because the previous run was still in progress",
+		},
+	)
+	backgroundTickErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "background",
+			Name:      "tick_errors_total",
+			Help:      "Background task runs completed with an error",
+		},
+	)
+	backgroundLastSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "background",
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Unix time of the last successful background task run",
+		},
+	)
+	backgroundJobErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "background",
+			Name:      "job_errors_total",
+			Help:      "Runs of the scheduled background jobs completed with an error by job",
+		},
+		[]string{"job"},
+	)
+	backgroundJobLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "background",
+			Name:      "job_last_success_timestamp_seconds",
+			Help:      "Unix time of the last successful run of the scheduled background jobs by job",
+		},
+		[]string{"job"},
+	)
+	quarantinedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "validation",
+			Name:      "quarantined_samples_total",
+			Help:      "Order book and ticker samples rejected by the sanity checks by symbol and reason",
+		},
+		[]string{"symbol", "reason"},
+	)
+	sinkWrites = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "sink",
+			Name:      "writes_total",
+			Help:      "Spread reports written to the sinks by watch-list, sink and result (ok or error)",
+		},
+		[]string{"watch_list", "sink", "result"},
+	)
+	clockOffset = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "clock",
+			Name:      "offset_seconds",
+			Help:      "Estimated offset of the exchange clock from the local one, positive when the exchange is ahead",
+		},
+	)
+	clockRoundTrip = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "clock",
+			Name:      "round_trip_seconds",
+			Help:      "Round trip of the server time sample the clock offset was estimated from",
+		},
+	)
+	clockSyncErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "clock",
+			Name:      "sync_errors_total",
+			Help:      "Exchange clock syncs failed to get any server time sample",
+		},
+	)
+	pegAlerts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "peg",
+			Name:      "alerts_total",
+			Help:      "Stablecoin peg alerts fired by pair and rate source",
+		},
+		[]string{"pair", "source"},
+	)
+	placedPaperOrders = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "paper",
+			Name:      "orders_total",
+			Help:      "Simulated orders by type, side and status after they were placed (REJECTED when refused)",
+		},
+		[]string{"type", "side", "status"},
+	)
+	proxyRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "proxy",
+			Name:      "requests_total",
+			Help:      "Proxied API requests by endpoint and result (hit, miss, coalesced, rejected or error)",
+		},
+		[]string{"endpoint", "result"},
+	)
+	httpRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "HTTP requests served by method, route and status code",
+		},
+		[]string{"method", "route", "code"},
+	)
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of the served HTTP requests by method and route",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"method", "route"},
+	)
+	httpResponseSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE,
+			Subsystem: "http",
+			Name:      "response_size_bytes",
+			Help:      "Size of the served HTTP responses by method and route",
+			Buckets:   prometheus.ExponentialBuckets(128, 4, 8),
+		},
+		[]string{"method", "route"},
+	)
+)
+
+func registerInstrumentation(reg prometheus.Registerer) {
+	reg.MustRegister(
+		apiRequestDuration,
+		apiErrors,
+		apiCacheRequests,
+		orderBookRequests,
+		orderBookQueueDepth,
+		backgroundTickDuration,
+		backgroundTicksSkipped,
+		backgroundTickErrors,
+		backgroundLastSuccess,
+		backgroundJobErrors,
+		backgroundJobLastSuccess,
+		quarantinedSamples,
+		sinkWrites,
+		clockOffset,
+		clockRoundTrip,
+		clockSyncErrors,
+		pegAlerts,
+		placedPaperOrders,
+		proxyRequests,
+		httpRequests,
+		httpRequestDuration,
+		httpResponseSize,
+	)
+}
+
+func observeCache(name string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	apiCacheRequests.WithLabelValues(name, result).Inc()
+}
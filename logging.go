@@ -1,13 +1,25 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+type loggerKey struct{}
+
 func init() {
 	log.SetFormatter(&log.TextFormatter{
 		FullTimestamp: true,
@@ -16,17 +28,158 @@ func init() {
 	log.SetOutput(os.Stderr)
 }
 
+func configureLogging(level string, format string) error {
+	l, err := log.ParseLevel(level)
+	if err != nil {
+		log.SetLevel(log.InfoLevel)
+	} else {
+		log.SetLevel(l)
+	}
+
+	switch format {
+	case LOG_FORMAT_TEXT:
+		log.SetFormatter(&log.TextFormatter{
+			FullTimestamp: true,
+		})
+	case LOG_FORMAT_JSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	return nil
+}
+
+func withLogger(ctx context.Context, logger *log.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFromContext returns the request-scoped logger enriched with
+// the trace identifiers, or the standard logger outside of a request
+func loggerFromContext(ctx context.Context) *log.Entry {
+	logger, ok := ctx.Value(loggerKey{}).(*log.Entry)
+	if !ok {
+		logger = log.NewEntry(log.StandardLogger())
+	}
+
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		logger = logger.WithFields(log.Fields{
+			"trace_id": sc.TraceID().String(),
+			"span_id":  sc.SpanID().String(),
+		})
+	}
+
+	return logger
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	if rec, ok := w.(*responseRecorder); ok {
+		return rec
+	}
+	return &responseRecorder{ResponseWriter: w}
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+// Flush lets the streaming handlers flush through the recorder
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *responseRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
 func (c *controller) logging(hdlr http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestID := w.Header().Get(REQUEST_ID_HEADER)
+		if requestID == "" {
+			requestID = "unknown"
+		}
+		route := c.route(req)
+		logger := c.logger.WithFields(log.Fields{
+			"request_id": requestID,
+			"method":     req.Method,
+			"route":      route,
+		})
+
+		rec := newResponseRecorder(w)
 		defer func(start time.Time) {
-			requestID := w.Header().Get("X-Request-Id")
-			if requestID == "" {
-				requestID = "unknown"
-			}
-			c.logger.WithField(
-				"method", req.Method,
-			).Infoln(requestID, req.Method, req.URL.Path, req.RemoteAddr, req.UserAgent(), time.Since(start))
+			elapsed := time.Since(start)
+			status := rec.Status()
+
+			httpRequests.WithLabelValues(req.Method, route, strconv.Itoa(status)).Inc()
+			httpRequestDuration.WithLabelValues(req.Method, route).Observe(elapsed.Seconds())
+			httpResponseSize.WithLabelValues(req.Method, route).Observe(float64(rec.size))
+
+			loggerFromContext(withLogger(req.Context(), logger)).WithFields(log.Fields{
+				"path":        req.URL.Path,
+				"remote_addr": req.RemoteAddr,
+				"user_agent":  req.UserAgent(),
+				"status":      status,
+				"size":        rec.size,
+				"duration":    elapsed.String(),
+			}).Info("Handled HTTP request")
 		}(time.Now())
-		hdlr.ServeHTTP(w, req)
+		hdlr.ServeHTTP(rec, req.WithContext(withLogger(req.Context(), logger)))
 	})
 }
+
+// route resolves the registered pattern to keep the metric labels bounded
+func (c *controller) route(req *http.Request) string {
+	if c.router == nil {
+		return "unknown"
+	}
+	_, pattern := c.router.Handler(req)
+	if pattern == "" {
+		return "unmatched"
+	}
+	return pattern
+}
+
+// logSampler lets through one of every n lines per key to keep
+// the high-frequency background output readable
+type logSampler struct {
+	mu     sync.Mutex
+	every  int
+	counts map[string]int
+}
+
+func newLogSampler(every int) *logSampler {
+	return &logSampler{every: every, counts: make(map[string]int)}
+}
+
+func (s *logSampler) Sample(key string) bool {
+	if s.every <= 1 {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.counts[key]
+	s.counts[key] = (n + 1) % s.every
+	return n == 0
+}
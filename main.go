@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"net/http"
+	"os"
 	"strconv"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
@@ -15,47 +18,250 @@ type middlewares []middleware
 
 type controller struct {
 	logger        *log.Logger
+	router        *http.ServeMux
+	analytics     AnalyticsService
+	flows         TradeFlowService
+	portfolios    PortfolioService
+	conversions   ConversionService
+	scanner       ArbitrageScanner
+	pegMonitor    PegMonitor
+	paper         PaperTrader
+	proxy         ApiProxy
+	history       HistoryStore
+	state         StateStore
+	health        *healthChecks
+	clock         ExchangeClock
 	nextRequestID func() string
 }
 
 var (
-	apiBaseUrl    string
-	listenAddress string
-	logLevel      string
+	apiBaseUrl        string
+	listenAddress     string
+	logLevel          string
+	logFormat         string
+	logSample         int
+	metricsLabels     string
+	tracingConfig     TracingConfig
+	streamBaseUrl     string
+	flowSymbols       string
+	flowConfig        TradeFlowConfig
+	historyFile       string
+	historyTTL        time.Duration
+	sinksConfig       string
+	staleness         StalenessConfig
+	readyMaxAge       time.Duration
+	clockInterval     time.Duration
+	maxClockDrift     time.Duration
+	credsConfig       CredentialsConfig
+	portfolioQuote    string
+	portfolioInterval time.Duration
+	arbitrageAssets   string
+	arbitrageConfig   ArbitrageConfig
+	arbitrageInterval time.Duration
+	pegConfig         PegConfig
+	pegInterval       time.Duration
+	paperBalances     string
+	paperConfig       PaperConfig
+	paperReplayFile   string
+	paperRecordFile   string
+	paperInterval     time.Duration
+	proxyEnabled      bool
+	proxyBudget       int
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if run, found := subcommands[os.Args[1]]; found {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
 
 	flag.StringVar(&apiBaseUrl, "api-base-url", "https://api.binance.com", "public Rest API for Binance")
+	flag.StringVar(&streamBaseUrl, "stream-base-url", "wss://stream.binance.com:9443", "websocket market streams for Binance")
 	flag.StringVar(&listenAddress, "listen-addres", ":8080", "server listen address")
 	flag.StringVar(&logLevel, "log-level", "info", "minimum logging level")
+	flag.StringVar(&logFormat, "log-format", LOG_FORMAT_TEXT, "logging format: text or json")
+	flag.IntVar(&logSample, "log-sample-every", 1, "print one of every n background spread lines per symbol")
+	flag.StringVar(&metricsLabels, "metrics-labels", "", "constant labels added to exported metrics, e.g. env=prod,region=eu")
+	flag.StringVar(&tracingConfig.Exporter, "trace-exporter", TRACING_NONE, "trace exporter: none, stdout or otlp")
+	flag.StringVar(&tracingConfig.OtlpEndpoint, "otlp-endpoint", "localhost:4318", "OTLP/HTTP collector endpoint")
+	flag.BoolVar(&tracingConfig.OtlpInsecure, "otlp-insecure", false, "disable TLS for the OTLP/HTTP collector endpoint")
+	flag.StringVar(&flowSymbols, "trade-flow-symbols", "", "symbols to track the trade flow from the aggregate trades stream, e.g. BTCUSDT,ETHUSDT")
+	flag.DurationVar(&flowConfig.Window, "trade-flow-window", time.Minute, "rolling window of the trade flow metrics, at most 1h")
+	flag.Int64Var(&flowConfig.LargeTradeMultiple, "large-trade-multiple", 10, "trades above this multiple of the median trade notional are reported as large")
+	flag.StringVar(&historyFile, "history-file", "", "append the collected spread samples to this file, memory only when empty")
+	flag.DurationVar(&historyTTL, "history-retention", 24*time.Hour, "retention of the collected spread samples")
+	flag.StringVar(&sinksConfig, "sinks-config", "", "json file with the watch-lists and the sinks of their background spread reports")
+	flag.StringVar(&staleness.Policy, "stale-policy", STALE_POLICY_KEEP, "export of the stale spread metrics: keep, drop or nan")
+	flag.DurationVar(&staleness.After, "stale-after", 30*time.Second, "spread metrics older than this are reported as stale")
+	flag.DurationVar(&readyMaxAge, "ready-max-age", time.Minute, "the app is not ready when the spread data is older than this")
+	flag.DurationVar(&clockInterval, "clock-sync-interval", time.Minute, "interval of the exchange clock offset estimation")
+	flag.DurationVar(&maxClockDrift, "max-clock-drift", time.Second, "the app is not ready when the exchange clock offset is above this")
+	credentialsFlags(flag.CommandLine, &credsConfig)
+	flag.StringVar(&portfolioQuote, "portfolio-quote", PORTFOLIO_QUOTE_USDT, "quote asset of the account portfolio valuation: USDT or BTC")
+	flag.DurationVar(&portfolioInterval, "portfolio-interval", time.Minute, "refresh interval of the account portfolio valuation")
+	flag.StringVar(&arbitrageAssets, "arbitrage-assets", "USDT,BTC", "assets the scanned arbitrage triangles start from")
+	flag.Float64Var(&arbitrageConfig.FeeBps, "arbitrage-fee-bps", 10, "taker fee paid on every leg of the arbitrage triangles in basis points")
+	flag.Float64Var(&arbitrageConfig.MinReturnBps, "arbitrage-min-return-bps", 0, "triangles with a lower fee adjusted return are not published")
+	flag.DurationVar(&arbitrageInterval, "arbitrage-interval", 10*time.Second, "interval of the arbitrage triangles scan")
+	flag.Float64Var(&pegConfig.BandBps, "peg-band-bps", 10, "band around 1.0 the depth of the stablecoin crosses is measured within in basis points")
+	flag.Float64Var(&pegConfig.AlertBps, "peg-alert-bps", 50, "stablecoin rate deviation from 1.0 which fires the peg alert in basis points")
+	flag.DurationVar(&pegInterval, "peg-interval", 30*time.Second, "interval of the stablecoin peg checks")
+	flag.StringVar(&paperBalances, "paper-balances", "USDT=10000", "starting balances of the new paper trading accounts, e.g. USDT=10000,BTC=0.5")
+	flag.Float64Var(&paperConfig.MakerFeeBps, "paper-maker-fee-bps", 10, "fee of the paper orders filled while resting on the book in basis points")
+	flag.Float64Var(&paperConfig.TakerFeeBps, "paper-taker-fee-bps", 10, "fee of the paper orders taking the book liquidity in basis points")
+	flag.StringVar(&paperConfig.StateFile, "paper-state-file", "", "persist the paper trading accounts to this file, memory only when empty")
+	flag.StringVar(&paperReplayFile, "paper-replay-file", "", "fill the paper orders against the order books recorded in this file instead of the live ones")
+	flag.StringVar(&paperRecordFile, "paper-record-file", "", "append the live order books the paper orders are filled against to this file")
+	flag.DurationVar(&paperInterval, "paper-match-interval", time.Second, "interval of the resting paper orders matching")
+	flag.BoolVar(&proxyEnabled, "proxy", false, "serve the public /api/v3 endpoints as a caching read-through proxy of the Binance API")
+	flag.IntVar(&proxyBudget, "proxy-weight-budget", 0, "request weight per minute the proxy keeps the shared usage under, the exchange limit when 0")
 	flag.Parse()
 
-	l, err := log.ParseLevel(logLevel)
+	if err := configureLogging(logLevel, logFormat); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	constLabels, err := parseConstLabels(metricsLabels)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := staleness.validate(); err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := flowConfig.validate(); err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := validatePortfolioQuote(portfolioQuote); err != nil {
+		log.Fatal(err.Error())
+	}
+	if portfolioInterval < time.Second {
+		log.Fatalf("invalid portfolio interval %s, the min is 1s", portfolioInterval)
+	}
+	arbitrageConfig.StartAssets = parseSymbols(arbitrageAssets)
+	if err := arbitrageConfig.validate(); err != nil {
+		log.Fatal(err.Error())
+	}
+	if arbitrageInterval < time.Second {
+		log.Fatalf("invalid arbitrage interval %s, the min is 1s", arbitrageInterval)
+	}
+	if err := pegConfig.validate(); err != nil {
+		log.Fatal(err.Error())
+	}
+	if pegInterval < time.Second {
+		log.Fatalf("invalid peg interval %s, the min is 1s", pegInterval)
+	}
+	paperConfig.Balances, err = parsePaperBalances(paperBalances)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := paperConfig.validate(); err != nil {
+		log.Fatal(err.Error())
+	}
+	if paperInterval < time.Second {
+		log.Fatalf("invalid paper match interval %s, the min is 1s", paperInterval)
+	}
+	if proxyBudget < 0 {
+		log.Fatalf("invalid proxy weight budget %d", proxyBudget)
+	}
+	shutdownTracing, err := initTracing(tracingConfig)
 	if err != nil {
-		log.SetLevel(log.InfoLevel)
-	} else {
-		log.SetLevel(l)
+		log.Fatal(err.Error())
 	}
 
-	c := &controller{logger: log.New(), nextRequestID: func() string { return strconv.FormatInt(time.Now().UnixNano(), 36) }}
+	c := &controller{logger: log.StandardLogger(), nextRequestID: func() string { return strconv.FormatInt(time.Now().UnixNano(), 36) }}
 
 	router := http.NewServeMux()
+	c.router = router
 	router.HandleFunc("/", c.index)
 
 	router.Handle("/metrics", promhttp.Handler())
 
-	health := healtcheck()
-	router.HandleFunc("/live", health.LiveEndpoint)
-	router.HandleFunc("/ready", health.ReadyEndpoint)
-
 	client := NewApiClient(apiBaseUrl)
-	service := NewMarketDataService(&client)
-	background := NewBackgroundService(&service)
+	c.clock = NewExchangeClock(client)
+	go c.clock.Start(context.Background(), clockInterval)
+	creds, err := LoadCredentials(credsConfig)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if creds != nil {
+		client.SetCredentials(creds, c.clock)
+		log.WithField("keyType", credsConfig.KeyType).Info("Enabled signed api requests")
+	}
+	service := NewMarketDataService(&client, c.clock)
+	c.history, err = NewHistoryStore(historyFile, historyTTL)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	watchLists, err := LoadWatchLists(sinksConfig)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	c.state = NewStateStore()
+	c.conversions = NewConversionService(&client, c.clock)
+	background := NewBackgroundService(&service, &c.history, c.state, watchLists, c.clock, logSample)
+	background.Schedule("exchange-info", METADATA_REFRESH_INTERVAL, service.RefreshMetadata)
+	// the balances are only valued when the signed requests are enabled
+	if creds != nil {
+		c.portfolios = NewPortfolioService(&client, c.conversions, c.clock, portfolioQuote)
+		background.Schedule("portfolio", portfolioInterval, c.portfolios.Refresh)
+	}
+	c.scanner = NewArbitrageScanner(&client, c.clock, arbitrageConfig)
+	background.Schedule("arbitrage", arbitrageInterval, c.scanner.Scan)
+	c.pegMonitor = NewPegMonitor(&client, &service, c.clock, pegConfig)
+	background.Schedule("peg", pegInterval, c.pegMonitor.Check)
+	books := NewLiveBookSource(&client, c.clock, paperRecordFile)
+	if paperReplayFile != "" {
+		books, err = NewReplayBookSource(paperReplayFile)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	c.paper, err = NewPaperTrader(&service, books, c.clock, paperConfig)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	background.Schedule("paper", paperInterval, c.paper.Match)
 	go background.Start()
 
+	c.health = healtcheck(client, c.clock, c.state, readyMaxAge, maxClockDrift)
+	router.HandleFunc("/live", c.health.LiveEndpoint)
+	router.HandleFunc("/ready", c.health.ReadyEndpoint)
+	router.HandleFunc("/health/details", c.healthDetails)
+
+	flowConfig.Symbols = parseSymbols(flowSymbols)
+	stream := NewStreamClient(streamBaseUrl)
+	c.flows = NewTradeFlowService(&client, &stream, flowConfig)
+	go c.flows.Start(context.Background())
+	router.HandleFunc("/trades/flow", c.tradeFlow)
+	router.HandleFunc("/trades/recent", c.recentTrades)
+	router.HandleFunc("/portfolio", c.portfolio)
+
+	registerer := prometheus.WrapRegistererWith(constLabels, prometheus.DefaultRegisterer)
+	registerer.MustRegister(newMetricsCollector(c.state, c.clock, staleness, c.flows, c.portfolios, c.scanner, c.pegMonitor))
+	registerInstrumentation(registerer)
+
+	c.analytics = NewAnalyticsService(&client, &service)
+	router.HandleFunc("/analytics/symbol", c.symbolAnalytics)
+	router.HandleFunc("/analytics/rank", c.rankAnalytics)
+	router.HandleFunc("/export/spreads", c.exportSpreads)
+	router.HandleFunc("/spreads", c.spreads)
+	router.HandleFunc("/conversion", c.conversion)
+	router.HandleFunc("/arbitrage", c.arbitrage)
+	router.HandleFunc("/pegs", c.pegs)
+	router.HandleFunc("/paper/orders", c.paperOrders)
+	router.HandleFunc("/paper/account", c.paperBalances)
+	if proxyEnabled {
+		c.proxy = NewApiProxy(&client, proxyBudget)
+		router.HandleFunc(PROXY_PREFIX, c.apiProxy)
+		log.WithField("weightBudget", proxyBudget).Info("Enabled the api proxy")
+	}
+	router.HandleFunc("/spreads/stream", c.spreadStream)
+
 	log.WithField("listen-addres", listenAddress).Info("Starting HTTP server")
-	log.Fatal(http.ListenAndServe(listenAddress, (middlewares{c.tracing, c.logging}).apply(router)))
+	err = http.ListenAndServe(listenAddress, (middlewares{c.logging, c.tracing}).apply(router))
+	shutdownTracing(context.Background())
+	log.Fatal(err)
 }
 
 func (mws middlewares) apply(hdlr http.Handler) http.Handler {
@@ -1,70 +1,409 @@
 package main
 
 import (
-	"strconv"
+	"fmt"
+	"math"
+	"strings"
 	"time"
 
-	"github.com/patrickmn/go-cache"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"github.com/shopspring/decimal"
 	log "github.com/sirupsen/logrus"
 )
 
-const SPREAD_METRICS_KEY = "spredMetrics"
+const (
+	METRICS_NAMESPACE = "binance"
 
-var MetricsCache = cache.New(time.Duration(10)*time.Second, time.Duration(10)*time.Second)
+	STALE_POLICY_KEEP = "keep"
+	STALE_POLICY_DROP = "drop"
+	STALE_POLICY_NAN  = "nan"
+)
+
+// StalenessConfig decides how the spread metrics of a symbol are exported
+// once its last good sample is older than After: the last values are kept,
+// dropped or replaced by NaN, the stale flag is exported in every case
+type StalenessConfig struct {
+	Policy string
+	After  time.Duration
+}
 
-func init() {
-	prometheus.MustRegister(newMetricsCollector())
+func (c StalenessConfig) validate() error {
+	switch c.Policy {
+	case STALE_POLICY_KEEP, STALE_POLICY_DROP, STALE_POLICY_NAN:
+	default:
+		return fmt.Errorf("invalid stale policy %q, expected keep, drop or nan", c.Policy)
+	}
+	if c.After <= 0 {
+		return fmt.Errorf("invalid stale threshold %s", c.After)
+	}
+	return nil
 }
 
 type SpreadMetric struct {
-	spread *Spread
-	delta  decimal.Decimal
+	spread    *Spread
+	delta     decimal.Decimal
+	notional  *TotalNotionalValue
+	ticker    *SymbolData
+	timestamp time.Time
 }
 
 type metricsCollector struct {
 	prometheus.Collector
-	spreadMetric      *prometheus.Desc
-	spreadDeltaMetric *prometheus.Desc
+	state           StateStore
+	clock           ExchangeClock
+	staleness       StalenessConfig
+	flows           TradeFlowService
+	portfolio       PortfolioService
+	scanner         ArbitrageScanner
+	pegs            PegMonitor
+	bestBid         *prometheus.Desc
+	bestAsk         *prometheus.Desc
+	midPrice        *prometheus.Desc
+	spreadValue     *prometheus.Desc
+	spreadBps       *prometheus.Desc
+	spreadDelta     *prometheus.Desc
+	bidsNotional    *prometheus.Desc
+	asksNotional    *prometheus.Desc
+	bookImbalance   *prometheus.Desc
+	volume          *prometheus.Desc
+	quoteVolume     *prometheus.Desc
+	tradeCount      *prometheus.Desc
+	sampleTimestamp *prometheus.Desc
+	lastUpdate      *prometheus.Desc
+	stale           *prometheus.Desc
+	flowVolume      *prometheus.Desc
+	flowQuoteVolume *prometheus.Desc
+	flowTradeRate   *prometheus.Desc
+	flowBuyRatio    *prometheus.Desc
+	flowTradeSize   *prometheus.Desc
+	flowLargeTrades *prometheus.Desc
+	symbolFailure   *prometheus.Desc
+	assetBalance    *prometheus.Desc
+	assetValue      *prometheus.Desc
+	portfolioValue  *prometheus.Desc
+	portfolioAge    *prometheus.Desc
+	arbTriangles    *prometheus.Desc
+	arbReturn       *prometheus.Desc
+	arbMaxSize      *prometheus.Desc
+	arbPublished    *prometheus.Desc
+	arbAge          *prometheus.Desc
+	pegDeviation    *prometheus.Desc
+	pegDepth        *prometheus.Desc
+	pegAlert        *prometheus.Desc
+	pegAge          *prometheus.Desc
 }
 
-func newMetricsCollector() *metricsCollector {
+func newMetricsCollector(
+	state StateStore, clock ExchangeClock, staleness StalenessConfig, flows TradeFlowService, portfolio PortfolioService,
+	scanner ArbitrageScanner, pegs PegMonitor,
+) *metricsCollector {
+	desc := func(subsystem, name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(METRICS_NAMESPACE, subsystem, name),
+			help, append([]string{"symbol"}, labels...), nil,
+		)
+	}
+	portfolioDesc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(METRICS_NAMESPACE, "portfolio", name), help, labels, nil,
+		)
+	}
+	arbitrageDesc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(METRICS_NAMESPACE, "arbitrage", name), help, labels, nil,
+		)
+	}
+	pegDesc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(METRICS_NAMESPACE, "peg", name), help, labels, nil,
+		)
+	}
+
 	return &metricsCollector{
-		spreadMetric: prometheus.NewDesc(
-			"spread_value",
-			"Bid-ask spread of the symbol",
-			[]string{"symbol"}, nil,
-		),
-		spreadDeltaMetric: prometheus.NewDesc(
-			"spread_delta",
-			"Absolute delta from the previous spread value with sign label",
-			[]string{"symbol", "sign"}, nil,
-		),
+		state:           state,
+		clock:           clock,
+		staleness:       staleness,
+		flows:           flows,
+		portfolio:       portfolio,
+		scanner:         scanner,
+		pegs:            pegs,
+		bestBid:         desc("spread", "best_bid", "Highest bid price of the symbol"),
+		bestAsk:         desc("spread", "best_ask", "Lowest ask price of the symbol"),
+		midPrice:        desc("spread", "mid_price", "Mid price between the best bid and the best ask"),
+		spreadValue:     desc("spread", "value", "Bid-ask spread of the symbol"),
+		spreadBps:       desc("spread", "relative_bps", "Bid-ask spread relative to the mid price in basis points"),
+		spreadDelta:     desc("spread", "delta", "Signed delta from the previous spread value"),
+		bidsNotional:    desc("order_book", "bids_notional", "Total notional value of the top 200 bids"),
+		asksNotional:    desc("order_book", "asks_notional", "Total notional value of the top 200 asks"),
+		bookImbalance:   desc("order_book", "imbalance", "Order book imbalance (bids - asks) / (bids + asks) of the notional totals"),
+		volume:          desc("ticker", "volume_24h", "Base asset volume over the last 24h"),
+		quoteVolume:     desc("ticker", "quote_volume_24h", "Quote asset volume over the last 24h"),
+		tradeCount:      desc("ticker", "trade_count_24h", "Number of trades over the last 24h"),
+		sampleTimestamp: desc("spread", "sample_timestamp_seconds", "Unix time of the sample the symbol metrics were taken from"),
+		lastUpdate:      desc("spread", "last_update_seconds", "Seconds since the last good sample of the symbol"),
+		stale:           desc("spread", "stale", "Set to 1 when the last good sample of the symbol is older than the stale threshold"),
+		flowVolume:      desc("trade_flow", "volume", "Base asset volume of the trades in the window by taker side", "side"),
+		flowQuoteVolume: desc("trade_flow", "quote_volume", "Quote asset volume of the trades in the window by taker side", "side"),
+		flowTradeRate:   desc("trade_flow", "trades_per_second", "Number of trades per second in the window"),
+		flowBuyRatio:    desc("trade_flow", "buy_ratio", "Share of the taker buy quote volume in the window"),
+		flowTradeSize:   desc("trade_flow", "trade_size_quote", "Distribution of the trade notional values in the quote asset in the window"),
+		flowLargeTrades: desc("trade_flow", "large_trades_total", "Trades larger than the configured multiple of the median trade by taker side", "side"),
+		symbolFailure:   desc("symbol", "failure", "Set to 1 for every symbol operation failed on the last background run with the reason", "operation", "reason"),
+		assetBalance:    portfolioDesc("asset_balance", "Free and locked balance of the account asset", "asset"),
+		assetValue:      portfolioDesc("asset_value", "Value of the account asset balance in the quote asset", "asset", "quote"),
+		portfolioValue:  portfolioDesc("total_value", "Total value of the priced account assets in the quote asset", "quote"),
+		portfolioAge:    portfolioDesc("age_seconds", "Seconds since the last valuation of the account assets"),
+		arbTriangles:    arbitrageDesc("triangles", "Number of the triangles walked on the last arbitrage scan"),
+		arbReturn:       arbitrageDesc("return_bps", "Fee adjusted round trip return of the best triangle above the threshold in basis points by start asset", "asset"),
+		arbMaxSize:      arbitrageDesc("max_size", "Top of book size of the best triangle above the threshold in the start asset", "asset"),
+		arbPublished:    arbitrageDesc("opportunities", "Number of the published triangles above the threshold by start asset", "asset"),
+		arbAge:          arbitrageDesc("scan_age_seconds", "Seconds since the last arbitrage scan"),
+		pegDeviation:    pegDesc("deviation_bps", "Deviation of the stablecoin rate from 1.0 in basis points by rate source", "pair", "source"),
+		pegDepth:        pegDesc("band_depth", "Notional value of the stablecoin cross book levels within the peg band", "pair", "side"),
+		pegAlert:        pegDesc("alert", "Set to 1 while the stablecoin rate deviation is above the alert threshold", "pair", "source"),
+		pegAge:          pegDesc("report_age_seconds", "Seconds since the last stablecoin peg check"),
 	}
 }
 
 func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
-	log.Debug("Collect Prometheus metrics from spread metrics cache")
-	var metrics map[string]*SpreadMetric
-	if x, found := MetricsCache.Get(SPREAD_METRICS_KEY); found {
-		metrics = x.(map[string]*SpreadMetric)
-		for _, sm := range metrics {
-			c.setSpreadMetrics(sm, ch)
+	snapshot := c.state.Snapshot()
+	log.WithField("version", snapshot.Version).Debug("Collect Prometheus metrics from spread snapshot")
+	// the samples are timestamped in the exchange time
+	now := c.clock.Now()
+	for _, sm := range snapshot.Spreads {
+		c.setSpreadMetrics(sm, now, ch)
+	}
+	for _, f := range snapshot.Failures {
+		ch <- prometheus.MustNewConstMetric(c.symbolFailure, prometheus.GaugeValue, 1, f.Symbol, f.Operation, f.Reason)
+	}
+
+	if c.flows != nil {
+		for _, flow := range c.flows.GetTrackedTradeFlows() {
+			c.setTradeFlowMetrics(flow, ch)
+		}
+	}
+
+	if c.portfolio != nil {
+		if p, err := c.portfolio.GetPortfolio(); err == nil {
+			c.setPortfolioMetrics(p, now, ch)
+		}
+	}
+
+	if c.scanner != nil {
+		if scan, err := c.scanner.GetScan(); err == nil {
+			c.setArbitrageMetrics(scan, now, ch)
+		}
+	}
+
+	if c.pegs != nil {
+		if report, err := c.pegs.GetPegs(); err == nil {
+			c.setPegMetrics(report, now, ch)
 		}
 	}
 }
 
 func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.spreadMetric
-	ch <- c.spreadDeltaMetric
+	ch <- c.bestBid
+	ch <- c.bestAsk
+	ch <- c.midPrice
+	ch <- c.spreadValue
+	ch <- c.spreadBps
+	ch <- c.spreadDelta
+	ch <- c.bidsNotional
+	ch <- c.asksNotional
+	ch <- c.bookImbalance
+	ch <- c.volume
+	ch <- c.quoteVolume
+	ch <- c.tradeCount
+	ch <- c.sampleTimestamp
+	ch <- c.lastUpdate
+	ch <- c.stale
+	ch <- c.flowVolume
+	ch <- c.flowQuoteVolume
+	ch <- c.flowTradeRate
+	ch <- c.flowBuyRatio
+	ch <- c.flowTradeSize
+	ch <- c.flowLargeTrades
+	ch <- c.symbolFailure
+	ch <- c.assetBalance
+	ch <- c.assetValue
+	ch <- c.portfolioValue
+	ch <- c.portfolioAge
+	ch <- c.arbTriangles
+	ch <- c.arbReturn
+	ch <- c.arbMaxSize
+	ch <- c.arbPublished
+	ch <- c.arbAge
+	ch <- c.pegDeviation
+	ch <- c.pegDepth
+	ch <- c.pegAlert
+	ch <- c.pegAge
 }
 
-func (c *metricsCollector) setSpreadMetrics(sm *SpreadMetric, ch chan<- prometheus.Metric) {
-	value, _ := sm.spread.Value.Float64()
-	ch <- prometheus.MustNewConstMetric(c.spreadMetric, prometheus.GaugeValue, value, sm.spread.Symbol)
+// setSpreadMetrics exports the values at the scrape time, the freshness
+// of the symbol is told by the sample timestamp and the last update gauges
+func (c *metricsCollector) setSpreadMetrics(sm *SpreadMetric, now time.Time, ch chan<- prometheus.Metric) {
+	symbol := sm.spread.Symbol
+	age := now.Sub(sm.timestamp)
+	stale := age > c.staleness.After
+
+	ch <- prometheus.MustNewConstMetric(c.lastUpdate, prometheus.GaugeValue, age.Seconds(), symbol)
+	staleValue := 0.0
+	if stale {
+		staleValue = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.stale, prometheus.GaugeValue, staleValue, symbol)
+	if stale && c.staleness.Policy == STALE_POLICY_DROP {
+		return
+	}
+
+	gauge := func(desc *prometheus.Desc, value decimal.Decimal) {
+		v, _ := value.Float64()
+		if stale && c.staleness.Policy == STALE_POLICY_NAN {
+			v = math.NaN()
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, symbol)
+	}
+
+	gauge(c.bestBid, sm.spread.HighestBid)
+	gauge(c.bestAsk, sm.spread.LowestAsk)
+	gauge(c.midPrice, sm.spread.MidPrice())
+	gauge(c.spreadValue, sm.spread.Value)
+	gauge(c.spreadBps, sm.spread.RelativeBps())
+	gauge(c.spreadDelta, sm.delta)
+
+	if sm.notional != nil {
+		gauge(c.bidsNotional, sm.notional.BidsTotal)
+		gauge(c.asksNotional, sm.notional.AsksTotal)
+		gauge(c.bookImbalance, sm.notional.Imbalance())
+	}
+
+	if sm.ticker != nil {
+		gauge(c.volume, sm.ticker.Volume)
+		gauge(c.quoteVolume, sm.ticker.QuoteVolume)
+		gauge(c.tradeCount, decimal.NewFromInt(int64(sm.ticker.TradeCount)))
+	}
+
+	ts := float64(sm.timestamp.UnixNano()) / float64(time.Second)
+	ch <- prometheus.MustNewConstMetric(c.sampleTimestamp, prometheus.GaugeValue, ts, symbol)
+}
+
+func (c *metricsCollector) setTradeFlowMetrics(flow *TradeFlow, ch chan<- prometheus.Metric) {
+	gauge := func(desc *prometheus.Desc, value decimal.Decimal, labels ...string) {
+		v, _ := value.Float64()
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, append([]string{flow.Symbol}, labels...)...)
+	}
+
+	gauge(c.flowVolume, flow.BuyVolume, SIDE_BUY)
+	gauge(c.flowVolume, flow.SellVolume, SIDE_SELL)
+	gauge(c.flowQuoteVolume, flow.BuyQuoteVolume, SIDE_BUY)
+	gauge(c.flowQuoteVolume, flow.SellQuoteVolume, SIDE_SELL)
+	ch <- prometheus.MustNewConstMetric(c.flowTradeRate, prometheus.GaugeValue, flow.TradesPerSecond, flow.Symbol)
+	ch <- prometheus.MustNewConstMetric(c.flowBuyRatio, prometheus.GaugeValue, flow.BuyRatio, flow.Symbol)
+
+	// the distribution buckets are lower bounds, while prometheus
+	// expects cumulative counts of the upper bounds
+	var count uint64
+	buckets := make(map[float64]uint64, len(flow.SizeDistribution))
+	for i, b := range flow.SizeDistribution {
+		count += uint64(b.Count)
+		if i+1 < len(flow.SizeDistribution) {
+			buckets[flow.SizeDistribution[i+1].From] = count
+		}
+	}
+	sum, _ := flow.BuyQuoteVolume.Add(flow.SellQuoteVolume).Float64()
+	ch <- prometheus.MustNewConstHistogram(c.flowTradeSize, count, sum, buckets, flow.Symbol)
+
+	for side, total := range flow.LargeTradesTotal {
+		ch <- prometheus.MustNewConstMetric(c.flowLargeTrades, prometheus.CounterValue, float64(total), flow.Symbol, side)
+	}
+}
+
+// setPortfolioMetrics exports the last valuation at the scrape time,
+// its freshness is told by the age gauge
+func (c *metricsCollector) setPortfolioMetrics(p *Portfolio, now time.Time, ch chan<- prometheus.Metric) {
+	gauge := func(desc *prometheus.Desc, value decimal.Decimal, labels ...string) {
+		v, _ := value.Float64()
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, labels...)
+	}
+
+	for _, a := range p.Assets {
+		gauge(c.assetBalance, a.Total, a.Asset)
+		if a.Value != nil {
+			gauge(c.assetValue, *a.Value, a.Asset, p.Quote)
+		}
+	}
+	gauge(c.portfolioValue, p.Total, p.Quote)
+	ch <- prometheus.MustNewConstMetric(c.portfolioAge, prometheus.GaugeValue, now.Sub(p.Time).Seconds())
+}
+
+// setArbitrageMetrics exports the last scan at the scrape time,
+// its freshness is told by the scan age gauge
+func (c *metricsCollector) setArbitrageMetrics(scan *ArbitrageScan, now time.Time, ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.arbAge, prometheus.GaugeValue, now.Sub(scan.Time).Seconds())
+	ch <- prometheus.MustNewConstMetric(c.arbTriangles, prometheus.GaugeValue, float64(scan.Triangles))
+
+	// the triangles change on every scan, labelling the series by their path
+	// would grow the cardinality without a bound, so only the best one of
+	// every start asset is reported, the opportunities are ranked by return
+	best := make(map[string]*ArbitrageOpportunity)
+	published := make(map[string]int)
+	for _, o := range scan.Opportunities {
+		asset := o.Path[0]
+		if best[asset] == nil {
+			best[asset] = o
+		}
+		published[asset]++
+	}
+	for asset, o := range best {
+		ret, _ := o.ReturnBps.Float64()
+		ch <- prometheus.MustNewConstMetric(c.arbReturn, prometheus.GaugeValue, ret, asset)
+		size, _ := o.MaxSize.Float64()
+		ch <- prometheus.MustNewConstMetric(c.arbMaxSize, prometheus.GaugeValue, size, asset)
+		ch <- prometheus.MustNewConstMetric(c.arbPublished, prometheus.GaugeValue, float64(published[asset]), asset)
+	}
+}
+
+// setPegMetrics exports the last check at the scrape time,
+// its freshness is told by the report age gauge
+func (c *metricsCollector) setPegMetrics(report *PegReport, now time.Time, ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.pegAge, prometheus.GaugeValue, now.Sub(report.Time).Seconds())
+	gauge := func(desc *prometheus.Desc, value decimal.Decimal, labels ...string) {
+		v, _ := value.Float64()
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, labels...)
+	}
+
+	for _, r := range report.Rates {
+		if r.DeviationBps == nil {
+			continue
+		}
+		gauge(c.pegDeviation, *r.DeviationBps, r.Pair, r.Source)
+		alert := decimal.Zero
+		if r.Alert {
+			alert = one
+		}
+		gauge(c.pegAlert, alert, r.Pair, r.Source)
+		if r.BidDepth != nil {
+			gauge(c.pegDepth, *r.BidDepth, r.Pair, SIDE_BUY)
+			gauge(c.pegDepth, *r.AskDepth, r.Pair, SIDE_SELL)
+		}
+	}
+}
+
+func parseConstLabels(s string) (prometheus.Labels, error) {
+	labels := prometheus.Labels{}
+	if strings.TrimSpace(s) == "" {
+		return labels, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || !model.LabelName(kv[0]).IsValid() {
+			return nil, fmt.Errorf("invalid metrics label %q, expected name=value", pair)
+		}
+		labels[kv[0]] = kv[1]
+	}
 
-	dvalue, _ := sm.delta.Abs().Float64()
-	sign := strconv.Itoa(sm.delta.Sign())
-	ch <- prometheus.MustNewConstMetric(c.spreadDeltaMetric, prometheus.GaugeValue, dvalue, sm.spread.Symbol, sign)
+	return labels, nil
 }
@@ -1,8 +1,21 @@
 package main
 
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// ApiError is the error body of the Binance API, the status and the
+// Retry-After delay (of the 429 and the 418 responses) are the ones
+// of the response it was returned with
 type ApiError struct {
-	Code    int    `json:"code"`
-	Message string `json:"msg"`
+	Code       int           `json:"code"`
+	Message    string        `json:"msg"`
+	Status     int           `json:"-"`
+	RetryAfter time.Duration `json:"-"`
 }
 
 func (e *ApiError) Error() string {
@@ -11,12 +24,16 @@ func (e *ApiError) Error() string {
 
 type ExchangeInfoResponse struct {
 	Timezone        string      `json:"timezone"`
-	ServerTime      int64       `json:"timestamp"`
+	ServerTime      int64       `json:"serverTime"`
 	RateLimits      []RateLimit `json:"rateLimits"`
 	ExchangeFilters []struct{}  `json:"exchangeFilters"`
 	Symbols         []Symbol    `json:"symbols"`
 }
 
+type ServerTimeResponse struct {
+	ServerTime int64 `json:"serverTime"`
+}
+
 type RateLimit struct {
 	RateLimitType string `json:"rateLimitType"`
 	Interval      string `json:"interval"`
@@ -84,8 +101,120 @@ type TickerChangeStatics struct {
 	Tradecount         int    `json:"count"`
 }
 
+// TickerRow is the subset of the 24hr ticker statistics
+// decoded from the payload of all the symbols
+type TickerRow struct {
+	Symbol      string `json:"symbol"`
+	Volume      string `json:"volume"`
+	QuoteVolume string `json:"quoteVolume"`
+	CloseTime   int64  `json:"closeTime"`
+	TradeCount  int    `json:"count"`
+}
+
+func (t *TickerChangeStatics) Row() *TickerRow {
+	return &TickerRow{
+		Symbol:      t.Symbol,
+		Volume:      t.Volume,
+		QuoteVolume: t.Quotevolume,
+		CloseTime:   t.Closetime,
+		TradeCount:  t.Tradecount,
+	}
+}
+
+type BookTicker struct {
+	Symbol   string `json:"symbol"`
+	BidPrice string `json:"bidPrice"`
+	BidQty   string `json:"bidQty"`
+	AskPrice string `json:"askPrice"`
+	AskQty   string `json:"askQty"`
+}
+
+type Account struct {
+	MakerCommission int       `json:"makerCommission"`
+	TakerCommission int       `json:"takerCommission"`
+	CanTrade        bool      `json:"canTrade"`
+	CanWithdraw     bool      `json:"canWithdraw"`
+	CanDeposit      bool      `json:"canDeposit"`
+	UpdateTime      int64     `json:"updateTime"`
+	AccountType     string    `json:"accountType"`
+	Balances        []Balance `json:"balances"`
+	Permissions     []string  `json:"permissions"`
+}
+
+type Balance struct {
+	Asset  string `json:"asset"`
+	Free   string `json:"free"`
+	Locked string `json:"locked"`
+}
+
 type OrderBook struct {
 	Lastupdateid int        `json:"lastUpdateId"`
 	Bids         [][]string `json:"bids"`
 	Asks         [][]string `json:"asks"`
 }
+
+type Kline struct {
+	OpenTime                 int64
+	Open                     decimal.Decimal
+	High                     decimal.Decimal
+	Low                      decimal.Decimal
+	Close                    decimal.Decimal
+	Volume                   decimal.Decimal
+	CloseTime                int64
+	QuoteVolume              decimal.Decimal
+	TradeCount               int
+	TakerBuyBaseAssetVolume  decimal.Decimal
+	TakerBuyQuoteAssetVolume decimal.Decimal
+}
+
+// UnmarshalJSON decodes the kline from the positional array returned by API
+func (k *Kline) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if len(raw) < 11 {
+		return fmt.Errorf("unexpected kline length %d", len(raw))
+	}
+
+	fields := []interface{}{
+		&k.OpenTime, &k.Open, &k.High, &k.Low, &k.Close, &k.Volume,
+		&k.CloseTime, &k.QuoteVolume, &k.TradeCount,
+		&k.TakerBuyBaseAssetVolume, &k.TakerBuyQuoteAssetVolume,
+	}
+	for i, f := range fields {
+		if err := json.Unmarshal(raw[i], f); err != nil {
+			return fmt.Errorf("invalid kline field %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+type Trade struct {
+	ID           int64  `json:"id"`
+	Price        string `json:"price"`
+	Qty          string `json:"qty"`
+	QuoteQty     string `json:"quoteQty"`
+	Time         int64  `json:"time"`
+	IsBuyerMaker bool   `json:"isBuyerMaker"`
+	IsBestMatch  bool   `json:"isBestMatch"`
+}
+
+type AggTrade struct {
+	AggTradeID   int64  `json:"a"`
+	Price        string `json:"p"`
+	Qty          string `json:"q"`
+	FirstTradeID int64  `json:"f"`
+	LastTradeID  int64  `json:"l"`
+	Time         int64  `json:"T"`
+	IsBuyerMaker bool   `json:"m"`
+	IsBestMatch  bool   `json:"M"`
+}
+
+type AggTradeEvent struct {
+	EventType string `json:"e"`
+	EventTime int64  `json:"E"`
+	Symbol    string `json:"s"`
+	AggTrade
+}
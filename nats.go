@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const NATS_DEFAULT_PORT = "4222"
+
+// natsSink publishes the reports over the NATS core protocol, which is
+// spoken by NATS servers and the compatible brokers, the connection is
+// dialed lazily and re-dialed on the next write after it drops
+type natsSink struct {
+	addr    string
+	subject string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newNatsSink(rawUrl string, subject string) (*natsSink, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid nats url %q", rawUrl)
+	}
+	if strings.ContainsAny(subject, " \t\r\n") {
+		return nil, fmt.Errorf("invalid nats subject %q", subject)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = NATS_DEFAULT_PORT
+	}
+	return &natsSink{addr: net.JoinHostPort(u.Hostname(), port), subject: subject}, nil
+}
+
+func (s *natsSink) Name() string { return SINK_NATS }
+
+func (s *natsSink) Write(ctx context.Context, report *SpreadReport) error {
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	// zero deadline, when the context has none, clears the previous one
+	deadline, _ := ctx.Deadline()
+	s.conn.SetWriteDeadline(deadline)
+	msg := fmt.Sprintf("PUB %s %d\r\n%s\r\n", s.subject, len(payload), payload)
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// connect must be called with the lock held, the server greets
+// with INFO and the client replies with its CONNECT options
+func (s *natsSink) connect(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return errors.New("unexpected nats greeting " + strings.TrimSpace(line))
+	}
+
+	options := `{"verbose":false,"pedantic":false,"name":"` + SERVICE_NAME + `","lang":"go"}`
+	if _, err := conn.Write([]byte("CONNECT " + options + "\r\n")); err != nil {
+		conn.Close()
+		return err
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	s.conn = conn
+	go s.read(conn, r)
+
+	log.WithField("addr", s.addr).Info("Connected to nats")
+	return nil
+}
+
+// read answers the server pings to keep the connection alive
+// and drops the connection on the protocol errors
+func (s *natsSink) read(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PING":
+			s.mu.Lock()
+			conn.SetWriteDeadline(time.Now().Add(SINK_TIMEOUT))
+			_, err = conn.Write([]byte("PONG\r\n"))
+			s.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			err = errors.New(line)
+		}
+		if err != nil {
+			log.WithError(err).WithField("addr", s.addr).Warn("Nats connection error")
+			break
+		}
+	}
+
+	s.mu.Lock()
+	if s.conn == conn {
+		s.conn = nil
+	}
+	s.mu.Unlock()
+	conn.Close()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeBroker greets the accepted connections the way a NATS server does
+// and hands them to the test, which reads the frames the client sends
+type fakeBroker struct {
+	ln    net.Listener
+	conns chan *brokerConn
+}
+
+type brokerConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{ln: ln, conns: make(chan *brokerConn, 4)}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(`INFO {"server_id":"fake","version":"2.10.0","max_payload":1048576}` + "\r\n"))
+			b.conns <- &brokerConn{Conn: conn, r: bufio.NewReader(conn)}
+		}
+	}()
+	return b
+}
+
+// accept waits for the next connection and checks its CONNECT line
+func (b *fakeBroker) accept(t *testing.T) *brokerConn {
+	select {
+	case conn := <-b.conns:
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(SINK_TIMEOUT))
+		if line := conn.readLine(t); !strings.HasPrefix(line, "CONNECT {") {
+			t.Fatalf("got %q, want CONNECT", line)
+		}
+		return conn
+	case <-time.After(SINK_TIMEOUT):
+		t.Fatal("the client did not connect")
+	}
+	return nil
+}
+
+func (c *brokerConn) readLine(t *testing.T) string {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+// readFrame returns the PUB frame as it was received, the payload is
+// read by the size in its header
+func (c *brokerConn) readFrame(t *testing.T) string {
+	header := c.readLine(t)
+	fields := strings.Fields(header)
+	if len(fields) != 3 || fields[0] != "PUB" {
+		t.Fatalf("got %q, want PUB <subject> <len>", header)
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header + string(payload)
+}
+
+func testReport(watchList string) *SpreadReport {
+	return &SpreadReport{WatchList: watchList, Time: time.Unix(1767225600, 0).UTC(), Spreads: []*SpreadSample{}}
+}
+
+func expectedFrame(t *testing.T, subject string, report *SpreadReport) string {
+	payload, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(payload), payload)
+}
+
+func TestNatsSinkPublish(t *testing.T) {
+	broker := newFakeBroker(t)
+	sink, err := newNatsSink("nats://"+broker.ln.Addr().String(), "binance.spreads.majors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	first := testReport("first")
+	if err := sink.Write(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	conn := broker.accept(t)
+	if got, want := conn.readFrame(t), expectedFrame(t, "binance.spreads.majors", first); got != want {
+		t.Errorf("got frame %q, want %q", got, want)
+	}
+
+	// the server pings the idle connection
+	conn.Write([]byte("PING\r\n"))
+	if line := conn.readLine(t); line != "PONG\r\n" {
+		t.Errorf("got %q, want PONG", line)
+	}
+
+	// the broker drops the connection, the next write dials it again
+	conn.Close()
+	deadline := time.Now().Add(SINK_TIMEOUT)
+	for {
+		sink.mu.Lock()
+		dropped := sink.conn == nil
+		sink.mu.Unlock()
+		if dropped {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the client did not notice the dropped connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second := testReport("second")
+	if err := sink.Write(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	conn = broker.accept(t)
+	if got, want := conn.readFrame(t), expectedFrame(t, "binance.spreads.majors", second); got != want {
+		t.Errorf("got frame %q, want %q", got, want)
+	}
+}
+
+func TestNatsSinkUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	sink, err := newNatsSink("nats://"+addr, DEFAULT_NATS_SUBJECT_BASE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(context.Background(), testReport("first")); err == nil {
+		t.Error("the write to the closed port succeeded")
+	}
+}
+
+func TestNewNatsSink(t *testing.T) {
+	for _, tt := range []struct {
+		url     string
+		subject string
+		addr    string
+	}{
+		{"nats://broker", "a.b", "broker:4222"},
+		{"nats://broker:4333", "a.b", "broker:4333"},
+		{"http://broker", "a.b", ""},
+		{"nats://broker", "a b", ""},
+	} {
+		sink, err := newNatsSink(tt.url, tt.subject)
+		switch {
+		case tt.addr == "" && err == nil:
+			t.Errorf("%s %q: no error", tt.url, tt.subject)
+		case tt.addr != "" && err != nil:
+			t.Errorf("%s %q: %v", tt.url, tt.subject, err)
+		case tt.addr != "" && sink.addr != tt.addr:
+			t.Errorf("%s: addr %s, want %s", tt.url, sink.addr, tt.addr)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ORDER_BOOK_CONCURRENCY = 8
+	ORDER_BOOK_MAX_AGE     = time.Duration(1) * time.Second
+	ORDER_BOOK_TIMEOUT     = time.Duration(10) * time.Second
+
+	ORDER_BOOK_FETCHED  = "fetched"
+	ORDER_BOOK_JOINED   = "coalesced"
+	ORDER_BOOK_SNAPSHOT = "snapshot"
+)
+
+type orderBookCall struct {
+	limit int
+	done  chan struct{}
+	book  *OrderBook
+	err   error
+}
+
+type orderBookSnapshot struct {
+	limit int
+	book  *OrderBook
+}
+
+// orderBookFetcher is shared by all the order book requests of the client,
+// the identical in-flight requests wait for a single call, the requests
+// which are not deeper than a fresh snapshot or an in-flight call are
+// answered from it, and the calls to the API are capped globally
+type orderBookFetcher struct {
+	fetch     func(ctx context.Context, symbol string, limit int) (*OrderBook, error)
+	slots     chan struct{}
+	snapshots *cache.Cache
+
+	mu       sync.Mutex
+	inflight map[string][]*orderBookCall
+}
+
+func newOrderBookFetcher(
+	fetch func(ctx context.Context, symbol string, limit int) (*OrderBook, error),
+) *orderBookFetcher {
+	return &orderBookFetcher{
+		fetch:     fetch,
+		slots:     make(chan struct{}, ORDER_BOOK_CONCURRENCY),
+		snapshots: cache.New(ORDER_BOOK_MAX_AGE, time.Duration(1)*time.Minute),
+		inflight:  make(map[string][]*orderBookCall),
+	}
+}
+
+func (f *orderBookFetcher) Get(ctx context.Context, symbol string, limit int) (*OrderBook, error) {
+	f.mu.Lock()
+	x, found := f.snapshots.Get(symbol)
+	if found && x.(*orderBookSnapshot).limit >= limit {
+		f.mu.Unlock()
+		orderBookRequests.WithLabelValues(ORDER_BOOK_SNAPSHOT).Inc()
+		return truncateOrderBook(x.(*orderBookSnapshot).book, limit), nil
+	}
+
+	call := f.join(symbol, limit)
+	if call != nil {
+		f.mu.Unlock()
+		orderBookRequests.WithLabelValues(ORDER_BOOK_JOINED).Inc()
+		return f.wait(ctx, call, limit)
+	}
+
+	call = &orderBookCall{limit: limit, done: make(chan struct{})}
+	f.inflight[symbol] = append(f.inflight[symbol], call)
+	f.mu.Unlock()
+	orderBookRequests.WithLabelValues(ORDER_BOOK_FETCHED).Inc()
+
+	// the call is shared, so it must not be cancelled together
+	// with the request which happened to start it
+	go f.run(detach(ctx), symbol, call)
+
+	return f.wait(ctx, call, limit)
+}
+
+// join must be called with the lock held, it returns the shallowest
+// in-flight call of the symbol which is at least as deep as the limit
+func (f *orderBookFetcher) join(symbol string, limit int) *orderBookCall {
+	var best *orderBookCall
+	for _, c := range f.inflight[symbol] {
+		if c.limit >= limit && (best == nil || c.limit < best.limit) {
+			best = c
+		}
+	}
+	return best
+}
+
+func (f *orderBookFetcher) wait(ctx context.Context, call *orderBookCall, limit int) (*OrderBook, error) {
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	return truncateOrderBook(call.book, limit), nil
+}
+
+func (f *orderBookFetcher) run(ctx context.Context, symbol string, call *orderBookCall) {
+	ctx, cancel := context.WithTimeout(ctx, ORDER_BOOK_TIMEOUT)
+	defer cancel()
+
+	call.book, call.err = f.acquire(ctx, symbol, call.limit)
+
+	f.mu.Lock()
+	calls := f.inflight[symbol]
+	for i, c := range calls {
+		if c == call {
+			calls = append(calls[:i], calls[i+1:]...)
+			break
+		}
+	}
+	if len(calls) == 0 {
+		delete(f.inflight, symbol)
+	} else {
+		f.inflight[symbol] = calls
+	}
+	if call.err == nil {
+		x, found := f.snapshots.Get(symbol)
+		if !found || x.(*orderBookSnapshot).limit <= call.limit {
+			f.snapshots.SetDefault(symbol, &orderBookSnapshot{limit: call.limit, book: call.book})
+		}
+	}
+	f.mu.Unlock()
+
+	close(call.done)
+}
+
+// acquire waits for a free slot of the global cap and calls the API
+func (f *orderBookFetcher) acquire(ctx context.Context, symbol string, limit int) (*OrderBook, error) {
+	ctx, span := tracer.Start(ctx, "orderBookFetcher.acquire",
+		trace.WithAttributes(attribute.String("symbol", symbol), attribute.Int("limit", limit)))
+	defer span.End()
+
+	orderBookQueueDepth.Inc()
+	select {
+	case f.slots <- struct{}{}:
+		orderBookQueueDepth.Dec()
+	case <-ctx.Done():
+		orderBookQueueDepth.Dec()
+		recordError(span, ctx.Err())
+		return nil, ctx.Err()
+	}
+	defer func() { <-f.slots }()
+
+	book, err := f.fetch(ctx, symbol, limit)
+	recordError(span, err)
+	return book, err
+}
+
+// truncateOrderBook answers a shallower request from a deeper book,
+// the levels are shared with the snapshot and must not be modified
+func truncateOrderBook(book *OrderBook, limit int) *OrderBook {
+	bids, asks := book.Bids, book.Asks
+	if len(bids) > limit {
+		bids = bids[:limit]
+	}
+	if len(asks) > limit {
+		asks = asks[:limit]
+	}
+	return &OrderBook{Lastupdateid: book.Lastupdateid, Bids: bids, Asks: asks}
+}
+
+// detachedContext keeps the values (logger, trace span) of the parent
+// context but not its cancellation and deadline
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func detach(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubBooks stands in for the order book endpoint, the fetches block
+// until released and the number of them running at once is tracked
+type stubBooks struct {
+	started chan string
+	release chan struct{}
+
+	mu        sync.Mutex
+	calls     int
+	active    int
+	maxActive int
+	cancelled bool
+}
+
+func newStubBooks() *stubBooks {
+	return &stubBooks{started: make(chan string, 64), release: make(chan struct{})}
+}
+
+func (s *stubBooks) fetch(ctx context.Context, symbol string, limit int) (*OrderBook, error) {
+	s.mu.Lock()
+	s.calls++
+	id := s.calls
+	s.active++
+	if s.active > s.maxActive {
+		s.maxActive = s.active
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}()
+
+	s.started <- symbol
+	<-s.release
+	if ctx.Err() != nil {
+		s.mu.Lock()
+		s.cancelled = true
+		s.mu.Unlock()
+		return nil, ctx.Err()
+	}
+
+	book := &OrderBook{Lastupdateid: id}
+	for i := 0; i < limit; i++ {
+		level := []string{fmt.Sprint(100 - i), "1"}
+		book.Bids = append(book.Bids, level)
+		book.Asks = append(book.Asks, level)
+	}
+	return book, nil
+}
+
+func (s *stubBooks) count() (calls int, maxActive int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls, s.maxActive
+}
+
+func (s *stubBooks) waitStarted(t *testing.T) string {
+	select {
+	case symbol := <-s.started:
+		return symbol
+	case <-time.After(time.Second):
+		t.Fatal("no order book fetch started")
+	}
+	return ""
+}
+
+type bookResult struct {
+	book *OrderBook
+	err  error
+}
+
+func getAsync(f *orderBookFetcher, ctx context.Context, symbol string, limit int) <-chan bookResult {
+	result := make(chan bookResult, 1)
+	go func() {
+		book, err := f.Get(ctx, symbol, limit)
+		result <- bookResult{book, err}
+	}()
+	return result
+}
+
+// TestOrderBookCoalescing answers the callers of an in-flight fetch, the
+// shallower ones too, from a single upstream request
+func TestOrderBookCoalescing(t *testing.T) {
+	stub := newStubBooks()
+	f := newOrderBookFetcher(stub.fetch)
+	ctx := context.Background()
+
+	first := getAsync(f, ctx, "BTCUSDT", 100)
+	stub.waitStarted(t)
+
+	var joined []<-chan bookResult
+	for _, limit := range []int{100, 100, 50, 5} {
+		joined = append(joined, getAsync(f, ctx, "BTCUSDT", limit))
+	}
+	// the callers are waiting on the call before it completes
+	time.Sleep(50 * time.Millisecond)
+	close(stub.release)
+
+	for i, result := range append([]<-chan bookResult{first}, joined...) {
+		r := <-result
+		if r.err != nil {
+			t.Fatalf("caller %d: %v", i, r.err)
+		}
+		if r.book.Lastupdateid != 1 {
+			t.Errorf("caller %d got the book of fetch %d, want 1", i, r.book.Lastupdateid)
+		}
+	}
+	if r := <-getAsync(f, ctx, "BTCUSDT", 5); len(r.book.Bids) != 5 || len(r.book.Asks) != 5 {
+		t.Errorf("got %d bids and %d asks, want the book truncated to 5", len(r.book.Bids), len(r.book.Asks))
+	}
+	if calls, _ := stub.count(); calls != 1 {
+		t.Errorf("got %d upstream requests, want 1", calls)
+	}
+}
+
+// TestOrderBookSnapshot reuses the snapshot while it's fresh and as deep
+// as the request, and fetches the book again once it expired
+func TestOrderBookSnapshot(t *testing.T) {
+	stub := newStubBooks()
+	close(stub.release)
+	f := newOrderBookFetcher(stub.fetch)
+	ctx := context.Background()
+
+	for _, step := range []struct {
+		name  string
+		limit int
+		wait  time.Duration
+		calls int
+	}{
+		{"first", 100, 0, 1},
+		{"fresh", 100, 0, 1},
+		{"fresh and shallower", 10, 0, 1},
+		{"deeper", 500, 0, 2},
+		{"expired", 100, ORDER_BOOK_MAX_AGE + 100*time.Millisecond, 3},
+	} {
+		time.Sleep(step.wait)
+		book, err := f.Get(ctx, "BTCUSDT", step.limit)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if len(book.Bids) != step.limit {
+			t.Errorf("%s: got %d levels, want %d", step.name, len(book.Bids), step.limit)
+		}
+		if calls, _ := stub.count(); calls != step.calls {
+			t.Errorf("%s: got %d upstream requests, want %d", step.name, calls, step.calls)
+		}
+	}
+}
+
+// TestOrderBookThrottle runs at most ORDER_BOOK_CONCURRENCY fetches of
+// different symbols at once, the rest wait for a free slot
+func TestOrderBookThrottle(t *testing.T) {
+	stub := newStubBooks()
+	f := newOrderBookFetcher(stub.fetch)
+	ctx := context.Background()
+
+	n := ORDER_BOOK_CONCURRENCY + 4
+	var results []<-chan bookResult
+	for i := 0; i < n; i++ {
+		results = append(results, getAsync(f, ctx, fmt.Sprintf("SYM%dUSDT", i), 5))
+	}
+	for i := 0; i < ORDER_BOOK_CONCURRENCY; i++ {
+		stub.waitStarted(t)
+	}
+	// the queued fetches don't start while the slots are taken
+	select {
+	case symbol := <-stub.started:
+		t.Fatalf("the fetch of %s started above the cap", symbol)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(stub.release)
+	for i, result := range results {
+		if r := <-result; r.err != nil {
+			t.Fatalf("caller %d: %v", i, r.err)
+		}
+	}
+	if calls, maxActive := stub.count(); calls != n || maxActive != ORDER_BOOK_CONCURRENCY {
+		t.Errorf("got %d requests, %d at once, want %d and %d", calls, maxActive, n, ORDER_BOOK_CONCURRENCY)
+	}
+}
+
+// TestOrderBookDetachedCancel lets the caller which started the shared
+// fetch go away without cancelling it for the callers which joined
+func TestOrderBookDetachedCancel(t *testing.T) {
+	stub := newStubBooks()
+	f := newOrderBookFetcher(stub.fetch)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := getAsync(f, ctx, "BTCUSDT", 100)
+	stub.waitStarted(t)
+	joined := getAsync(f, context.Background(), "BTCUSDT", 100)
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	if r := <-first; r.err != context.Canceled {
+		t.Errorf("the cancelled caller got %v, want %v", r.err, context.Canceled)
+	}
+	close(stub.release)
+	if r := <-joined; r.err != nil || r.book.Lastupdateid != 1 {
+		t.Errorf("the joined caller got %v, want the book of the shared fetch", r.err)
+	}
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if stub.cancelled || stub.calls != 1 {
+		t.Errorf("the shared fetch was cancelled %v after %d requests", stub.cancelled, stub.calls)
+	}
+}
@@ -0,0 +1,853 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ORDER_TYPE_MARKET = "MARKET"
+	ORDER_TYPE_LIMIT  = "LIMIT"
+
+	TIME_IN_FORCE_GTC = "GTC"
+	TIME_IN_FORCE_IOC = "IOC"
+
+	ORDER_STATUS_NEW              = "NEW"
+	ORDER_STATUS_PARTIALLY_FILLED = "PARTIALLY_FILLED"
+	ORDER_STATUS_FILLED           = "FILLED"
+	ORDER_STATUS_CANCELED         = "CANCELED"
+	ORDER_STATUS_EXPIRED          = "EXPIRED"
+	ORDER_STATUS_REJECTED         = "REJECTED"
+
+	PAPER_DEFAULT_ACCOUNT = "default"
+	// only the latest closed orders of an account are kept
+	PAPER_MAX_CLOSED_ORDERS = 200
+	// the accounts are created by the requests, so their number, the length
+	// of their names and their resting orders are limited
+	PAPER_MAX_ACCOUNTS     = 1000
+	PAPER_MAX_ACCOUNT_NAME = 64
+	PAPER_MAX_OPEN_ORDERS  = 200
+)
+
+var (
+	ErrFilterFailure       = errors.New("filter failure")
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrInvalidOrder        = errors.New("invalid order")
+	ErrUnknownOrder        = errors.New("unknown order")
+	ErrUnknownAccount      = errors.New("unknown paper account")
+	ErrInvalidAccount      = errors.New("invalid paper account")
+	ErrAccountLimit        = errors.New("paper account limit")
+)
+
+// PaperConfig sets the starting balances of every new simulated account,
+// the fees paid by the resting (maker) and the taking orders, and the file
+// the accounts are persisted to
+type PaperConfig struct {
+	Balances    map[string]decimal.Decimal
+	MakerFeeBps float64
+	TakerFeeBps float64
+	StateFile   string
+}
+
+type PaperOrderRequest struct {
+	Symbol      string           `json:"symbol"`
+	Side        string           `json:"side"`
+	Type        string           `json:"type"`
+	TimeInForce string           `json:"timeInForce,omitempty"`
+	Quantity    decimal.Decimal  `json:"quantity"`
+	Price       *decimal.Decimal `json:"price,omitempty"`
+}
+
+// PaperFill is a match of the order against a book level, the fee is
+// charged in the received asset
+type PaperFill struct {
+	Price    decimal.Decimal `json:"price"`
+	Qty      decimal.Decimal `json:"qty"`
+	Fee      decimal.Decimal `json:"fee"`
+	FeeAsset string          `json:"feeAsset"`
+	Maker    bool            `json:"maker"`
+	Time     time.Time       `json:"time"`
+}
+
+type PaperOrder struct {
+	ID          int64            `json:"orderId"`
+	Symbol      string           `json:"symbol"`
+	Side        string           `json:"side"`
+	Type        string           `json:"type"`
+	TimeInForce string           `json:"timeInForce,omitempty"`
+	Price       *decimal.Decimal `json:"price,omitempty"`
+	Quantity    decimal.Decimal  `json:"quantity"`
+	ExecutedQty decimal.Decimal  `json:"executedQty"`
+	QuoteQty    decimal.Decimal  `json:"quoteQty"`
+	Status      string           `json:"status"`
+	Fills       []*PaperFill     `json:"fills"`
+	Created     time.Time        `json:"created"`
+	Updated     time.Time        `json:"updated"`
+}
+
+type PaperBalance struct {
+	Asset  string          `json:"asset"`
+	Free   decimal.Decimal `json:"free"`
+	Locked decimal.Decimal `json:"locked"`
+}
+
+// PaperPosition is the traded base asset of the symbol at its average cost,
+// negative when more was sold than bought; the pnl and the fees are in the
+// quote asset and the unrealized pnl is marked at the mid price of the book
+type PaperPosition struct {
+	Symbol        string           `json:"symbol"`
+	Qty           decimal.Decimal  `json:"qty"`
+	AvgPrice      decimal.Decimal  `json:"avgPrice"`
+	RealizedPnl   decimal.Decimal  `json:"realizedPnl"`
+	Fees          decimal.Decimal  `json:"fees"`
+	Mark          *decimal.Decimal `json:"mark,omitempty"`
+	UnrealizedPnl *decimal.Decimal `json:"unrealizedPnl,omitempty"`
+	Error         string           `json:"error,omitempty"`
+}
+
+type PaperAccount struct {
+	Name      string           `json:"name"`
+	Time      time.Time        `json:"time"`
+	Balances  []*PaperBalance  `json:"balances"`
+	Positions []*PaperPosition `json:"positions"`
+}
+
+type PaperTrader interface {
+	PlaceOrder(ctx context.Context, account string, r *PaperOrderRequest) (*PaperOrder, error)
+	CancelOrder(ctx context.Context, account string, id int64) (*PaperOrder, error)
+	GetOrders(account string) ([]*PaperOrder, error)
+	GetAccount(ctx context.Context, account string) (*PaperAccount, error)
+	Match(ctx context.Context) error
+}
+
+// paperAccount keeps the open and the latest closed orders by id
+type paperAccount struct {
+	Balances  map[string]*PaperBalance  `json:"balances"`
+	Positions map[string]*PaperPosition `json:"positions"`
+	Orders    []*PaperOrder             `json:"orders"`
+}
+
+type paperState struct {
+	NextOrderID int64                    `json:"nextOrderId"`
+	Accounts    map[string]*paperAccount `json:"accounts"`
+}
+
+type paper struct {
+	service MarketDataService
+	books   PaperBookSource
+	clock   ExchangeClock
+	config  PaperConfig
+	maker   decimal.Decimal
+	taker   decimal.Decimal
+
+	mu    sync.Mutex
+	state *paperState
+	dirty bool
+}
+
+// NewPaperTrader loads the accounts from the state file when it's set,
+// they are memory only otherwise
+func NewPaperTrader(s *MarketDataService, books PaperBookSource, clock ExchangeClock, config PaperConfig) (PaperTrader, error) {
+	p := &paper{
+		service: *s,
+		books:   books,
+		clock:   clock,
+		config:  config,
+		maker:   decimal.NewFromFloat(config.MakerFeeBps).Div(basisPoints),
+		taker:   decimal.NewFromFloat(config.TakerFeeBps).Div(basisPoints),
+		state:   &paperState{NextOrderID: 1, Accounts: make(map[string]*paperAccount)},
+	}
+	if config.StateFile == "" {
+		return p, nil
+	}
+
+	data, err := ioutil.ReadFile(config.StateFile)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, p.state); err != nil {
+		return nil, fmt.Errorf("%s: %w", config.StateFile, err)
+	}
+	return p, nil
+}
+
+func (c PaperConfig) validate() error {
+	if len(c.Balances) == 0 {
+		return errors.New("at least one paper trading starting balance is required")
+	}
+	for _, fee := range []float64{c.MakerFeeBps, c.TakerFeeBps} {
+		if fee < 0 || fee >= 10000 {
+			return fmt.Errorf("invalid paper trading fee %v bps", fee)
+		}
+	}
+	return nil
+}
+
+// parsePaperBalances parses the starting balances, e.g. USDT=10000,BTC=0.5
+func parsePaperBalances(s string) (map[string]decimal.Decimal, error) {
+	balances := make(map[string]decimal.Decimal)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid paper trading balance %q, expected ASSET=amount", v)
+		}
+		amount, err := decimal.NewFromString(kv[1])
+		if err != nil || !amount.IsPositive() {
+			return nil, fmt.Errorf("invalid paper trading balance %q", v)
+		}
+		balances[strings.ToUpper(strings.TrimSpace(kv[0]))] = amount
+	}
+	return balances, nil
+}
+
+// PlaceOrder fills the order against the book, a new account is only
+// kept once its first order is accepted
+func (p *paper) PlaceOrder(ctx context.Context, account string, r *PaperOrderRequest) (order *PaperOrder, err error) {
+	ctx, span := tracer.Start(ctx, "PaperTrader.PlaceOrder",
+		trace.WithAttributes(attribute.String("account", account), attribute.String("symbol", r.Symbol)))
+	defer span.End()
+	defer func() {
+		status := ORDER_STATUS_REJECTED
+		if err != nil {
+			recordError(span, err)
+		} else {
+			status = order.Status
+		}
+		// the labels of the invalid requests are not taken from them
+		kind, side := r.Type, r.Side
+		if kind != ORDER_TYPE_MARKET && kind != ORDER_TYPE_LIMIT {
+			kind = "invalid"
+		}
+		if side != SIDE_BUY && side != SIDE_SELL {
+			side = "invalid"
+		}
+		placedPaperOrders.WithLabelValues(kind, side, status).Inc()
+	}()
+
+	if err := validatePaperAccount(account); err != nil {
+		return nil, err
+	}
+	symbol, err := p.validateOrder(r)
+	if err != nil {
+		return nil, err
+	}
+	book, err := p.books.GetBook(ctx, r.Symbol)
+	if err != nil {
+		return nil, err
+	}
+	// the min notional of the market orders is checked at the mid price
+	price := bookMid(book)
+	if r.Price != nil {
+		price = *r.Price
+	}
+	if err := checkNotional(symbol, r, price); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	acc, found := p.state.Accounts[account]
+	if !found {
+		if len(p.state.Accounts) >= PAPER_MAX_ACCOUNTS {
+			return nil, fmt.Errorf("%w: there are already %d accounts", ErrAccountLimit, PAPER_MAX_ACCOUNTS)
+		}
+		acc = p.newAccount()
+	}
+	if r.TimeInForce == TIME_IN_FORCE_GTC && acc.openOrders() >= PAPER_MAX_OPEN_ORDERS {
+		return nil, fmt.Errorf("%w: the account has %d open orders", ErrAccountLimit, PAPER_MAX_OPEN_ORDERS)
+	}
+	levels := book.Asks
+	if r.Side == SIDE_SELL {
+		levels = book.Bids
+	}
+	levels = append([]PriceLevel{}, levels...)
+	if err := p.reserve(acc, symbol, r, levels); err != nil {
+		return nil, err
+	}
+
+	now := p.clock.Now()
+	order = &PaperOrder{
+		ID:          p.state.NextOrderID,
+		Symbol:      r.Symbol,
+		Side:        r.Side,
+		Type:        r.Type,
+		TimeInForce: r.TimeInForce,
+		Price:       r.Price,
+		Quantity:    r.Quantity,
+		Status:      ORDER_STATUS_NEW,
+		Fills:       []*PaperFill{},
+		Created:     now,
+		Updated:     now,
+	}
+	p.state.Accounts[account] = acc
+	p.state.NextOrderID++
+	p.take(acc, symbol, order, levels, false, now)
+
+	// the unfilled part of the market and the immediate or cancel orders expires
+	if order.Status != ORDER_STATUS_FILLED && order.TimeInForce != TIME_IN_FORCE_GTC {
+		p.release(acc, symbol, order)
+		order.Status = ORDER_STATUS_EXPIRED
+	}
+	acc.Orders = append(acc.Orders, order)
+	p.prune(acc)
+	p.dirty = true
+
+	loggerFromContext(ctx).WithField("account", account).Debugf("Placed paper %s %s order %d of %s %s, %s",
+		order.Type, order.Side, order.ID, order.Quantity, order.Symbol, order.Status)
+	return copyPaperOrder(order), nil
+}
+
+func (p *paper) CancelOrder(ctx context.Context, account string, id int64) (*PaperOrder, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	acc, found := p.state.Accounts[account]
+	if !found {
+		return nil, fmt.Errorf("%w %s", ErrUnknownAccount, account)
+	}
+	for _, o := range acc.Orders {
+		if o.ID != id {
+			continue
+		}
+		if !o.open() {
+			return nil, fmt.Errorf("%w: order %d is already %s", ErrInvalidOrder, id, o.Status)
+		}
+		p.release(acc, p.service.GetMetadata()[o.Symbol], o)
+		o.Status = ORDER_STATUS_CANCELED
+		o.Updated = p.clock.Now()
+		p.dirty = true
+		return copyPaperOrder(o), nil
+	}
+	return nil, fmt.Errorf("%w %d", ErrUnknownOrder, id)
+}
+
+func (p *paper) GetOrders(account string) ([]*PaperOrder, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	acc, found := p.state.Accounts[account]
+	if !found {
+		return nil, fmt.Errorf("%w %s", ErrUnknownAccount, account)
+	}
+	orders := make([]*PaperOrder, 0, len(acc.Orders))
+	for i := len(acc.Orders) - 1; i >= 0; i-- {
+		orders = append(orders, copyPaperOrder(acc.Orders[i]))
+	}
+	return orders, nil
+}
+
+// GetAccount marks the open positions at the mid price of their books
+func (p *paper) GetAccount(ctx context.Context, account string) (*PaperAccount, error) {
+	ctx, span := tracer.Start(ctx, "PaperTrader.GetAccount", trace.WithAttributes(attribute.String("account", account)))
+	defer span.End()
+
+	p.mu.Lock()
+	acc, found := p.state.Accounts[account]
+	if !found {
+		p.mu.Unlock()
+		err := fmt.Errorf("%w %s", ErrUnknownAccount, account)
+		recordError(span, err)
+		return nil, err
+	}
+	view := &PaperAccount{
+		Name:      account,
+		Time:      p.clock.Now(),
+		Balances:  []*PaperBalance{},
+		Positions: []*PaperPosition{},
+	}
+	for _, b := range acc.Balances {
+		copied := *b
+		view.Balances = append(view.Balances, &copied)
+	}
+	for _, pos := range acc.Positions {
+		copied := *pos
+		view.Positions = append(view.Positions, &copied)
+	}
+	p.mu.Unlock()
+
+	sort.Slice(view.Balances, func(i, j int) bool { return view.Balances[i].Asset < view.Balances[j].Asset })
+	sort.Slice(view.Positions, func(i, j int) bool { return view.Positions[i].Symbol < view.Positions[j].Symbol })
+	fanOut(len(view.Positions), FETCH_CONCURRENCY, func(i int) {
+		pos := view.Positions[i]
+		if pos.Qty.IsZero() {
+			return
+		}
+		book, err := p.books.GetBook(ctx, pos.Symbol)
+		if err != nil {
+			pos.Error = err.Error()
+			return
+		}
+		mark := bookMid(book)
+		unrealized := mark.Sub(pos.AvgPrice).Mul(pos.Qty)
+		pos.Mark, pos.UnrealizedPnl = &mark, &unrealized
+	})
+	return view, nil
+}
+
+// Match fills the resting limit orders against the current books, at their
+// limit price as the maker, in the order they were placed; the liquidity
+// taken by an order is not available to the next ones. The accounts changed
+// since the previous run are saved after it
+func (p *paper) Match(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "PaperTrader.Match")
+	defer span.End()
+	defer p.save(ctx)
+
+	p.mu.Lock()
+	var symbols []string
+	seen := make(map[string]bool)
+	for _, acc := range p.state.Accounts {
+		for _, o := range acc.Orders {
+			if o.open() && !seen[o.Symbol] {
+				seen[o.Symbol] = true
+				symbols = append(symbols, o.Symbol)
+			}
+		}
+	}
+	p.mu.Unlock()
+	if len(symbols) == 0 {
+		return nil
+	}
+
+	books := make([]*ValidatedOrderBook, len(symbols))
+	errs := make([]error, len(symbols))
+	fanOut(len(symbols), FETCH_CONCURRENCY, func(i int) {
+		books[i], errs[i] = p.books.GetBook(ctx, symbols[i])
+	})
+	bids := make(map[string][]PriceLevel)
+	asks := make(map[string][]PriceLevel)
+	var failed []string
+	var firstErr error
+	for i, symbol := range symbols {
+		if errs[i] != nil {
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+			failed = append(failed, symbol)
+			continue
+		}
+		bids[symbol] = append([]PriceLevel{}, books[i].Bids...)
+		asks[symbol] = append([]PriceLevel{}, books[i].Asks...)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var orders []*PaperOrder
+	owners := make(map[int64]*paperAccount)
+	for _, acc := range p.state.Accounts {
+		for _, o := range acc.Orders {
+			if _, found := bids[o.Symbol]; found && o.open() {
+				orders = append(orders, o)
+				owners[o.ID] = acc
+			}
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+
+	now := p.clock.Now()
+	filled := 0
+	metadata := p.service.GetMetadata()
+	for _, o := range orders {
+		levels := asks[o.Symbol]
+		if o.Side == SIDE_SELL {
+			levels = bids[o.Symbol]
+		}
+		if n := len(o.Fills); p.take(owners[o.ID], metadata[o.Symbol], o, levels, true, now) > n {
+			filled++
+		}
+	}
+	if filled > 0 {
+		for _, acc := range p.state.Accounts {
+			p.prune(acc)
+		}
+		p.dirty = true
+		loggerFromContext(ctx).Debugf("Filled %d resting paper orders", filled)
+	}
+
+	if len(failed) > 0 {
+		err := fmt.Errorf("order books of %s failed: %w", strings.Join(failed, ","), firstErr)
+		recordError(span, err)
+		return err
+	}
+	return nil
+}
+
+// validateOrder normalizes the request and checks it against the price
+// and the quantity filters of the symbol
+func (p *paper) validateOrder(r *PaperOrderRequest) (Symbol, error) {
+	r.Symbol = strings.ToUpper(r.Symbol)
+	r.Side = strings.ToLower(r.Side)
+	r.Type = strings.ToUpper(r.Type)
+	r.TimeInForce = strings.ToUpper(r.TimeInForce)
+
+	if r.Side != SIDE_BUY && r.Side != SIDE_SELL {
+		return Symbol{}, fmt.Errorf("%w side %q, expected buy or sell", ErrInvalidOrder, r.Side)
+	}
+	if !r.Quantity.IsPositive() {
+		return Symbol{}, fmt.Errorf("%w quantity %s", ErrInvalidOrder, r.Quantity)
+	}
+	switch r.Type {
+	case ORDER_TYPE_MARKET:
+		if r.Price != nil {
+			return Symbol{}, fmt.Errorf("%w: the market orders have no price", ErrInvalidOrder)
+		}
+		if r.TimeInForce != "" {
+			return Symbol{}, fmt.Errorf("%w: the market orders have no time in force", ErrInvalidOrder)
+		}
+	case ORDER_TYPE_LIMIT:
+		if r.Price == nil || !r.Price.IsPositive() {
+			return Symbol{}, fmt.Errorf("%w: the limit orders require a positive price", ErrInvalidOrder)
+		}
+		if r.TimeInForce == "" {
+			r.TimeInForce = TIME_IN_FORCE_GTC
+		}
+		if r.TimeInForce != TIME_IN_FORCE_GTC && r.TimeInForce != TIME_IN_FORCE_IOC {
+			return Symbol{}, fmt.Errorf("%w time in force %q, expected GTC or IOC", ErrInvalidOrder, r.TimeInForce)
+		}
+	default:
+		return Symbol{}, fmt.Errorf("%w type %q, expected MARKET or LIMIT", ErrInvalidOrder, r.Type)
+	}
+
+	symbol, found := p.service.GetMetadata()[r.Symbol]
+	if !found {
+		return Symbol{}, fmt.Errorf("%w %s", ErrUnknownSymbol, r.Symbol)
+	}
+	if symbol.Status != SYMBOL_STATUS_TRADING {
+		return Symbol{}, fmt.Errorf("%w: %s is not trading", ErrInvalidOrder, r.Symbol)
+	}
+	return symbol, checkFilters(symbol, r)
+}
+
+// checkFilters applies the price filter to the limit orders and the lot
+// size filters to all of them, the values of the disabled ones are zero
+func checkFilters(s Symbol, r *PaperOrderRequest) error {
+	for _, f := range s.Filters {
+		switch {
+		case f.Filtertype == "PRICE_FILTER" && r.Type == ORDER_TYPE_LIMIT:
+			min, max, tick := filterDecimal(f.Minprice), filterDecimal(f.Maxprice), filterDecimal(f.Ticksize)
+			if r.Price.LessThan(min) || (max.IsPositive() && r.Price.GreaterThan(max)) {
+				return fmt.Errorf("%w: PRICE_FILTER, price %s is out of the range %s to %s",
+					ErrFilterFailure, r.Price, min, max)
+			}
+			if !multipleOf(*r.Price, min, tick) {
+				return fmt.Errorf("%w: PRICE_FILTER, price %s is not a multiple of the tick size %s",
+					ErrFilterFailure, r.Price, tick)
+			}
+		case f.Filtertype == "LOT_SIZE" || (f.Filtertype == "MARKET_LOT_SIZE" && r.Type == ORDER_TYPE_MARKET):
+			min, max, step := filterDecimal(f.Minqty), filterDecimal(f.Maxqty), filterDecimal(f.Stepsize)
+			if r.Quantity.LessThan(min) || (max.IsPositive() && r.Quantity.GreaterThan(max)) {
+				return fmt.Errorf("%w: %s, quantity %s is out of the range %s to %s",
+					ErrFilterFailure, f.Filtertype, r.Quantity, min, max)
+			}
+			if !multipleOf(r.Quantity, min, step) {
+				return fmt.Errorf("%w: %s, quantity %s is not a multiple of the step size %s",
+					ErrFilterFailure, f.Filtertype, r.Quantity, step)
+			}
+		}
+	}
+	return nil
+}
+
+// checkNotional applies the min notional filters at the price, the min
+// notional one only applies to the market orders when it says so
+func checkNotional(s Symbol, r *PaperOrderRequest, price decimal.Decimal) error {
+	notional := price.Mul(r.Quantity)
+	for _, f := range s.Filters {
+		if f.Filtertype != "NOTIONAL" && f.Filtertype != "MIN_NOTIONAL" {
+			continue
+		}
+		if f.Filtertype == "MIN_NOTIONAL" && r.Type == ORDER_TYPE_MARKET && !f.Applytomarket {
+			continue
+		}
+		if min := filterDecimal(f.Minnotional); notional.LessThan(min) {
+			return fmt.Errorf("%w: %s, notional %s is below %s", ErrFilterFailure, f.Filtertype, notional, min)
+		}
+	}
+	return nil
+}
+
+func filterDecimal(s string) decimal.Decimal {
+	d, _ := decimal.NewFromString(s)
+	return d
+}
+
+func multipleOf(v decimal.Decimal, min decimal.Decimal, step decimal.Decimal) bool {
+	return !step.IsPositive() || v.Sub(min).Mod(step).IsZero()
+}
+
+// validatePaperAccount allows the names of letters, digits, dots, dashes and underscores
+func validatePaperAccount(name string) error {
+	if len(name) > PAPER_MAX_ACCOUNT_NAME {
+		return fmt.Errorf("%w: the name is longer than %d characters", ErrInvalidAccount, PAPER_MAX_ACCOUNT_NAME)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("._-", r)) {
+			return fmt.Errorf("%w name %q", ErrInvalidAccount, name)
+		}
+	}
+	return nil
+}
+
+// newAccount starts with the configured balances
+func (p *paper) newAccount() *paperAccount {
+	acc := &paperAccount{
+		Balances:  make(map[string]*PaperBalance, len(p.config.Balances)),
+		Positions: make(map[string]*PaperPosition),
+		Orders:    []*PaperOrder{},
+	}
+	for asset, amount := range p.config.Balances {
+		acc.Balances[asset] = &PaperBalance{Asset: asset, Free: amount}
+	}
+	return acc
+}
+
+func (a *paperAccount) openOrders() int {
+	n := 0
+	for _, o := range a.Orders {
+		if o.open() {
+			n++
+		}
+	}
+	return n
+}
+
+func (a *paperAccount) balance(asset string) *PaperBalance {
+	b, found := a.Balances[asset]
+	if !found {
+		b = &PaperBalance{Asset: asset}
+		a.Balances[asset] = b
+	}
+	return b
+}
+
+// reserve checks the free balance the order spends and locks it for the
+// limit orders, a market buy spends the quote asset of the levels it takes
+func (p *paper) reserve(acc *paperAccount, s Symbol, r *PaperOrderRequest, levels []PriceLevel) error {
+	asset, amount := s.Baseasset, r.Quantity
+	if r.Side == SIDE_BUY {
+		asset = s.Quoteasset
+		if r.Price != nil {
+			amount = r.Price.Mul(r.Quantity)
+		} else {
+			amount = decimal.Zero
+			remaining := r.Quantity
+			for _, l := range levels {
+				qty := decimal.Min(remaining, l.Qty)
+				amount = amount.Add(qty.Mul(l.Price))
+				if remaining = remaining.Sub(qty); remaining.IsZero() {
+					break
+				}
+			}
+		}
+	}
+
+	b := acc.balance(asset)
+	if b.Free.LessThan(amount) {
+		return fmt.Errorf("%w: %s %s is required, %s is free", ErrInsufficientBalance, amount, asset, b.Free)
+	}
+	if r.Type == ORDER_TYPE_LIMIT {
+		b.Free, b.Locked = b.Free.Sub(amount), b.Locked.Add(amount)
+	}
+	return nil
+}
+
+// release unlocks the balance of the unfilled part of the limit order
+func (p *paper) release(acc *paperAccount, s Symbol, o *PaperOrder) {
+	if o.Type != ORDER_TYPE_LIMIT {
+		return
+	}
+	remaining := o.Quantity.Sub(o.ExecutedQty)
+	b, amount := acc.balance(s.Baseasset), remaining
+	if o.Side == SIDE_BUY {
+		b, amount = acc.balance(s.Quoteasset), o.Price.Mul(remaining)
+	}
+	b.Free, b.Locked = b.Free.Add(amount), b.Locked.Sub(amount)
+}
+
+// take fills the order against the levels which cross its limit price and
+// removes the taken quantity from them, a taker fills at the level prices
+// and a maker at its limit price; it returns the number of the order fills
+func (p *paper) take(acc *paperAccount, s Symbol, o *PaperOrder, levels []PriceLevel, maker bool, now time.Time) int {
+	for i := range levels {
+		remaining := o.Quantity.Sub(o.ExecutedQty)
+		if remaining.IsZero() {
+			break
+		}
+		l := &levels[i]
+		if o.Price != nil && ((o.Side == SIDE_BUY && l.Price.GreaterThan(*o.Price)) ||
+			(o.Side == SIDE_SELL && l.Price.LessThan(*o.Price))) {
+			break
+		}
+		qty := decimal.Min(remaining, l.Qty)
+		if !qty.IsPositive() {
+			continue
+		}
+		l.Qty = l.Qty.Sub(qty)
+
+		price := l.Price
+		if maker {
+			price = *o.Price
+		}
+		p.fill(acc, s, o, price, qty, maker, now)
+	}
+
+	if o.ExecutedQty.Equal(o.Quantity) {
+		o.Status = ORDER_STATUS_FILLED
+	} else if o.ExecutedQty.IsPositive() {
+		o.Status = ORDER_STATUS_PARTIALLY_FILLED
+	}
+	return len(o.Fills)
+}
+
+// fill moves the balances of the fill and updates the position of the symbol,
+// the locked balance of the limit orders is released before it's spent
+func (p *paper) fill(acc *paperAccount, s Symbol, o *PaperOrder, price decimal.Decimal, qty decimal.Decimal, maker bool, now time.Time) {
+	rate := p.taker
+	if maker {
+		rate = p.maker
+	}
+	notional := price.Mul(qty)
+	base, quote := acc.balance(s.Baseasset), acc.balance(s.Quoteasset)
+
+	f := &PaperFill{Price: price, Qty: qty, Maker: maker, Time: now}
+	position := acc.Positions[o.Symbol]
+	if position == nil {
+		position = &PaperPosition{Symbol: o.Symbol}
+		acc.Positions[o.Symbol] = position
+	}
+	if o.Side == SIDE_BUY {
+		if o.Type == ORDER_TYPE_LIMIT {
+			locked := o.Price.Mul(qty)
+			quote.Free, quote.Locked = quote.Free.Add(locked), quote.Locked.Sub(locked)
+		}
+		// the fee is paid in the base asset, the position grows by the
+		// received quantity so it reconciles with the base balance
+		f.Fee, f.FeeAsset = qty.Mul(rate), s.Baseasset
+		received := qty.Sub(f.Fee)
+		quote.Free = quote.Free.Sub(notional)
+		base.Free = base.Free.Add(received)
+		position.trade(received, price)
+		position.Fees = position.Fees.Add(f.Fee.Mul(price))
+	} else {
+		if o.Type == ORDER_TYPE_LIMIT {
+			base.Free, base.Locked = base.Free.Add(qty), base.Locked.Sub(qty)
+		}
+		f.Fee, f.FeeAsset = notional.Mul(rate), s.Quoteasset
+		base.Free = base.Free.Sub(qty)
+		quote.Free = quote.Free.Add(notional.Sub(f.Fee))
+		position.trade(qty.Neg(), price)
+		position.Fees = position.Fees.Add(f.Fee)
+	}
+
+	o.Fills = append(o.Fills, f)
+	o.ExecutedQty = o.ExecutedQty.Add(qty)
+	o.QuoteQty = o.QuoteQty.Add(notional)
+	o.Updated = now
+}
+
+// trade adds the signed quantity at the price, the part closing the position
+// realizes its pnl and the rest opens it at the average price
+func (pos *PaperPosition) trade(qty decimal.Decimal, price decimal.Decimal) {
+	if pos.Qty.IsZero() || pos.Qty.Sign() == qty.Sign() {
+		total := pos.Qty.Add(qty)
+		pos.AvgPrice = pos.AvgPrice.Mul(pos.Qty.Abs()).Add(price.Mul(qty.Abs())).Div(total.Abs())
+		pos.Qty = total
+		return
+	}
+
+	closed := decimal.Min(qty.Abs(), pos.Qty.Abs())
+	pnl := price.Sub(pos.AvgPrice).Mul(closed)
+	if pos.Qty.IsNegative() {
+		pnl = pnl.Neg()
+	}
+	pos.RealizedPnl = pos.RealizedPnl.Add(pnl)
+	pos.Qty = pos.Qty.Add(qty)
+	if pos.Qty.IsZero() {
+		pos.AvgPrice = decimal.Zero
+	} else if pos.Qty.Sign() == qty.Sign() {
+		pos.AvgPrice = price
+	}
+}
+
+func (o *PaperOrder) open() bool {
+	return o.Status == ORDER_STATUS_NEW || o.Status == ORDER_STATUS_PARTIALLY_FILLED
+}
+
+// prune drops the oldest closed orders above PAPER_MAX_CLOSED_ORDERS
+func (p *paper) prune(acc *paperAccount) {
+	closed := 0
+	for _, o := range acc.Orders {
+		if !o.open() {
+			closed++
+		}
+	}
+	if closed <= PAPER_MAX_CLOSED_ORDERS {
+		return
+	}
+	orders := acc.Orders[:0]
+	for _, o := range acc.Orders {
+		if !o.open() && closed > PAPER_MAX_CLOSED_ORDERS {
+			closed--
+			continue
+		}
+		orders = append(orders, o)
+	}
+	acc.Orders = orders
+}
+
+// save rewrites the state file when the accounts changed, the snapshot is
+// taken under the lock and written without it; it's only called by Match,
+// whose runs don't overlap. The accounts stay in memory when it fails,
+// and the next run tries again
+func (p *paper) save(ctx context.Context) {
+	if p.config.StateFile == "" {
+		return
+	}
+	p.mu.Lock()
+	if !p.dirty {
+		p.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(p.state)
+	p.dirty = false
+	p.mu.Unlock()
+
+	if err == nil {
+		tmp := p.config.StateFile + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, p.config.StateFile)
+		}
+	}
+	if err != nil {
+		loggerFromContext(ctx).WithError(err).Error("Error occurred while saving paper trading accounts")
+		p.mu.Lock()
+		p.dirty = true
+		p.mu.Unlock()
+	}
+}
+
+func copyPaperOrder(o *PaperOrder) *PaperOrder {
+	copied := *o
+	copied.Fills = append([]*PaperFill{}, o.Fills...)
+	return &copied
+}
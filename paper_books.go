@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the simulated orders walk the top 100 levels of the book
+const PAPER_BOOK_LIMIT = 100
+
+var ErrReplayFinished = errors.New("the replayed order books are finished")
+
+// RecordedOrderBook is a line of the recorded order books file
+type RecordedOrderBook struct {
+	Time   time.Time  `json:"time"`
+	Symbol string     `json:"symbol"`
+	Bids   [][]string `json:"bids"`
+	Asks   [][]string `json:"asks"`
+}
+
+// PaperBookSource provides the order books the simulated orders are filled against
+type PaperBookSource interface {
+	GetBook(ctx context.Context, symbol string) (*ValidatedOrderBook, error)
+}
+
+// liveBooks fetches the books from the api and, when the path is set,
+// appends every fetched book to the file so the session can be replayed
+type liveBooks struct {
+	client ApiClient
+	clock  ExchangeClock
+	path   string
+
+	mu sync.Mutex
+}
+
+func NewLiveBookSource(c *ApiClient, clock ExchangeClock, recordPath string) PaperBookSource {
+	return &liveBooks{client: *c, clock: clock, path: recordPath}
+}
+
+func (b *liveBooks) GetBook(ctx context.Context, symbol string) (*ValidatedOrderBook, error) {
+	book, err := b.client.GetOrderBook(ctx, symbol, PAPER_BOOK_LIMIT)
+	if err != nil {
+		return nil, err
+	}
+	validated, err := validateOrderBook(symbol, book)
+	if err != nil {
+		quarantine(ctx, err)
+		return nil, err
+	}
+
+	if b.path != "" {
+		recorded := &RecordedOrderBook{Time: b.clock.Now(), Symbol: symbol, Bids: book.Bids, Asks: book.Asks}
+		if err := b.record(recorded); err != nil {
+			loggerFromContext(ctx).WithError(err).Warn("Error occurred while recording order book")
+		}
+	}
+	return validated, nil
+}
+
+func (b *liveBooks) record(book *RecordedOrderBook) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	f, err := os.OpenFile(b.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(book)
+}
+
+// replayBooks plays the recorded books in real time from the start of the
+// replay, a symbol is at its last book recorded before the replay time
+type replayBooks struct {
+	books map[string][]*ValidatedOrderBook
+	times map[string][]time.Time
+	first time.Time
+	last  time.Time
+	start time.Time
+}
+
+func NewReplayBookSource(path string) (PaperBookSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recorded []*RecordedOrderBook
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var r RecordedOrderBook
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		recorded = append(recorded, &r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(recorded) == 0 {
+		return nil, fmt.Errorf("no order books are recorded in %s", path)
+	}
+	sort.SliceStable(recorded, func(i, j int) bool { return recorded[i].Time.Before(recorded[j].Time) })
+
+	r := &replayBooks{
+		books: make(map[string][]*ValidatedOrderBook),
+		times: make(map[string][]time.Time),
+		first: recorded[0].Time,
+		last:  recorded[len(recorded)-1].Time,
+		start: time.Now(),
+	}
+	for _, b := range recorded {
+		book, err := validateOrderBook(b.Symbol, &OrderBook{Bids: b.Bids, Asks: b.Asks})
+		if err != nil {
+			return nil, err
+		}
+		r.books[b.Symbol] = append(r.books[b.Symbol], book)
+		r.times[b.Symbol] = append(r.times[b.Symbol], b.Time)
+	}
+	return r, nil
+}
+
+func (r *replayBooks) GetBook(ctx context.Context, symbol string) (*ValidatedOrderBook, error) {
+	at := r.first.Add(time.Since(r.start))
+	if at.After(r.last) {
+		return nil, ErrReplayFinished
+	}
+
+	times := r.times[symbol]
+	i := sort.Search(len(times), func(i int) bool { return times[i].After(at) })
+	if i == 0 {
+		return nil, fmt.Errorf("no order book of %s is recorded before %s", symbol, at.Format(time.RFC3339))
+	}
+	return r.books[symbol][i-1], nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// the order requests are small, anything bigger is refused
+const PAPER_MAX_REQUEST_BYTES = 1 << 16
+
+// paperOrders places a simulated order on POST, cancels one on DELETE
+// and lists the open and the latest closed orders of the account on GET
+func (c *controller) paperOrders(w http.ResponseWriter, req *http.Request) {
+	account := paperAccountName(req)
+
+	switch req.Method {
+	case http.MethodGet:
+		orders, err := c.paper.GetOrders(account)
+		if err != nil {
+			writeJSONError(w, paperStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, orders)
+
+	case http.MethodPost:
+		var order PaperOrderRequest
+		dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, PAPER_MAX_REQUEST_BYTES))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&order); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("%w: %s", ErrInvalidOrder, err))
+			return
+		}
+		placed, err := c.paper.PlaceOrder(req.Context(), account, &order)
+		if err != nil {
+			writeJSONError(w, paperStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, placed)
+
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(req.URL.Query().Get("orderId"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, errors.New("a numeric orderId is required"))
+			return
+		}
+		canceled, err := c.paper.CancelOrder(req.Context(), account, id)
+		if err != nil {
+			writeJSONError(w, paperStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, canceled)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", req.Method))
+	}
+}
+
+// paperBalances returns the balances and the positions marked to the books
+func (c *controller) paperBalances(w http.ResponseWriter, req *http.Request) {
+	acc, err := c.paper.GetAccount(req.Context(), paperAccountName(req))
+	if err != nil {
+		writeJSONError(w, paperStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, acc)
+}
+
+func paperAccountName(req *http.Request) string {
+	if name := strings.TrimSpace(req.URL.Query().Get("account")); name != "" {
+		return name
+	}
+	return PAPER_DEFAULT_ACCOUNT
+}
+
+func paperStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnknownAccount), errors.Is(err, ErrUnknownOrder):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidOrder), errors.Is(err, ErrFilterFailure),
+		errors.Is(err, ErrInsufficientBalance), errors.Is(err, ErrUnknownSymbol),
+		errors.Is(err, ErrInvalidAccount), errors.Is(err, ErrAccountLimit):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrReplayFinished):
+		return http.StatusServiceUnavailable
+	}
+	return upstreamStatus(err)
+}
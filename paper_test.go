@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// paperMetadata is the market data service of the paper trader, which
+// only takes the symbols from it
+type paperMetadata struct {
+	MarketDataService
+	symbols map[string]Symbol
+}
+
+func (m *paperMetadata) GetMetadata() map[string]Symbol { return m.symbols }
+
+// paperBooks serves the books set by the test, a symbol without
+// a book fails as the API would
+type paperBooks struct {
+	mu    sync.Mutex
+	books map[string]*ValidatedOrderBook
+}
+
+func (b *paperBooks) GetBook(ctx context.Context, symbol string) (*ValidatedOrderBook, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	book, found := b.books[symbol]
+	if !found {
+		return nil, fmt.Errorf("no order book of %s", symbol)
+	}
+	return book, nil
+}
+
+// set takes the levels as price:qty pairs, the best first
+func (b *paperBooks) set(t *testing.T, symbol string, bids string, asks string) {
+	levels := func(s string) [][]string {
+		out := [][]string{}
+		for _, l := range strings.Fields(s) {
+			out = append(out, strings.SplitN(l, ":", 2))
+		}
+		return out
+	}
+	book, err := validateOrderBook(symbol, &OrderBook{Bids: levels(bids), Asks: levels(asks)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.books[symbol] = book
+}
+
+func paperSymbol() Symbol {
+	s := testSymbol("BTCUSDT", "BTC", "USDT", SYMBOL_STATUS_TRADING)
+	s.Filters = []Filter{
+		{Filtertype: "PRICE_FILTER", Minprice: "0.01", Maxprice: "1000000", Ticksize: "0.01"},
+		{Filtertype: "LOT_SIZE", Minqty: "0.001", Maxqty: "100", Stepsize: "0.001"},
+		{Filtertype: "NOTIONAL", Minnotional: "10"},
+	}
+	return s
+}
+
+func newTestPaperTrader(t *testing.T, books PaperBookSource, stateFile string) PaperTrader {
+	var service MarketDataService = &paperMetadata{symbols: map[string]Symbol{"BTCUSDT": paperSymbol()}}
+	p, err := NewPaperTrader(&service, books, &fixedClock{now: time.Unix(1767225600, 0)}, PaperConfig{
+		Balances:    map[string]decimal.Decimal{"USDT": decimal.NewFromInt(1000)},
+		MakerFeeBps: 10,
+		TakerFeeBps: 10,
+		StateFile:   stateFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func paperPrice(s string) *decimal.Decimal {
+	d := decimal.RequireFromString(s)
+	return &d
+}
+
+// TestPaperFillReconciles buys and sells back everything received, the
+// position follows the base balance and the fees are paid on both sides
+func TestPaperFillReconciles(t *testing.T) {
+	p := &paper{
+		config: PaperConfig{Balances: map[string]decimal.Decimal{"USDT": decimal.NewFromInt(1000)}},
+		maker:  decimal.RequireFromString("0.001"),
+		taker:  decimal.RequireFromString("0.001"),
+	}
+	acc := p.newAccount()
+	s := testSymbol("BTCUSDT", "BTC", "USDT", SYMBOL_STATUS_TRADING)
+	now := time.Unix(1767225600, 0)
+	d := decimal.RequireFromString
+
+	buy := &PaperOrder{Symbol: "BTCUSDT", Side: SIDE_BUY, Type: ORDER_TYPE_MARKET, Quantity: d("1")}
+	p.fill(acc, s, buy, d("100"), d("1"), false, now)
+
+	pos := acc.Positions["BTCUSDT"]
+	if base := acc.balance("BTC").Free; !pos.Qty.Equal(base) || !base.Equal(d("0.999")) {
+		t.Fatalf("position %s, balance %s, want 0.999", pos.Qty, base)
+	}
+	if !pos.AvgPrice.Equal(d("100")) {
+		t.Errorf("average price %s, want 100", pos.AvgPrice)
+	}
+
+	sell := &PaperOrder{Symbol: "BTCUSDT", Side: SIDE_SELL, Type: ORDER_TYPE_MARKET, Quantity: d("0.999")}
+	p.fill(acc, s, sell, d("110"), d("0.999"), false, now)
+
+	if !pos.Qty.IsZero() || !acc.balance("BTC").Free.IsZero() {
+		t.Errorf("position %s, balance %s after selling everything", pos.Qty, acc.balance("BTC").Free)
+	}
+	// the quote balance moved by the realized pnl less the fees
+	for _, v := range []struct {
+		name string
+		got  decimal.Decimal
+		want string
+	}{
+		{"realized pnl", pos.RealizedPnl, "9.99"},
+		{"fees", pos.Fees, "0.20989"},
+		{"usdt", acc.balance("USDT").Free, "1009.78011"},
+	} {
+		if !v.got.Equal(d(v.want)) {
+			t.Errorf("%s %s, want %s", v.name, v.got, v.want)
+		}
+	}
+	if diff := acc.balance("USDT").Free.Sub(d("1000")); !diff.Equal(pos.RealizedPnl.Sub(pos.Fees)) {
+		t.Errorf("the balance moved by %s, the pnl less the fees is %s", diff, pos.RealizedPnl.Sub(pos.Fees))
+	}
+}
+
+// TestPaperPlaceOrderRejections refuses the orders which fail the filters
+// of the symbol or the free balance, without creating their account
+func TestPaperPlaceOrderRejections(t *testing.T) {
+	books := &paperBooks{books: make(map[string]*ValidatedOrderBook)}
+	books.set(t, "BTCUSDT", "99:5", "100:5")
+	d := decimal.RequireFromString
+
+	for _, tt := range []struct {
+		name    string
+		request PaperOrderRequest
+		err     error
+		reason  string
+	}{
+		{"quantity below the min", PaperOrderRequest{Symbol: "BTCUSDT", Side: "buy", Type: "LIMIT", Quantity: d("0.0001"), Price: paperPrice("100")},
+			ErrFilterFailure, "LOT_SIZE"},
+		{"quantity off the step", PaperOrderRequest{Symbol: "BTCUSDT", Side: "buy", Type: "LIMIT", Quantity: d("0.5005"), Price: paperPrice("100")},
+			ErrFilterFailure, "LOT_SIZE"},
+		{"price off the tick", PaperOrderRequest{Symbol: "BTCUSDT", Side: "buy", Type: "LIMIT", Quantity: d("0.5"), Price: paperPrice("100.005")},
+			ErrFilterFailure, "PRICE_FILTER"},
+		{"price above the max", PaperOrderRequest{Symbol: "BTCUSDT", Side: "sell", Type: "LIMIT", Quantity: d("0.5"), Price: paperPrice("2000000")},
+			ErrFilterFailure, "PRICE_FILTER"},
+		{"limit notional", PaperOrderRequest{Symbol: "BTCUSDT", Side: "buy", Type: "LIMIT", Quantity: d("0.05"), Price: paperPrice("100")},
+			ErrFilterFailure, "NOTIONAL"},
+		{"market notional at the mid", PaperOrderRequest{Symbol: "BTCUSDT", Side: "buy", Type: "MARKET", Quantity: d("0.09")},
+			ErrFilterFailure, "NOTIONAL"},
+		{"insufficient quote", PaperOrderRequest{Symbol: "BTCUSDT", Side: "buy", Type: "LIMIT", Quantity: d("20"), Price: paperPrice("100")},
+			ErrInsufficientBalance, ""},
+		{"insufficient base", PaperOrderRequest{Symbol: "BTCUSDT", Side: "sell", Type: "MARKET", Quantity: d("1")},
+			ErrInsufficientBalance, ""},
+		{"unknown symbol", PaperOrderRequest{Symbol: "ETHUSDT", Side: "buy", Type: "MARKET", Quantity: d("1")},
+			ErrUnknownSymbol, ""},
+	} {
+		p := newTestPaperTrader(t, books, "")
+		r := tt.request
+		_, err := p.PlaceOrder(context.Background(), "alice", &r)
+		if !errors.Is(err, tt.err) || !strings.Contains(err.Error(), tt.reason) {
+			t.Errorf("%s: got %v, want %v %s", tt.name, err, tt.err, tt.reason)
+		}
+		if _, err := p.GetOrders("alice"); !errors.Is(err, ErrUnknownAccount) {
+			t.Errorf("%s: the rejected order created the account", tt.name)
+		}
+	}
+}
+
+// TestPaperMatch fills a resting limit buy as the maker at its price from
+// the book updates which cross it, and locks only its unfilled part
+func TestPaperMatch(t *testing.T) {
+	books := &paperBooks{books: make(map[string]*ValidatedOrderBook)}
+	books.set(t, "BTCUSDT", "99:5", "100:5")
+	p := newTestPaperTrader(t, books, "")
+	ctx := context.Background()
+	d := decimal.RequireFromString
+
+	order, err := p.PlaceOrder(ctx, "alice", &PaperOrderRequest{
+		Symbol: "BTCUSDT", Side: "buy", Type: "LIMIT", Quantity: d("1"), Price: paperPrice("99.5"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Status != ORDER_STATUS_NEW {
+		t.Fatalf("the order below the ask is %s, want NEW", order.Status)
+	}
+
+	for _, step := range []struct {
+		name     string
+		asks     string
+		status   string
+		executed string
+		free     string
+		locked   string
+		btc      string
+	}{
+		{"no cross", "99.6:5", ORDER_STATUS_NEW, "0", "900.5", "99.5", "0"},
+		{"partial", "99.4:0.4 99.7:5", ORDER_STATUS_PARTIALLY_FILLED, "0.4", "900.5", "59.7", "0.3996"},
+		{"rest", "99:5", ORDER_STATUS_FILLED, "1", "900.5", "0", "0.999"},
+	} {
+		books.set(t, "BTCUSDT", "98:5", step.asks)
+		if err := p.Match(ctx); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		orders, _ := p.GetOrders("alice")
+		o := orders[0]
+		if o.Status != step.status || !o.ExecutedQty.Equal(d(step.executed)) {
+			t.Errorf("%s: the order is %s with %s executed, want %s with %s",
+				step.name, o.Status, o.ExecutedQty, step.status, step.executed)
+		}
+		for _, f := range o.Fills {
+			if !f.Maker || !f.Price.Equal(d("99.5")) {
+				t.Errorf("%s: got a fill at %s maker %v, want the maker at 99.5", step.name, f.Price, f.Maker)
+			}
+		}
+		acc, err := p.GetAccount(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		balances := make(map[string]*PaperBalance)
+		for _, b := range acc.Balances {
+			balances[b.Asset] = b
+		}
+		usdt := balances["USDT"]
+		if !usdt.Free.Equal(d(step.free)) || !usdt.Locked.Equal(d(step.locked)) {
+			t.Errorf("%s: usdt %s free, %s locked, want %s and %s", step.name, usdt.Free, usdt.Locked, step.free, step.locked)
+		}
+		btc := decimal.Zero
+		if b, found := balances["BTC"]; found {
+			btc = b.Free
+		}
+		if !btc.Equal(d(step.btc)) {
+			t.Errorf("%s: btc %s, want %s", step.name, btc, step.btc)
+		}
+	}
+}
+
+// TestPaperCancel releases the locked balance of the open order once
+func TestPaperCancel(t *testing.T) {
+	books := &paperBooks{books: make(map[string]*ValidatedOrderBook)}
+	books.set(t, "BTCUSDT", "99:5", "100:5")
+	p := newTestPaperTrader(t, books, "")
+	ctx := context.Background()
+
+	order, err := p.PlaceOrder(ctx, "alice", &PaperOrderRequest{
+		Symbol: "BTCUSDT", Side: "buy", Type: "LIMIT", Quantity: decimal.NewFromInt(2), Price: paperPrice("90"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		account string
+		id      int64
+		err     error
+	}{
+		{"open", "alice", order.ID, nil},
+		{"already canceled", "alice", order.ID, ErrInvalidOrder},
+		{"unknown order", "alice", order.ID + 1, ErrUnknownOrder},
+		{"unknown account", "bob", order.ID, ErrUnknownAccount},
+	} {
+		canceled, err := p.CancelOrder(ctx, tt.account, tt.id)
+		if !errors.Is(err, tt.err) || (tt.err != nil) != (err != nil) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && canceled.Status != ORDER_STATUS_CANCELED {
+			t.Errorf("%s: the order is %s, want CANCELED", tt.name, canceled.Status)
+		}
+	}
+
+	acc, err := p.GetAccount(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range acc.Balances {
+		if b.Asset == "USDT" && (!b.Free.Equal(decimal.NewFromInt(1000)) || !b.Locked.IsZero()) {
+			t.Errorf("usdt %s free, %s locked after the cancel, want 1000 and 0", b.Free, b.Locked)
+		}
+	}
+}
+
+// TestPaperPersistence saves the accounts changed by the matching run and
+// loads the orders and the balances back from the state file
+func TestPaperPersistence(t *testing.T) {
+	books := &paperBooks{books: make(map[string]*ValidatedOrderBook)}
+	books.set(t, "BTCUSDT", "99:5", "100:5")
+	path := filepath.Join(t.TempDir(), "paper.json")
+	p := newTestPaperTrader(t, books, path)
+	ctx := context.Background()
+
+	for _, r := range []*PaperOrderRequest{
+		{Symbol: "BTCUSDT", Side: "buy", Type: "MARKET", Quantity: decimal.NewFromInt(1)},
+		{Symbol: "BTCUSDT", Side: "sell", Type: "LIMIT", Quantity: decimal.RequireFromString("0.5"), Price: paperPrice("105")},
+	} {
+		if _, err := p.PlaceOrder(ctx, "alice", r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Match(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := p.GetOrders("alice")
+
+	loaded := newTestPaperTrader(t, books, path)
+	got, err := loaded.GetOrders("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJSON, _ := json.Marshal(want)
+	gotJSON, _ := json.Marshal(got)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("loaded orders %s, want %s", gotJSON, wantJSON)
+	}
+
+	// the order ids continue after the loaded ones
+	order, err := loaded.PlaceOrder(ctx, "alice", &PaperOrderRequest{
+		Symbol: "BTCUSDT", Side: "sell", Type: "MARKET", Quantity: decimal.RequireFromString("0.2"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.ID != 3 {
+		t.Errorf("got order id %d, want 3", order.ID)
+	}
+}
+
+// TestPaperReplay fills the orders against the recorded books, a symbol
+// is at its last book recorded before the replay time
+func TestPaperReplay(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+	var lines []string
+	for _, r := range []RecordedOrderBook{
+		{Time: start, Symbol: "BTCUSDT", Bids: [][]string{{"99", "5"}}, Asks: [][]string{{"100", "5"}}},
+		{Time: start.Add(time.Second), Symbol: "BTCUSDT", Bids: [][]string{{"101", "5"}}, Asks: [][]string{{"102", "5"}}},
+		{Time: start.Add(time.Hour), Symbol: "BTCUSDT", Bids: [][]string{{"1", "5"}}, Asks: [][]string{{"2", "5"}}},
+	} {
+		line, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(line))
+	}
+	books, err := NewReplayBookSource(writeTestFile(t, "books.jsonl", []byte(strings.Join(lines, "\n")+"\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPaperTrader(t, books, "")
+
+	// the replay starts at the first book and the second one is recorded a
+	// second later, the order placed within it is filled at its ask
+	time.Sleep(1100 * time.Millisecond)
+	order, err := p.PlaceOrder(context.Background(), "alice", &PaperOrderRequest{
+		Symbol: "BTCUSDT", Side: "buy", Type: "MARKET", Quantity: decimal.NewFromInt(1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Status != ORDER_STATUS_FILLED || !order.Fills[0].Price.Equal(decimal.NewFromInt(102)) {
+		t.Errorf("the order is %s at %v, want FILLED at 102", order.Status, order.Fills)
+	}
+
+	if _, err := NewReplayBookSource(writeTestFile(t, "torn.jsonl", []byte(lines[0]+"\n{"))); err == nil {
+		t.Error("the recorded books with a malformed line were loaded")
+	}
+}
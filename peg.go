@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	PEG_SOURCE_BOOK = "book"
+
+	// the implied rates only need the top of the book
+	PEG_BOOK_LIMIT    = 100
+	PEG_IMPLIED_LIMIT = 5
+)
+
+var (
+	pegStablecoins     = []string{"USDT", "USDC", "FDUSD", "DAI", "TUSD"}
+	pegReferenceAssets = []string{"BTC", "ETH"}
+)
+
+var ErrNoPegReport = errors.New("the stablecoin pegs are not checked yet")
+
+// PegConfig sets the band around 1.0 the depth is measured within,
+// and the deviation which fires the alert of the rate
+type PegConfig struct {
+	BandBps  float64
+	AlertBps float64
+}
+
+// PegRate is the rate of the base stablecoin in the quote one, taken from
+// the order book of their cross, or implied by the books of the reference
+// asset in both of them; the depth is the notional value of the book
+// levels within the band in the quote stablecoin
+type PegRate struct {
+	Pair         string           `json:"pair"`
+	Source       string           `json:"source"`
+	Symbols      []string         `json:"symbols"`
+	Rate         *decimal.Decimal `json:"rate,omitempty"`
+	DeviationBps *decimal.Decimal `json:"deviationBps,omitempty"`
+	BidDepth     *decimal.Decimal `json:"bidDepth,omitempty"`
+	AskDepth     *decimal.Decimal `json:"askDepth,omitempty"`
+	Alert        bool             `json:"alert"`
+	Error        string           `json:"error,omitempty"`
+}
+
+type PegReport struct {
+	Time     time.Time  `json:"time"`
+	BandBps  float64    `json:"bandBps"`
+	AlertBps float64    `json:"alertBps"`
+	Rates    []*PegRate `json:"rates"`
+}
+
+type PegMonitor interface {
+	Check(ctx context.Context) error
+	GetPegs() (*PegReport, error)
+}
+
+// pegPair is the cross of two stablecoins and the reference symbols
+// of the implied rates by the reference asset
+type pegPair struct {
+	base    string
+	quote   string
+	symbol  string
+	implied map[string][2]string
+}
+
+type pegMonitor struct {
+	client  ApiClient
+	service MarketDataService
+	clock   ExchangeClock
+	config  PegConfig
+	band    decimal.Decimal
+	alert   decimal.Decimal
+
+	mu       sync.RWMutex
+	last     *PegReport
+	alerting map[string]bool
+}
+
+func NewPegMonitor(c *ApiClient, s *MarketDataService, clock ExchangeClock, config PegConfig) PegMonitor {
+	return &pegMonitor{
+		client:   *c,
+		service:  *s,
+		clock:    clock,
+		config:   config,
+		band:     decimal.NewFromFloat(config.BandBps).Div(basisPoints),
+		alert:    decimal.NewFromFloat(config.AlertBps),
+		alerting: make(map[string]bool),
+	}
+}
+
+func (c PegConfig) validate() error {
+	if c.BandBps <= 0 || c.BandBps >= 10000 {
+		return fmt.Errorf("invalid peg band %v bps", c.BandBps)
+	}
+	if c.AlertBps <= 0 {
+		return fmt.Errorf("invalid peg alert threshold %v bps", c.AlertBps)
+	}
+	return nil
+}
+
+func (m *pegMonitor) GetPegs() (*PegReport, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.last == nil {
+		return nil, ErrNoPegReport
+	}
+	return m.last, nil
+}
+
+// Check takes the rates of all the stablecoin crosses listed in the metadata,
+// the alert of a rate fires once when it drifts and once when it recovers
+func (m *pegMonitor) Check(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "PegMonitor.Check")
+	defer span.End()
+
+	pairs := pegPairs(m.service.GetMetadata())
+	if len(pairs) == 0 {
+		err := errors.New("no stablecoin crosses are listed")
+		recordError(span, err)
+		return err
+	}
+
+	var symbols []string
+	limits := make(map[string]int)
+	for _, p := range pairs {
+		symbols = append(symbols, p.symbol)
+		limits[p.symbol] = PEG_BOOK_LIMIT
+		for _, refs := range p.implied {
+			for _, symbol := range refs {
+				if _, found := limits[symbol]; !found {
+					symbols = append(symbols, symbol)
+					limits[symbol] = PEG_IMPLIED_LIMIT
+				}
+			}
+		}
+	}
+
+	books := make([]*ValidatedOrderBook, len(symbols))
+	errs := make([]error, len(symbols))
+	fanOut(len(symbols), FETCH_CONCURRENCY, func(i int) {
+		book, err := m.client.GetOrderBook(ctx, symbols[i], limits[symbols[i]])
+		if err != nil {
+			errs[i] = err
+			return
+		}
+		books[i], errs[i] = validateOrderBook(symbols[i], book)
+		quarantine(ctx, errs[i])
+	})
+	byBook := make(map[string]*ValidatedOrderBook, len(symbols))
+	failed := make(map[string]error)
+	for i, symbol := range symbols {
+		if errs[i] != nil {
+			failed[symbol] = errs[i]
+			continue
+		}
+		byBook[symbol] = books[i]
+	}
+	rate := func(pair string, source string, symbols ...string) *PegRate {
+		r := &PegRate{Pair: pair, Source: source, Symbols: symbols}
+		for _, symbol := range symbols {
+			if err, found := failed[symbol]; found {
+				r.Error = err.Error()
+			}
+		}
+		return r
+	}
+
+	report := &PegReport{Time: m.clock.Now(), BandBps: m.config.BandBps, AlertBps: m.config.AlertBps}
+	for _, p := range pairs {
+		name := p.base + "/" + p.quote
+
+		r := rate(name, PEG_SOURCE_BOOK, p.symbol)
+		if book, found := byBook[p.symbol]; found {
+			mid := bookMid(book)
+			bids, asks := m.bandDepth(book)
+			r.Rate, r.BidDepth, r.AskDepth = &mid, &bids, &asks
+		}
+		report.Rates = append(report.Rates, r)
+
+		for _, ref := range pegReferenceAssets {
+			refs, found := p.implied[ref]
+			if !found {
+				continue
+			}
+			r := rate(name, ref, refs[0], refs[1])
+			inBase, okBase := byBook[refs[0]]
+			inQuote, okQuote := byBook[refs[1]]
+			if okBase && okQuote {
+				// the reference asset costs x base or y quote, so a base is worth y/x quote
+				implied := bookMid(inQuote).Div(bookMid(inBase))
+				r.Rate = &implied
+			}
+			report.Rates = append(report.Rates, r)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range report.Rates {
+		if r.Rate == nil {
+			continue
+		}
+		deviation := r.Rate.Sub(one).Mul(basisPoints).Round(2)
+		r.DeviationBps = &deviation
+		r.Alert = deviation.Abs().GreaterThanOrEqual(m.alert)
+		m.fireAlert(ctx, r)
+	}
+	m.last = report
+
+	return nil
+}
+
+// fireAlert logs the transitions of the alert of the rate
+func (m *pegMonitor) fireAlert(ctx context.Context, r *PegRate) {
+	key := r.Pair + "@" + r.Source
+	if r.Alert == m.alerting[key] {
+		return
+	}
+	m.alerting[key] = r.Alert
+
+	logger := loggerFromContext(ctx).WithFields(log.Fields{
+		"pair":         r.Pair,
+		"source":       r.Source,
+		"rate":         r.Rate,
+		"deviationBps": r.DeviationBps,
+	})
+	if r.Alert {
+		pegAlerts.WithLabelValues(r.Pair, r.Source).Inc()
+		logger.Warnf("Stablecoin %s drifted from the peg by %s bps", r.Pair, r.DeviationBps)
+		return
+	}
+	logger.Infof("Stablecoin %s is back within %v bps of the peg", r.Pair, m.config.AlertBps)
+}
+
+// bandDepth sums the notional value of the levels priced within the band
+// around 1.0, the levels beyond the peg band don't defend it
+func (m *pegMonitor) bandDepth(book *ValidatedOrderBook) (decimal.Decimal, decimal.Decimal) {
+	var bids, asks decimal.Decimal
+	low, high := one.Sub(m.band), one.Add(m.band)
+	for _, l := range book.Bids {
+		if l.Price.LessThan(low) {
+			break
+		}
+		bids = bids.Add(l.Price.Mul(l.Qty))
+	}
+	for _, l := range book.Asks {
+		if l.Price.GreaterThan(high) {
+			break
+		}
+		asks = asks.Add(l.Price.Mul(l.Qty))
+	}
+	return bids, asks
+}
+
+func bookMid(book *ValidatedOrderBook) decimal.Decimal {
+	return book.Bids[0].Price.Add(book.Asks[0].Price).Div(two)
+}
+
+// pegPairs finds the trading crosses of the stablecoins, and the symbols
+// of the reference assets quoted in both stablecoins of the cross
+func pegPairs(metadata map[string]Symbol) []*pegPair {
+	symbols := make(map[string]string)
+	for _, s := range metadata {
+		if s.Status == SYMBOL_STATUS_TRADING {
+			symbols[s.Baseasset+"/"+s.Quoteasset] = s.Symbol
+		}
+	}
+
+	var pairs []*pegPair
+	for _, base := range pegStablecoins {
+		for _, quote := range pegStablecoins {
+			symbol, found := symbols[base+"/"+quote]
+			if !found {
+				continue
+			}
+			p := &pegPair{base: base, quote: quote, symbol: symbol, implied: make(map[string][2]string)}
+			for _, ref := range pegReferenceAssets {
+				inBase, okBase := symbols[ref+"/"+base]
+				inQuote, okQuote := symbols[ref+"/"+quote]
+				if okBase && okQuote {
+					p.implied[ref] = [2]string{inBase, inQuote}
+				}
+			}
+			pairs = append(pairs, p)
+		}
+	}
+	return pairs
+}
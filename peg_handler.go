@@ -0,0 +1,15 @@
+package main
+
+import (
+	"net/http"
+)
+
+func (c *controller) pegs(w http.ResponseWriter, req *http.Request) {
+	report, err := c.pegMonitor.GetPegs()
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
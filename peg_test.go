@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shopspring/decimal"
+)
+
+func TestPegPairs(t *testing.T) {
+	metadata := make(map[string]Symbol)
+	for _, s := range []Symbol{
+		testSymbol("USDCUSDT", "USDC", "USDT", SYMBOL_STATUS_TRADING),
+		testSymbol("FDUSDUSDT", "FDUSD", "USDT", "BREAK"),
+		testSymbol("DAIUSDT", "DAI", "USDT", SYMBOL_STATUS_TRADING),
+		testSymbol("BTCUSDT", "BTC", "USDT", SYMBOL_STATUS_TRADING),
+		testSymbol("BTCUSDC", "BTC", "USDC", SYMBOL_STATUS_TRADING),
+		testSymbol("ETHUSDT", "ETH", "USDT", SYMBOL_STATUS_TRADING),
+		testSymbol("BTCFDUSD", "BTC", "FDUSD", SYMBOL_STATUS_TRADING),
+	} {
+		metadata[s.Symbol] = s
+	}
+
+	pairs := pegPairs(metadata)
+	var got []string
+	for _, p := range pairs {
+		line := p.base + "/" + p.quote + "=" + p.symbol
+		for _, ref := range pegReferenceAssets {
+			if refs, found := p.implied[ref]; found {
+				line += " " + ref + ":" + refs[0] + "," + refs[1]
+			}
+		}
+		got = append(got, line)
+	}
+	// the cross not trading is skipped and ETH is not quoted in USDC
+	if want := "USDC/USDT=USDCUSDT BTC:BTCUSDC,BTCUSDT;DAI/USDT=DAIUSDT"; strings.Join(got, ";") != want {
+		t.Errorf("got %s, want %s", strings.Join(got, ";"), want)
+	}
+}
+
+func TestPegBandDepth(t *testing.T) {
+	m := NewPegMonitor(new(ApiClient), new(MarketDataService), &fixedClock{}, PegConfig{BandBps: 50, AlertBps: 50}).(*pegMonitor)
+	book, err := validateOrderBook("USDCUSDT", &OrderBook{
+		Bids: [][]string{{"1.001", "100"}, {"0.996", "200"}, {"0.99", "300"}},
+		Asks: [][]string{{"1.002", "100"}, {"1.005", "50"}, {"1.01", "1000"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bids, asks := m.bandDepth(book)
+	if !bids.Equal(decimal.RequireFromString("299.3")) || !asks.Equal(decimal.RequireFromString("150.45")) {
+		t.Errorf("got %s bids and %s asks within the band, want 299.3 and 150.45", bids, asks)
+	}
+}
+
+// TestPegCheck takes the cross rate from its book and the rate implied by
+// the BTC books, the alerts fire once when the rates drift and once when
+// they recover
+func TestPegCheck(t *testing.T) {
+	var mu sync.Mutex
+	books := make(map[string]*OrderBook)
+	setBook := func(symbol, bid, ask string) {
+		mu.Lock()
+		defer mu.Unlock()
+		books[symbol] = &OrderBook{Bids: [][]string{{bid, "1000"}}, Asks: [][]string{{ask, "1000"}}}
+	}
+	exchange := fakeExchangeHandler([]Symbol{
+		testSymbol("USDCUSDT", "USDC", "USDT", SYMBOL_STATUS_TRADING),
+		testSymbol("BTCUSDT", "BTC", "USDT", SYMBOL_STATUS_TRADING),
+		testSymbol("BTCUSDC", "BTC", "USDC", SYMBOL_STATUS_TRADING),
+	}, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v3/depth" {
+			exchange(w, req)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(books[req.URL.Query().Get("symbol")])
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	var client ApiClient = c
+	clock := &fixedClock{now: time.Unix(1767225600, 0)}
+	service := NewMarketDataService(&client, clock)
+	monitor := NewPegMonitor(&client, &service, clock, PegConfig{BandBps: 50, AlertBps: 50})
+	ctx := context.Background()
+	// the alerts counter is shared by the tests, so it's compared from its start
+	fired := func(source string) float64 {
+		return testutil.ToFloat64(pegAlerts.WithLabelValues("USDC/USDT", source))
+	}
+	bookStart, btcStart := fired(PEG_SOURCE_BOOK), fired("BTC")
+
+	for _, step := range []struct {
+		name      string
+		cross     [2]string
+		btcUsdt   [2]string
+		book      string
+		implied   string
+		alert     bool
+		bookFired float64
+		btcFired  float64
+	}{
+		{"at the peg", [2]string{"0.9999", "1.0001"}, [2]string{"49999", "50001"}, "0", "0", false, 0, 0},
+		{"drift", [2]string{"0.9899", "0.9901"}, [2]string{"49499", "49501"}, "-100", "-100", true, 1, 1},
+		{"still drifted", [2]string{"0.9899", "0.9901"}, [2]string{"49499", "49501"}, "-100", "-100", true, 1, 1},
+		{"recovered", [2]string{"0.9999", "1.0001"}, [2]string{"49999", "50001"}, "0", "0", false, 1, 1},
+	} {
+		setBook("USDCUSDT", step.cross[0], step.cross[1])
+		setBook("BTCUSDT", step.btcUsdt[0], step.btcUsdt[1])
+		setBook("BTCUSDC", "49999", "50001")
+		// the books are fetched again on every check
+		c.books.snapshots.Flush()
+
+		if err := monitor.Check(ctx); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		report, err := monitor.GetPegs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Rates) != 2 {
+			t.Fatalf("%s: got %d rates, want the book and the BTC implied one", step.name, len(report.Rates))
+		}
+		for i, want := range []struct {
+			source    string
+			deviation string
+		}{
+			{PEG_SOURCE_BOOK, step.book},
+			{"BTC", step.implied},
+		} {
+			r := report.Rates[i]
+			if r.Source != want.source || r.DeviationBps == nil || !r.DeviationBps.Equal(decimal.RequireFromString(want.deviation)) {
+				t.Errorf("%s: rate %d is %s off by %v bps, want %s off by %s", step.name, i, r.Source, r.DeviationBps, want.source, want.deviation)
+			}
+			if r.Alert != step.alert {
+				t.Errorf("%s: the %s alert is %v, want %v", step.name, r.Source, r.Alert, step.alert)
+			}
+		}
+		if book, btc := fired(PEG_SOURCE_BOOK)-bookStart, fired("BTC")-btcStart; book != step.bookFired || btc != step.btcFired {
+			t.Errorf("%s: fired %v book and %v BTC alerts, want %v and %v", step.name, book, btc, step.bookFired, step.btcFired)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	PORTFOLIO_QUOTE_USDT = "USDT"
+	PORTFOLIO_QUOTE_BTC  = "BTC"
+)
+
+var ErrNoPortfolio = errors.New("the portfolio is not valued yet")
+
+type AssetValue struct {
+	Asset  string           `json:"asset"`
+	Free   decimal.Decimal  `json:"free"`
+	Locked decimal.Decimal  `json:"locked"`
+	Total  decimal.Decimal  `json:"total"`
+	Price  *decimal.Decimal `json:"price,omitempty"`
+	Value  *decimal.Decimal `json:"value,omitempty"`
+	Path   []string         `json:"path,omitempty"`
+	Error  string           `json:"error,omitempty"`
+}
+
+// Portfolio is the valuation of the account balances in the quote asset,
+// the total only includes the assets which were priced
+type Portfolio struct {
+	Quote  string          `json:"quote"`
+	Time   time.Time       `json:"time"`
+	Total  decimal.Decimal `json:"total"`
+	Assets []*AssetValue   `json:"assets"`
+}
+
+type PortfolioService interface {
+	Refresh(ctx context.Context) error
+	GetPortfolio() (*Portfolio, error)
+}
+
+type portfolio struct {
+	client      ApiClient
+	conversions ConversionService
+	clock       ExchangeClock
+	quote       string
+
+	mu   sync.RWMutex
+	last *Portfolio
+}
+
+func NewPortfolioService(c *ApiClient, conversions ConversionService, clock ExchangeClock, quote string) PortfolioService {
+	return &portfolio{
+		client:      *c,
+		conversions: conversions,
+		clock:       clock,
+		quote:       quote,
+	}
+}
+
+func validatePortfolioQuote(quote string) error {
+	switch quote {
+	case PORTFOLIO_QUOTE_USDT, PORTFOLIO_QUOTE_BTC:
+		return nil
+	}
+	return fmt.Errorf("invalid portfolio quote %q, expected USDT or BTC", quote)
+}
+
+func (p *portfolio) GetPortfolio() (*Portfolio, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.last == nil {
+		return nil, ErrNoPortfolio
+	}
+	return p.last, nil
+}
+
+// Refresh values the balances along the most liquid conversion paths,
+// the previous valuation is kept when the account can't be read
+func (p *portfolio) Refresh(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "PortfolioService.Refresh",
+		trace.WithAttributes(attribute.String("quote_asset", p.quote)))
+	defer span.End()
+
+	account, err := p.client.GetAccount(ctx)
+	if err != nil {
+		recordError(span, err)
+		return err
+	}
+	conversions, err := p.conversions.GetConversions(ctx, p.quote)
+	if err != nil {
+		recordError(span, err)
+		return err
+	}
+
+	assets := make([]*AssetValue, 0, len(account.Balances))
+	total := decimal.Zero
+	for i := range account.Balances {
+		asset, err := validateBalance(&account.Balances[i])
+		if err != nil {
+			quarantine(ctx, err)
+			continue
+		}
+		if asset.Total.IsZero() {
+			continue
+		}
+		assets = append(assets, asset)
+
+		rate, err := conversions.Rate(asset.Asset)
+		if err != nil {
+			asset.Error = err.Error()
+			continue
+		}
+		value := asset.Total.Mul(rate.Rate)
+		asset.Price = &rate.Rate
+		asset.Value = &value
+		asset.Path = rate.Path
+		total = total.Add(value)
+	}
+
+	sort.SliceStable(assets, func(i, j int) bool {
+		return assetValue(assets[i]).GreaterThan(assetValue(assets[j]))
+	})
+
+	p.mu.Lock()
+	p.last = &Portfolio{Quote: p.quote, Time: p.clock.Now(), Total: total, Assets: assets}
+	p.mu.Unlock()
+
+	loggerFromContext(ctx).WithField("quoteAsset", p.quote).Debugf(
+		"Valued %d assets of the portfolio at %s", len(assets), total)
+	return nil
+}
+
+func assetValue(a *AssetValue) decimal.Decimal {
+	if a.Value == nil {
+		return decimal.Zero
+	}
+	return *a.Value
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+)
+
+// portfolio returns the last valuation of the account balances,
+// it's only refreshed when the api credentials are configured
+func (c *controller) portfolio(w http.ResponseWriter, req *http.Request) {
+	if c.portfolios == nil {
+		writeJSONError(w, http.StatusNotFound, ErrNoCredentials)
+		return
+	}
+
+	p, err := c.portfolios.GetPortfolio()
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, p)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	PROXY_PREFIX  = "/api/v3/"
+	PROXY_TIMEOUT = time.Duration(10) * time.Second
+
+	PROXY_HIT       = "hit"
+	PROXY_MISS      = "miss"
+	PROXY_COALESCED = "coalesced"
+	PROXY_REJECTED  = "rejected"
+	PROXY_ERROR     = "error"
+)
+
+var ErrUnsupportedEndpoint = errors.New("unsupported endpoint")
+
+// WeightExhaustedError is returned when forwarding the request would exceed
+// the weight budget of the current minute, its message is the one of the API
+type WeightExhaustedError struct {
+	Limit      int
+	RetryAfter time.Duration
+}
+
+func (e *WeightExhaustedError) Error() string {
+	return fmt.Sprintf("Too much request weight used; current limit is %d request weight per 1 MINUTE. "+
+		"Please use WebSocket Streams for live updates to avoid polling the API.", e.Limit)
+}
+
+// ProxyResponse is the body of the public endpoint, the used weight is the
+// one of the current minute including the requests still in flight
+type ProxyResponse struct {
+	Body       []byte
+	Result     string
+	UsedWeight int
+}
+
+type ApiProxy interface {
+	Get(ctx context.Context, path string, params url.Values) (*ProxyResponse, error)
+}
+
+// proxyEndpoint is a public endpoint the proxy forwards, the responses are
+// cached for the ttl (not at all when it's zero) and the weight is the one
+// the API charges for the params
+type proxyEndpoint struct {
+	ttl    time.Duration
+	weight func(params url.Values) int
+}
+
+// the ttls follow the ones of the client caches
+var proxyEndpoints = map[string]*proxyEndpoint{
+	"/api/v3/ping":              {ttl: time.Second, weight: fixedWeight(1)},
+	"/api/v3/time":              {ttl: 0, weight: fixedWeight(1)},
+	"/api/v3/exchangeInfo":      {ttl: time.Duration(10) * time.Minute, weight: fixedWeight(20)},
+	"/api/v3/depth":             {ttl: ORDER_BOOK_MAX_AGE, weight: depthWeight},
+	"/api/v3/trades":            {ttl: time.Second, weight: fixedWeight(25)},
+	"/api/v3/aggTrades":         {ttl: time.Second, weight: fixedWeight(4)},
+	"/api/v3/klines":            {ttl: time.Duration(10) * time.Second, weight: fixedWeight(2)},
+	"/api/v3/avgPrice":          {ttl: time.Second, weight: fixedWeight(2)},
+	"/api/v3/ticker/24hr":       {ttl: time.Second, weight: ticker24hrWeight},
+	"/api/v3/ticker/price":      {ttl: time.Second, weight: tickerWeight},
+	"/api/v3/ticker/bookTicker": {ttl: time.Second, weight: tickerWeight},
+}
+
+type proxyCall struct {
+	done chan struct{}
+	body []byte
+	err  error
+}
+
+// proxy answers the identical requests from the cache or from a single
+// in-flight call, the calls to the API are forwarded by the shared client
+// so the weight used by the app and the proxy is tracked together
+type proxy struct {
+	client ApiClient
+	budget int
+	cache  *cache.Cache
+
+	mu       sync.Mutex
+	inflight map[string]*proxyCall
+	pending  int
+	blocked  time.Time
+}
+
+// NewApiProxy keeps the weight used per minute under the budget, the limit
+// of the exchange info when it's zero or above it
+func NewApiProxy(c *ApiClient, budget int) ApiProxy {
+	return &proxy{
+		client:   *c,
+		budget:   budget,
+		cache:    cache.New(cache.NoExpiration, time.Duration(1)*time.Minute),
+		inflight: make(map[string]*proxyCall),
+	}
+}
+
+func (p *proxy) Get(ctx context.Context, path string, params url.Values) (*ProxyResponse, error) {
+	endpoint, found := proxyEndpoints[path]
+	if !found || params.Get("signature") != "" {
+		proxyRequests.WithLabelValues("unsupported", PROXY_REJECTED).Inc()
+		return nil, fmt.Errorf("%w %s", ErrUnsupportedEndpoint, path)
+	}
+	key := path + "?" + params.Encode()
+
+	p.mu.Lock()
+	if x, found := p.cache.Get(key); found {
+		used := p.usedWeight(time.Now())
+		p.mu.Unlock()
+		proxyRequests.WithLabelValues(path, PROXY_HIT).Inc()
+		return &ProxyResponse{Body: x.([]byte), Result: PROXY_HIT, UsedWeight: used}, nil
+	}
+
+	if call, found := p.inflight[key]; found {
+		p.mu.Unlock()
+		return p.wait(ctx, path, call, PROXY_COALESCED)
+	}
+
+	weight := endpoint.weight(params)
+	if err := p.reserve(weight, time.Now()); err != nil {
+		p.mu.Unlock()
+		proxyRequests.WithLabelValues(path, PROXY_REJECTED).Inc()
+		return nil, err
+	}
+	call := &proxyCall{done: make(chan struct{})}
+	p.inflight[key] = call
+	p.mu.Unlock()
+
+	// the call is shared, so it must not be cancelled together
+	// with the request which happened to start it
+	go p.run(detach(ctx), path, params, key, endpoint, weight, call)
+
+	return p.wait(ctx, path, call, PROXY_MISS)
+}
+
+func (p *proxy) wait(ctx context.Context, path string, call *proxyCall, result string) (*ProxyResponse, error) {
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if call.err != nil {
+		proxyRequests.WithLabelValues(path, PROXY_ERROR).Inc()
+		return nil, call.err
+	}
+	proxyRequests.WithLabelValues(path, result).Inc()
+
+	p.mu.Lock()
+	used := p.usedWeight(time.Now())
+	p.mu.Unlock()
+	return &ProxyResponse{Body: call.body, Result: result, UsedWeight: used}, nil
+}
+
+func (p *proxy) run(
+	ctx context.Context, path string, params url.Values, key string, endpoint *proxyEndpoint, weight int, call *proxyCall,
+) {
+	ctx, cancel := context.WithTimeout(ctx, PROXY_TIMEOUT)
+	defer cancel()
+
+	call.body, call.err = p.client.GetPublic(ctx, path, params)
+
+	p.mu.Lock()
+	delete(p.inflight, key)
+	p.pending -= weight
+	if call.err == nil && endpoint.ttl > 0 {
+		p.cache.Set(key, call.body, endpoint.ttl)
+	}
+	// the API refused the ip, nothing is forwarded for the time it asked
+	// to back off, or until the next minute when it didn't say
+	var apierr *ApiError
+	if errors.As(call.err, &apierr) &&
+		(apierr.Status == http.StatusTooManyRequests || apierr.Status == http.StatusTeapot) {
+		now := time.Now()
+		blocked := now.Truncate(time.Minute).Add(time.Minute)
+		if apierr.RetryAfter > 0 {
+			blocked = now.Add(apierr.RetryAfter)
+		}
+		if blocked.After(p.blocked) {
+			p.blocked = blocked
+		}
+	}
+	p.mu.Unlock()
+
+	close(call.done)
+}
+
+// reserve must be called with the lock held, the weight of the in-flight
+// calls is pending until their responses report the used weight
+func (p *proxy) reserve(weight int, now time.Time) error {
+	budget := p.weightBudget()
+	if now.Before(p.blocked) {
+		return &WeightExhaustedError{Limit: budget, RetryAfter: p.blocked.Sub(now)}
+	}
+	if budget > 0 && p.usedWeight(now)+weight > budget {
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		return &WeightExhaustedError{Limit: budget, RetryAfter: next.Sub(now)}
+	}
+	p.pending += weight
+	return nil
+}
+
+// usedWeight must be called with the lock held, the weight reported
+// in an earlier minute was already reset by the API
+func (p *proxy) usedWeight(now time.Time) int {
+	used, _, at := p.client.UsedWeight()
+	if !at.Truncate(time.Minute).Equal(now.Truncate(time.Minute)) {
+		used = 0
+	}
+	return used + p.pending
+}
+
+func (p *proxy) weightBudget() int {
+	_, limit, _ := p.client.UsedWeight()
+	if p.budget <= 0 || (limit > 0 && p.budget > limit) {
+		return limit
+	}
+	return p.budget
+}
+
+func fixedWeight(weight int) func(url.Values) int {
+	return func(url.Values) int { return weight }
+}
+
+func depthWeight(params url.Values) int {
+	limit, err := strconv.Atoi(params.Get("limit"))
+	if err != nil {
+		limit = 100
+	}
+	switch {
+	case limit <= 100:
+		return 5
+	case limit <= 500:
+		return 25
+	case limit <= 1000:
+		return 50
+	}
+	return 250
+}
+
+// tickerWeight is the weight of the price and the book tickers,
+// a single symbol is cheaper than several or all of them
+func tickerWeight(params url.Values) int {
+	if params.Get("symbol") != "" {
+		return 2
+	}
+	return 4
+}
+
+func ticker24hrWeight(params url.Values) int {
+	if params.Get("symbol") != "" {
+		return 2
+	}
+	symbols := params.Get("symbols")
+	if symbols == "" {
+		return 80
+	}
+	switch n := strings.Count(symbols, ",") + 1; {
+	case n <= 20:
+		return 2
+	case n <= 100:
+		return 40
+	}
+	return 80
+}
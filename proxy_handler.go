@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// the error codes of the API the proxy answers with
+const (
+	API_CODE_DISCONNECTED          = -1001
+	API_CODE_TOO_MANY_REQUESTS     = -1003
+	API_CODE_UNSUPPORTED_OPERATION = -1020
+)
+
+// apiProxy serves the public endpoints of the API, the errors are
+// returned in the error body of the API so its clients can parse them
+func (c *controller) apiProxy(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed,
+			&ApiError{Code: API_CODE_UNSUPPORTED_OPERATION, Message: "This operation is not supported."})
+		return
+	}
+
+	res, err := c.proxy.Get(req.Context(), req.URL.Path, req.URL.Query())
+	if err != nil {
+		writeProxyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("X-Cache", strings.ToUpper(res.Result))
+	w.Header().Set("X-MBX-USED-WEIGHT-1M", strconv.Itoa(res.UsedWeight))
+	w.WriteHeader(http.StatusOK)
+	w.Write(res.Body)
+}
+
+func writeProxyError(w http.ResponseWriter, err error) {
+	var exhausted *WeightExhaustedError
+	var apierr *ApiError
+	switch {
+	case errors.Is(err, ErrUnsupportedEndpoint):
+		writeJSON(w, http.StatusNotFound,
+			&ApiError{Code: API_CODE_UNSUPPORTED_OPERATION, Message: "This operation is not supported."})
+	case errors.As(err, &exhausted):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(exhausted.RetryAfter.Seconds()))))
+		writeJSON(w, http.StatusTooManyRequests, &ApiError{Code: API_CODE_TOO_MANY_REQUESTS, Message: exhausted.Error()})
+	case errors.As(err, &apierr) && apierr.Status != 0:
+		if apierr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(apierr.RetryAfter.Seconds()))))
+		}
+		writeJSON(w, apierr.Status, apierr)
+	default:
+		writeJSON(w, http.StatusBadGateway, &ApiError{Code: API_CODE_DISCONNECTED,
+			Message: "Internal error; unable to process your request. Please try again."})
+	}
+}
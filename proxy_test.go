@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestProxyRetryAfter bans the proxy for the time the API asked,
+// which is longer than the rest of the current minute
+func TestProxyRetryAfter(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte(`{"code":-1003,"msg":"Way too many requests; IP banned until 1767225720000."}`))
+	}))
+	defer srv.Close()
+
+	var client ApiClient = newTestClient(srv.URL)
+	proxy := NewApiProxy(&client, 0)
+	ctx := context.Background()
+
+	_, err := proxy.Get(ctx, "/api/v3/ping", url.Values{})
+	var apierr *ApiError
+	if !errors.As(err, &apierr) {
+		t.Fatalf("got %v, want the api error", err)
+	}
+	if apierr.Status != http.StatusTeapot || apierr.RetryAfter != 2*time.Minute {
+		t.Errorf("got status %d retry after %s, want 418 and 2m", apierr.Status, apierr.RetryAfter)
+	}
+	rec := httptest.NewRecorder()
+	writeProxyError(rec, err)
+	if rec.Code != http.StatusTeapot || rec.Header().Get("Retry-After") != "120" {
+		t.Errorf("got status %d retry after %q, want 418 and 120", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	_, err = proxy.Get(ctx, "/api/v3/time", url.Values{})
+	var exhausted *WeightExhaustedError
+	if !errors.As(err, &exhausted) {
+		t.Fatalf("got %v, want the weight exhausted error", err)
+	}
+	if exhausted.RetryAfter <= time.Minute || exhausted.RetryAfter > 2*time.Minute {
+		t.Errorf("retry after %s, want above 1m up to 2m", exhausted.RetryAfter)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("the api was called %d times while banned", calls)
+	}
+}
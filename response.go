@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError passes the Retry-After delay of the rate limited
+// upstream requests on to the unavailable responses
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	var apierr *ApiError
+	if status == http.StatusServiceUnavailable && errors.As(err, &apierr) && apierr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(apierr.RetryAfter.Seconds()))))
+	}
+	writeJSON(w, status, &errorResponse{Error: err.Error()})
+}
+
+func parseSymbols(s string) []string {
+	var symbols []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.ToUpper(strings.TrimSpace(v)); v != "" {
+			symbols = append(symbols, v)
+		}
+	}
+	return symbols
+}
+
+// parseTime accepts RFC3339 timestamps as well as unix milliseconds
+func parseTime(s string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return fromMillis(ms), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
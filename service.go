@@ -1,18 +1,34 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"sort"
+	"fmt"
+	"sync"
+	"time"
 
+	"github.com/patrickmn/go-cache"
 	"github.com/shopspring/decimal"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	NO_VALUE  string = ""
-	TOP_LIMIT int    = 5
+	NO_VALUE       string = ""
+	TOP_LIMIT      int    = 5
+	NOTIONAL_DEPTH int    = 200
+
+	// the symbols param of the book ticker is limited by the url length
+	BOOK_TICKER_BATCH_LIMIT int = 100
+
+	// the client fetches the exchange info again once its cache expires
+	METADATA_REFRESH_INTERVAL = time.Minute
 )
 
+// order book limits accepted by the depth endpoint
+var orderBookLimits = []int{5, 10, 20, 50, 100, 500, 1000, 5000}
+
 type MarketDataQuery struct {
 	VolumeQuoteAsset     string
 	TradeCountQuoteAsset string
@@ -21,245 +37,474 @@ type MarketDataQuery struct {
 type MarketData struct {
 	TopVolumes          []*SymbolData
 	TopNumberOfTrades   []*SymbolData
-	TotalNotionalValues []*TotalNotionalValue
-	Spreads             []*Spread
+	TotalNotionalValues []*NotionalValueResult
+	Spreads             []*SpreadResult
+	Failures            []*SymbolFailure
 }
 
 type SymbolData struct {
-	Symbol     string
-	Volume     decimal.Decimal
-	TradeCount int
+	Symbol      string
+	Volume      decimal.Decimal
+	QuoteVolume decimal.Decimal
+	TradeCount  int
 }
 
+// TotalNotionalValue and Spread carry the exchange time of the sample
 type TotalNotionalValue struct {
 	Symbol    string
 	AsksTotal decimal.Decimal
 	BidsTotal decimal.Decimal
+	Time      time.Time
 }
 
 type Spread struct {
 	Symbol     string
 	HighestBid decimal.Decimal
 	LowestAsk  decimal.Decimal
+	BidQty     decimal.Decimal
+	AskQty     decimal.Decimal
 	Value      decimal.Decimal
+	Time       time.Time
+}
+
+type NotionalValueResult struct {
+	Symbol string
+	Value  *TotalNotionalValue
+	Err    error
+}
+
+type SpreadResult struct {
+	Symbol string
+	Spread *Spread
+	Err    error
+}
+
+var (
+	one         = decimal.NewFromInt(1)
+	two         = decimal.NewFromInt(2)
+	basisPoints = decimal.NewFromInt(10000)
+)
+
+func (s *Spread) MidPrice() decimal.Decimal {
+	return s.HighestBid.Add(s.LowestAsk).Div(two)
+}
+
+func (s *Spread) RelativeBps() decimal.Decimal {
+	mid := s.MidPrice()
+	if mid.IsZero() {
+		return decimal.Zero
+	}
+	return s.Value.Div(mid).Mul(basisPoints)
+}
+
+func (v *TotalNotionalValue) Imbalance() decimal.Decimal {
+	total := v.BidsTotal.Add(v.AsksTotal)
+	if total.IsZero() {
+		return decimal.Zero
+	}
+	return v.BidsTotal.Sub(v.AsksTotal).Div(total)
 }
 
 type MarketDataService interface {
-	GetMarketData(query *MarketDataQuery) (*MarketData, error)
-	GetTopSymbols(quoteAsset string, limit int, sort func(symbols []*SymbolData)) ([]*SymbolData, error)
-	GetTotalNotionalValues(symbols []string) ([]*TotalNotionalValue, error)
-	GetSpreads(symbols []string) ([]*Spread, error)
+	GetMarketData(ctx context.Context, query *MarketDataQuery) (*MarketData, error)
+	GetTopSymbols(ctx context.Context, quoteAsset string, limit int, order SymbolOrder) ([]*SymbolData, error)
+	GetSymbolsData(ctx context.Context, symbols []string) ([]*SymbolData, error)
+	GetTotalNotionalValues(ctx context.Context, symbols []string, depth int) []*NotionalValueResult
+	GetSpreads(ctx context.Context, symbols []string) []*SpreadResult
+	GetMetadata() map[string]Symbol
+	RefreshMetadata(ctx context.Context) error
 }
 
 type service struct {
-	client   ApiClient
+	client     ApiClient
+	clock      ExchangeClock
+	quoteCache *cache.Cache
+
+	mu       sync.RWMutex
+	info     *ExchangeInfoResponse
 	metadata map[string]Symbol
 }
 
-func NewMarketDataService(c *ApiClient) MarketDataService {
-	info, err := (*c).GetExchangeInfo()
-	if err != nil {
+func NewMarketDataService(c *ApiClient, clock ExchangeClock) MarketDataService {
+	s := &service{
+		client:     *c,
+		clock:      clock,
+		quoteCache: cache.New(time.Duration(1)*time.Second, time.Duration(1)*time.Second),
+	}
+	if err := s.RefreshMetadata(context.Background()); err != nil {
 		log.Fatal("Error occurred while getting exchange info")
 	}
+	return s
+}
+
+// GetMetadata returns the exchange info symbols by name, which are shared
+// by the callers and must not be modified; a refresh replaces the whole map
+func (s *service) GetMetadata() map[string]Symbol {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.metadata
+}
+
+// RefreshMetadata takes the exchange info cached by the client, the map is
+// only rebuilt when the client fetched a new one
+func (s *service) RefreshMetadata(ctx context.Context) error {
+	info, err := s.client.GetExchangeInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	unchanged := s.info == info
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
 
 	metadata := make(map[string]Symbol, len(info.Symbols))
 	for i := range info.Symbols {
-		s := info.Symbols[i]
-		metadata[s.Symbol] = s
+		symbol := info.Symbols[i]
+		metadata[symbol.Symbol] = symbol
 	}
 
-	return &service{
-		client:   *c,
-		metadata: metadata,
-	}
+	s.mu.Lock()
+	s.info, s.metadata = info, metadata
+	s.mu.Unlock()
+	return nil
 }
 
-func (s *service) GetMarketData(q *MarketDataQuery) (*MarketData, error) {
+func (s *service) GetMarketData(ctx context.Context, q *MarketDataQuery) (*MarketData, error) {
+	ctx, span := tracer.Start(ctx, "MarketDataService.GetMarketData")
+	defer span.End()
+
+	// both tops are taken from a single decode of all the tickers, when it
+	// fails the tops fetch the tickers again and report their own errors
+	s.getQuoteTickers(ctx, q.VolumeQuoteAsset, q.TradeCountQuoteAsset)
+
+	// the failed tops are reported by their quote asset
+	var failures []*SymbolFailure
 
 	// get top volumes
-	byVolumeSort := func(symbols []*SymbolData) {
-		sort.Sort(ByVolume{symbols: symbols})
+	topVolumes, err := s.GetTopSymbols(ctx,
+		q.VolumeQuoteAsset, TOP_LIMIT, ByVolume)
+	if err != nil {
+		failures = append(failures, newSymbolFailure(q.VolumeQuoteAsset, OPERATION_TOP_VOLUME, err))
 	}
-	topVolumes, _ := s.GetTopSymbols(
-		q.VolumeQuoteAsset, TOP_LIMIT, byVolumeSort)
 
 	// get top number of trades
-	byTradeCountSort := func(symbols []*SymbolData) {
-		sort.Sort(ByTradeCount{symbols: symbols})
+	topNumberOfTrades, err := s.GetTopSymbols(ctx,
+		q.TradeCountQuoteAsset, TOP_LIMIT, ByTradeCount)
+	if err != nil {
+		failures = append(failures, newSymbolFailure(q.TradeCountQuoteAsset, OPERATION_TOP_TRADES, err))
 	}
-	topNumberOfTrades, _ := s.GetTopSymbols(
-		q.TradeCountQuoteAsset, TOP_LIMIT, byTradeCountSort)
 
 	// get total notional values
 	var tnvTargets []string
 	for _, v := range topVolumes {
 		tnvTargets = append(tnvTargets, v.Symbol)
 	}
-	totalNotionalValues, _ := s.GetTotalNotionalValues(tnvTargets)
+	totalNotionalValues := s.GetTotalNotionalValues(ctx, tnvTargets, NOTIONAL_DEPTH)
 
 	// get spreds
 	var spreadTargets []string
 	for _, v := range topNumberOfTrades {
 		spreadTargets = append(spreadTargets, v.Symbol)
 	}
-	spreads, _ := s.GetSpreads(spreadTargets)
+	spreads := s.GetSpreads(ctx, spreadTargets)
+
+	_, notionalFailures := splitNotionalResults(totalNotionalValues)
+	_, spreadFailures := splitSpreadResults(spreads)
 
 	return &MarketData{
 		TopVolumes:          topVolumes,
 		TopNumberOfTrades:   topNumberOfTrades,
 		TotalNotionalValues: totalNotionalValues,
 		Spreads:             spreads,
+		Failures:            append(append(failures, notionalFailures...), spreadFailures...),
 	}, nil
 }
 
-func (s *service) GetTopSymbols(
-	quoteAsset string, limit int, sort func(symbols []*SymbolData),
+func (s *service) GetTopSymbols(ctx context.Context,
+	quoteAsset string, limit int, order SymbolOrder,
 ) ([]*SymbolData, error) {
-	stats, err := s.client.GetTickerChangeStatistics(NO_VALUE)
+	ctx, span := tracer.Start(ctx, "MarketDataService.GetTopSymbols",
+		trace.WithAttributes(attribute.String("quote_asset", quoteAsset)))
+	defer span.End()
+
+	tickers, err := s.getQuoteTickers(ctx, quoteAsset)
 	if err != nil {
-		log.Error("Error occurred while getting ticker change statistics")
+		recordError(span, err)
+		loggerFromContext(ctx).Error("Error occurred while getting ticker change statistics")
 		return nil, err
 	}
+	symbols := tickers[quoteAsset]
 
-	var symbols []*SymbolData
-	for _, t := range stats {
-		s := s.metadata[t.Symbol]
-		if s.Quoteasset == quoteAsset {
-			vol, _ := decimal.NewFromString(t.Volume)
-			symbols = append(symbols, &SymbolData{
-				Symbol:     t.Symbol,
-				Volume:     vol,
-				TradeCount: t.Tradecount,
-			})
-		}
+	loggerFromContext(ctx).WithField("quoteAsset", quoteAsset).Debugf(
+		"Found %d symbols to sort", len(symbols))
+
+	top := newTopSymbols(limit, order)
+	for _, v := range symbols {
+		top.Add(v)
 	}
 
-	log.WithField("quoteAsset", quoteAsset).Debugf(
-		"Found %d symbols to sort", len(symbols))
+	return top.Sorted(), nil
+}
 
-	sort(symbols)
+// getQuoteTickers returns the 24hr statistics of the symbols by their quote
+// asset, the quote assets which aren't cached are filtered during the decode
+// of all the tickers, so only their rows are parsed
+func (s *service) getQuoteTickers(ctx context.Context, quoteAssets ...string) (map[string][]*SymbolData, error) {
+	tickers := make(map[string][]*SymbolData, len(quoteAssets))
+	missing := make(map[string]bool)
+	for _, quote := range quoteAssets {
+		x, found := s.quoteCache.Get(quote)
+		observeCache("quote_ticker", found)
+		if found {
+			tickers[quote] = x.([]*SymbolData)
+		} else {
+			missing[quote] = true
+		}
+	}
+	if len(missing) == 0 {
+		return tickers, nil
+	}
 
-	if len(symbols) > limit {
-		symbols = symbols[:limit]
+	metadata := s.GetMetadata()
+	rows, err := s.client.GetTickerRows(ctx, func(symbol string) bool {
+		return missing[metadata[symbol].Quoteasset]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fetched := make(map[string][]*SymbolData, len(missing))
+	for _, row := range rows {
+		data, err := validateTicker(row, TICKER_MAX_STALENESS)
+		if err != nil {
+			quarantine(ctx, err)
+			continue
+		}
+		quote := metadata[row.Symbol].Quoteasset
+		fetched[quote] = append(fetched[quote], data)
+	}
+	for quote := range missing {
+		s.quoteCache.SetDefault(quote, fetched[quote])
+		tickers[quote] = fetched[quote]
 	}
 
-	return symbols, nil
+	return tickers, nil
 }
 
-func (s *service) GetTotalNotionalValues(symbols []string) ([]*TotalNotionalValue, error) {
-	var aerr error
-	var tnvs []*TotalNotionalValue
-	c := make(chan *TotalNotionalValue)
+func (s *service) GetSymbolsData(ctx context.Context, symbols []string) ([]*SymbolData, error) {
+	ctx, span := tracer.Start(ctx, "MarketDataService.GetSymbolsData",
+		trace.WithAttributes(attribute.StringSlice("symbols", symbols)))
+	defer span.End()
+
+	var data []*SymbolData
 	for _, symbol := range symbols {
-		s1 := symbol
-		go func() {
-			value, err := s.getTotalNotionalValue(s1)
+		stats, err := s.client.GetTickerChangeStatistics(ctx, symbol)
+		if err != nil {
+			recordError(span, err)
+			loggerFromContext(ctx).WithField("symbol", symbol).Errorf(
+				"Error occurred while getting ticker change statistics for %s", symbol)
+			return nil, err
+		}
+		for _, t := range stats {
+			v, err := validateTicker(t.Row(), TICKER_MAX_STALENESS)
 			if err != nil {
-				aerr = err
+				quarantine(ctx, err)
+				continue
 			}
-			c <- value
-		}()
+			data = append(data, v)
+		}
 	}
 
-	for i := 0; i < len(symbols); i++ {
-		tnvs = append(tnvs, <-c)
-	}
+	return data, nil
+}
 
-	if aerr != nil {
-		log.Error("Erorr occurred while getting total notional values")
-		return nil, aerr
+func (s *service) GetTotalNotionalValues(ctx context.Context, symbols []string, depth int) []*NotionalValueResult {
+	ctx, span := tracer.Start(ctx, "MarketDataService.GetTotalNotionalValues",
+		trace.WithAttributes(attribute.StringSlice("symbols", symbols), attribute.Int("depth", depth)))
+	defer span.End()
+
+	results := make([]*NotionalValueResult, len(symbols))
+	fanOut(len(symbols), FETCH_CONCURRENCY, func(i int) {
+		value, err := s.getTotalNotionalValue(ctx, symbols[i], depth)
+		results[i] = &NotionalValueResult{Symbol: symbols[i], Value: value, Err: err}
+	})
+
+	if failed := countNotionalFailures(results); failed > 0 {
+		span.SetAttributes(attribute.Int("failed", failed))
+		loggerFromContext(ctx).Errorf(
+			"Error occurred while getting total notional values of %d symbols", failed)
 	}
 
-	return tnvs, nil
+	return results
 }
 
-func (s *service) getTotalNotionalValue(symbol string) (*TotalNotionalValue, error) {
-	limit := 500
-	count := 200
+func (s *service) getTotalNotionalValue(ctx context.Context, symbol string, depth int) (*TotalNotionalValue, error) {
+	ctx, span := tracer.Start(ctx, "MarketDataService.getTotalNotionalValue",
+		trace.WithAttributes(attribute.String("symbol", symbol)))
+	defer span.End()
+
+	limit := orderBookLimit(depth)
+	count := depth
 
-	book, err := s.client.GetOrderBook(symbol, limit)
+	book, err := s.client.GetOrderBook(ctx, symbol, limit)
+	now := s.clock.Now()
 	if err != nil {
-		log.WithField("symbol", symbol).Errorf(
+		recordError(span, err)
+		loggerFromContext(ctx).WithField("symbol", symbol).Errorf(
 			"Error occurred while getting order book for %s", symbol)
 		return nil, err
 	}
 
-	var asksTotal, bidsTotal, price, qty decimal.Decimal
-	if len(book.Asks) > count {
-		book.Asks = book.Asks[:count]
+	levels, err := validateOrderBook(symbol, book)
+	if err != nil {
+		recordError(span, err)
+		quarantine(ctx, err)
+		return nil, err
+	}
+
+	var asksTotal, bidsTotal decimal.Decimal
+	if len(levels.Asks) > count {
+		levels.Asks = levels.Asks[:count]
 	}
-	for _, v := range book.Asks {
-		price, _ = decimal.NewFromString(v[0])
-		qty, _ = decimal.NewFromString(v[1])
-		asksTotal = asksTotal.Add(price.Mul(qty))
+	for _, v := range levels.Asks {
+		asksTotal = asksTotal.Add(v.Price.Mul(v.Qty))
 	}
 
-	if len(book.Bids) > count {
-		book.Bids = book.Asks[:count]
+	if len(levels.Bids) > count {
+		levels.Bids = levels.Bids[:count]
 	}
-	for _, v := range book.Bids {
-		price, _ = decimal.NewFromString(v[0])
-		qty, _ = decimal.NewFromString(v[1])
-		bidsTotal = bidsTotal.Add(price.Mul(qty))
+	for _, v := range levels.Bids {
+		bidsTotal = bidsTotal.Add(v.Price.Mul(v.Qty))
 	}
 
 	return &TotalNotionalValue{
 		Symbol:    symbol,
 		AsksTotal: asksTotal,
 		BidsTotal: bidsTotal,
+		Time:      now,
 	}, nil
 }
 
-func (s *service) GetSpreads(symbols []string) ([]*Spread, error) {
-	var aerr error
-	var spreads []*Spread
-	c := make(chan *Spread)
-	for _, symbol := range symbols {
-		s1 := symbol
-		go func() {
-			value, err := s.getSpread(s1)
-			if err != nil {
-				aerr = err
-			}
-			c <- value
-		}()
+// GetSpreads takes the top level of all the books from a single book ticker
+// call, the spreads don't fall back to the order books, so when the call
+// fails the spreads of all the symbols fail with its error
+func (s *service) GetSpreads(ctx context.Context, symbols []string) []*SpreadResult {
+	ctx, span := tracer.Start(ctx, "MarketDataService.GetSpreads",
+		trace.WithAttributes(attribute.StringSlice("symbols", symbols)))
+	defer span.End()
+
+	results := make([]*SpreadResult, len(symbols))
+	tickers, err := s.getBookTickers(ctx, symbols)
+	now := s.clock.Now()
+	if err != nil {
+		recordError(span, err)
+		loggerFromContext(ctx).WithError(err).Error("Error occurred while getting book tickers")
 	}
-
-	for i := 0; i < len(symbols); i++ {
-		spreads = append(spreads, <-c)
+	for i, symbol := range symbols {
+		if err != nil {
+			results[i] = &SpreadResult{Symbol: symbol, Err: err}
+			continue
+		}
+		ticker, found := tickers[symbol]
+		if !found {
+			results[i] = &SpreadResult{Symbol: symbol, Err: fmt.Errorf("no book ticker for %s", symbol)}
+			continue
+		}
+		spread, verr := validateBookTicker(ticker)
+		if verr != nil {
+			quarantine(ctx, verr)
+		} else {
+			spread.Time = now
+		}
+		results[i] = &SpreadResult{Symbol: symbol, Spread: spread, Err: verr}
 	}
-	close(c)
 
-	if aerr != nil {
-		log.Error("Erorr occurred while getting spreads")
-		return nil, aerr
+	if failed := countSpreadFailures(results); failed > 0 {
+		span.SetAttributes(attribute.Int("failed", failed))
+		loggerFromContext(ctx).Errorf(
+			"Error occurred while getting spreads of %d symbols", failed)
 	}
 
-	return spreads, nil
+	return results
 }
 
-func (s *service) getSpread(symbol string) (*Spread, error) {
-	book, err := s.client.GetOrderBook(symbol, 5)
+// getBookTickers fetches the book tickers of the symbols by symbol, the
+// long lists take the all symbols call, which has the same request weight
+func (s *service) getBookTickers(ctx context.Context, symbols []string) (map[string]*BookTicker, error) {
+	tickers := make(map[string]*BookTicker, len(symbols))
+	if len(symbols) == 0 {
+		return tickers, nil
+	}
+
+	query := symbols
+	if len(symbols) > BOOK_TICKER_BATCH_LIMIT {
+		query = nil
+	}
+	list, err := s.client.GetBookTicker(ctx, query)
+
+	// a single unknown symbol fails the whole request,
+	// so the known ones are taken from the all symbols call
+	var apierr *ApiError
+	if err != nil && query != nil && errors.As(err, &apierr) {
+		loggerFromContext(ctx).WithError(err).Warn("Falling back to the book tickers of all symbols")
+		list, err = s.client.GetBookTicker(ctx, nil)
+	}
 	if err != nil {
-		log.WithField("symbol", symbol).Errorf(
-			"Error occurred while getting order book for %s", symbol)
 		return nil, err
 	}
 
-	// not sure if this edge case is possible and how to calc spread
-	if len(book.Bids) == 0 || len(book.Asks) == 0 {
-		return nil, errors.New("empty bids or asks in order book")
+	for _, t := range list {
+		tickers[t.Symbol] = t
 	}
+	return tickers, nil
+}
 
-	var hbid, lask, spread decimal.Decimal
-	hbid, _ = decimal.NewFromString(book.Bids[0][0])
-	lask, _ = decimal.NewFromString(book.Asks[0][0])
-	spread = lask.Add(hbid.Neg())
+func splitNotionalResults(results []*NotionalValueResult) ([]*TotalNotionalValue, []*SymbolFailure) {
+	var values []*TotalNotionalValue
+	var failures []*SymbolFailure
+	for _, r := range results {
+		if r.Err != nil {
+			failures = append(failures, newSymbolFailure(r.Symbol, OPERATION_NOTIONAL, r.Err))
+			continue
+		}
+		values = append(values, r.Value)
+	}
+	return values, failures
+}
 
-	return &Spread{
-		Symbol:     symbol,
-		HighestBid: hbid,
-		LowestAsk:  lask,
-		Value:      spread,
-	}, nil
+func splitSpreadResults(results []*SpreadResult) ([]*Spread, []*SymbolFailure) {
+	var spreads []*Spread
+	var failures []*SymbolFailure
+	for _, r := range results {
+		if r.Err != nil {
+			failures = append(failures, newSymbolFailure(r.Symbol, OPERATION_SPREAD, r.Err))
+			continue
+		}
+		spreads = append(spreads, r.Spread)
+	}
+	return spreads, failures
+}
+
+func countNotionalFailures(results []*NotionalValueResult) int {
+	_, failures := splitNotionalResults(results)
+	return len(failures)
+}
+
+func countSpreadFailures(results []*SpreadResult) int {
+	_, failures := splitSpreadResults(results)
+	return len(failures)
+}
+
+// orderBookLimit returns the smallest order book limit covering the depth
+func orderBookLimit(depth int) int {
+	for _, limit := range orderBookLimits {
+		if limit >= depth {
+			return limit
+		}
+	}
+	return orderBookLimits[len(orderBookLimits)-1]
 }
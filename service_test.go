@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRefreshMetadata rebuilds the metadata once the client fetched
+// the exchange info again
+func TestRefreshMetadata(t *testing.T) {
+	symbols := []Symbol{testSymbol("BTCUSDT", "BTC", "USDT", SYMBOL_STATUS_TRADING)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fakeExchangeHandler(symbols, nil)(w, req)
+	}))
+	defer srv.Close()
+	c := newTestClient(srv.URL)
+	var client ApiClient = c
+	service := NewMarketDataService(&client, &fixedClock{now: time.Unix(1767225600, 0)})
+
+	symbols = []Symbol{
+		testSymbol("BTCUSDT", "BTC", "USDT", "BREAK"),
+		testSymbol("ETHUSDT", "ETH", "USDT", SYMBOL_STATUS_TRADING),
+	}
+	ctx := context.Background()
+
+	// the cached exchange info is still the first one
+	if err := service.RefreshMetadata(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if metadata := service.GetMetadata(); len(metadata) != 1 || metadata["BTCUSDT"].Status != SYMBOL_STATUS_TRADING {
+		t.Errorf("the metadata changed before the exchange info expired: %v", metadata)
+	}
+
+	c.infoCache.Flush()
+	if err := service.RefreshMetadata(ctx); err != nil {
+		t.Fatal(err)
+	}
+	metadata := service.GetMetadata()
+	if len(metadata) != 2 || metadata["BTCUSDT"].Status != "BREAK" {
+		t.Errorf("the metadata was not refreshed: %v", metadata)
+	}
+}
+
+// TestGetTopSymbolsDropsStaleTickers quarantines the rows of the all
+// symbols ticker whose statistics were not updated for too long
+func TestGetTopSymbolsDropsStaleTickers(t *testing.T) {
+	now := time.Now()
+	stats := []*TickerChangeStatics{
+		{Symbol: "BTCUSDT", Volume: "10", Quotevolume: "700000", Closetime: toMillis(now)},
+		{Symbol: "ETHUSDT", Volume: "500", Quotevolume: "1500000", Closetime: toMillis(now.Add(-TICKER_MAX_STALENESS - time.Minute))},
+		{Symbol: "BNBUSDT", Volume: "100", Quotevolume: "60000", Closetime: toMillis(now.Add(-time.Minute))},
+	}
+	exchange := fakeExchangeHandler([]Symbol{
+		testSymbol("BTCUSDT", "BTC", "USDT", SYMBOL_STATUS_TRADING),
+		testSymbol("ETHUSDT", "ETH", "USDT", SYMBOL_STATUS_TRADING),
+		testSymbol("BNBUSDT", "BNB", "USDT", SYMBOL_STATUS_TRADING),
+	}, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/v3/ticker/24hr" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(stats)
+			return
+		}
+		exchange(w, req)
+	}))
+	defer srv.Close()
+
+	var client ApiClient = newTestClient(srv.URL)
+	service := NewMarketDataService(&client, &fixedClock{now: now})
+	top, err := service.GetTopSymbols(context.Background(), "USDT", TOP_LIMIT, ByQuoteVolume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, s := range top {
+		got = append(got, s.Symbol)
+	}
+	if strings.Join(got, ",") != "BTCUSDT,BNBUSDT" {
+		t.Errorf("got %v, want BTCUSDT,BNBUSDT", got)
+	}
+}
+
+// TestGetMarketDataReportsFailedTops reports the tops which failed to be
+// fetched by their quote asset next to the symbol failures
+func TestGetMarketDataReportsFailedTops(t *testing.T) {
+	exchange := fakeExchangeHandler([]Symbol{testSymbol("BTCUSDT", "BTC", "USDT", SYMBOL_STATUS_TRADING)}, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/v3/ticker/24hr" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"code":-1000,"msg":"An unknown error occurred while processing the request."}`))
+			return
+		}
+		exchange(w, req)
+	}))
+	defer srv.Close()
+
+	var client ApiClient = newTestClient(srv.URL)
+	service := NewMarketDataService(&client, &fixedClock{now: time.Now()})
+	data, err := service.GetMarketData(context.Background(), &MarketDataQuery{
+		VolumeQuoteAsset:     "BTC",
+		TradeCountQuoteAsset: "USDT",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, f := range data.Failures {
+		got = append(got, f.Operation+":"+f.Symbol+":"+f.Reason)
+	}
+	if want := "top_volume:BTC:api_-1000,top_trades:USDT:api_-1000"; strings.Join(got, ",") != want {
+		t.Errorf("got failures %v, want %s", got, want)
+	}
+}
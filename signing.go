@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	KEY_TYPE_HMAC    = "hmac"
+	KEY_TYPE_ED25519 = "ed25519"
+
+	ENV_API_KEY    = "BINANCE_API_KEY"
+	ENV_API_SECRET = "BINANCE_API_SECRET"
+
+	API_KEY_HEADER      = "X-MBX-APIKEY"
+	DEFAULT_RECV_WINDOW = time.Duration(5) * time.Second
+)
+
+var ErrNoCredentials = errors.New("the endpoint requires api credentials")
+
+// CredentialsConfig points to the api key and the secret, the files take
+// precedence over the environment variables; the secret is the HMAC secret
+// or the PEM encoded PKCS#8 Ed25519 private key depending on the key type
+type CredentialsConfig struct {
+	KeyType    string
+	KeyFile    string
+	SecretFile string
+	RecvWindow time.Duration
+}
+
+type Credentials struct {
+	ApiKey     string
+	RecvWindow time.Duration
+	sign       func(payload string) string
+}
+
+// LoadCredentials returns nil without an error when neither the key
+// nor the secret is configured, so only the public endpoints are used
+func LoadCredentials(c CredentialsConfig) (*Credentials, error) {
+	key, err := readSecret(c.KeyFile, ENV_API_KEY)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := readSecret(c.SecretFile, ENV_API_SECRET)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" && secret == "" {
+		return nil, nil
+	}
+	if key == "" || secret == "" {
+		return nil, errors.New("both the api key and the secret are required")
+	}
+	if c.RecvWindow < 0 || c.RecvWindow > time.Minute {
+		return nil, fmt.Errorf("invalid recv window %s, the max is 1m", c.RecvWindow)
+	}
+
+	creds := &Credentials{ApiKey: key, RecvWindow: c.RecvWindow}
+	switch c.KeyType {
+	case KEY_TYPE_HMAC:
+		creds.sign = hmacSigner([]byte(secret))
+	case KEY_TYPE_ED25519:
+		creds.sign, err = ed25519Signer([]byte(secret))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported api key type %q, expected hmac or ed25519", c.KeyType)
+	}
+	return creds, nil
+}
+
+func readSecret(path string, env string) (string, error) {
+	if path == "" {
+		return strings.TrimSpace(os.Getenv(env)), nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// hmacSigner signs with HMAC-SHA256 of the secret, hex encoded
+func hmacSigner(secret []byte) func(string) string {
+	return func(payload string) string {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(payload))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+}
+
+// ed25519Signer signs with the Ed25519 private key, base64 encoded
+func ed25519Signer(pemData []byte) (func(string) string, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("ed25519 secret is not a PEM encoded private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ed25519 private key: %w", err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is %T, not ed25519", key)
+	}
+
+	return func(payload string) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(payload)))
+	}, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	TEST_API_KEY     = "vmPUZE6mv9SD5VNHk4HlWFsOr6aKE2zvsw0MuIgwCIPy6utIco14y7Ju91duEh8A"
+	TEST_HMAC_SECRET = "NhqPtmdSJYdKjVHjA7PZj4Mge3R5YNiP1e3UZjInClVN65XAbvqqM6A7H5fATj0j"
+)
+
+// fixedClock is the exchange clock stopped at the time
+type fixedClock struct {
+	now time.Time
+}
+
+func (c *fixedClock) Now() time.Time                                    { return c.now }
+func (c *fixedClock) Offset() (*ClockOffset, bool)                      { return nil, false }
+func (c *fixedClock) Sync(ctx context.Context) error                    { return nil }
+func (c *fixedClock) Start(ctx context.Context, interval time.Duration) {}
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestSignedRequest recomputes the signature of the query the server
+// received with the same keys and checks the params the client adds
+func TestSignedRequest(t *testing.T) {
+	seed := make([]byte, ed25519.SeedSize)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	private := ed25519.NewKeyFromSeed(seed)
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Pem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	tests := []struct {
+		keyType string
+		secret  []byte
+		verify  func(query string, signature string) bool
+	}{
+		{KEY_TYPE_HMAC, []byte(TEST_HMAC_SECRET), func(query string, signature string) bool {
+			mac := hmac.New(sha256.New, []byte(TEST_HMAC_SECRET))
+			mac.Write([]byte(query))
+			return signature == hex.EncodeToString(mac.Sum(nil))
+		}},
+		{KEY_TYPE_ED25519, ed25519Pem, func(query string, signature string) bool {
+			sig, err := base64.StdEncoding.DecodeString(signature)
+			return err == nil && ed25519.Verify(private.Public().(ed25519.PublicKey), []byte(query), sig)
+		}},
+	}
+
+	now := time.Date(2026, 1, 2, 3, 4, 5, 678000000, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.keyType, func(t *testing.T) {
+			var received *http.Request
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				received = req
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"canTrade":true,"accountType":"SPOT","balances":[]}`))
+			}))
+			defer srv.Close()
+
+			creds, err := LoadCredentials(CredentialsConfig{
+				KeyType:    tt.keyType,
+				KeyFile:    writeTestFile(t, "key", []byte(TEST_API_KEY+"\n")),
+				SecretFile: writeTestFile(t, "secret", tt.secret),
+				RecvWindow: time.Duration(3) * time.Second,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := newTestClient(srv.URL)
+			c.SetCredentials(creds, &fixedClock{now: now})
+
+			account, err := c.GetAccount(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if account.AccountType != "SPOT" {
+				t.Errorf("account type %q, want SPOT", account.AccountType)
+			}
+
+			if got := received.Header.Get(API_KEY_HEADER); got != TEST_API_KEY {
+				t.Errorf("%s header %q, want %q", API_KEY_HEADER, got, TEST_API_KEY)
+			}
+			raw := received.URL.RawQuery
+			i := strings.LastIndex(raw, "&signature=")
+			if i < 0 {
+				t.Fatalf("the signature is not the last param of %q", raw)
+			}
+			query := raw[:i]
+			signature, err := url.QueryUnescape(raw[i+len("&signature="):])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.verify(query, signature) {
+				t.Errorf("signature %q does not match the query %q", signature, query)
+			}
+
+			params, err := url.ParseQuery(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, want := range map[string]string{
+				"timestamp":        "1767323045678",
+				"recvWindow":       "3000",
+				"omitZeroBalances": "true",
+			} {
+				if got := params.Get(key); got != want {
+					t.Errorf("%s %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSignedRequestWithoutCredentials(t *testing.T) {
+	c := newTestClient("http://localhost:0")
+	if _, err := c.GetAccount(context.Background()); err != ErrNoCredentials {
+		t.Errorf("got %v, want %v", err, ErrNoCredentials)
+	}
+}
+
+// the example of the signed endpoints in the API documentation
+func TestHmacSigner(t *testing.T) {
+	query := "symbol=LTCBTC&side=BUY&type=LIMIT&timeInForce=GTC&quantity=1&price=0.1&recvWindow=5000&timestamp=1499827319559"
+	want := "c8db56825ae71d6d79447849e617115f4a920fa2acdcab2b053c4b2838bd6b71"
+	if got := hmacSigner([]byte(TEST_HMAC_SECRET))(query); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
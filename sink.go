@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SINK_STDOUT  = "stdout"
+	SINK_FILE    = "file"
+	SINK_NATS    = "nats"
+	SINK_WEBHOOK = "webhook"
+
+	SINK_CONCURRENCY          = 4
+	SINK_TIMEOUT              = time.Duration(5) * time.Second
+	DEFAULT_FILE_MAX_SIZE_MB  = 10
+	DEFAULT_FILE_MAX_BACKUPS  = 3
+	DEFAULT_NATS_SUBJECT_BASE = "binance.spreads"
+)
+
+// SpreadReport is the payload of the background spread run
+// written to the sinks of a watch-list
+type SpreadReport struct {
+	WatchList string          `json:"watchList"`
+	Time      time.Time       `json:"time"`
+	Spreads   []*SpreadSample `json:"spreads"`
+}
+
+type Sink interface {
+	Name() string
+	Write(ctx context.Context, report *SpreadReport) error
+}
+
+type SinkConfig struct {
+	Type       string `json:"type"`
+	Path       string `json:"path,omitempty"`
+	MaxSizeMB  int    `json:"maxSizeMB,omitempty"`
+	MaxBackups int    `json:"maxBackups,omitempty"`
+	Url        string `json:"url,omitempty"`
+	Subject    string `json:"subject,omitempty"`
+}
+
+type WatchListConfig struct {
+	Name    string       `json:"name"`
+	Symbols []string     `json:"symbols"`
+	Sinks   []SinkConfig `json:"sinks"`
+}
+
+type SinksConfig struct {
+	WatchLists []WatchListConfig `json:"watchLists"`
+}
+
+// WatchList routes the spreads of its symbols to its sinks,
+// all the spreads reported by the background worker when empty
+type WatchList struct {
+	Name    string
+	Symbols map[string]bool
+	sinks   []Sink
+}
+
+type WatchLists []*WatchList
+
+func LoadWatchLists(path string) (WatchLists, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config SinksConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid sinks config %s: %w", path, err)
+	}
+
+	var lists WatchLists
+	for i, wc := range config.WatchLists {
+		if wc.Name == "" {
+			wc.Name = fmt.Sprintf("watchlist%d", i+1)
+		}
+		list := &WatchList{Name: wc.Name, Symbols: make(map[string]bool)}
+		for _, s := range parseSymbols(strings.Join(wc.Symbols, ",")) {
+			list.Symbols[s] = true
+		}
+		for _, sc := range wc.Sinks {
+			sink, err := newSink(wc.Name, sc)
+			if err != nil {
+				return nil, fmt.Errorf("watch-list %s: %w", wc.Name, err)
+			}
+			list.sinks = append(list.sinks, sink)
+		}
+		lists = append(lists, list)
+	}
+
+	return lists, nil
+}
+
+func newSink(watchList string, c SinkConfig) (Sink, error) {
+	switch c.Type {
+	case SINK_STDOUT:
+		return &stdoutSink{}, nil
+	case SINK_FILE:
+		if c.Path == "" {
+			return nil, fmt.Errorf("%s sink requires a path", c.Type)
+		}
+		if c.MaxSizeMB <= 0 {
+			c.MaxSizeMB = DEFAULT_FILE_MAX_SIZE_MB
+		}
+		if c.MaxBackups <= 0 {
+			c.MaxBackups = DEFAULT_FILE_MAX_BACKUPS
+		}
+		return &fileSink{path: c.Path, maxSize: int64(c.MaxSizeMB) << 20, maxBackups: c.MaxBackups}, nil
+	case SINK_NATS:
+		if c.Url == "" {
+			return nil, fmt.Errorf("%s sink requires a url", c.Type)
+		}
+		if c.Subject == "" {
+			c.Subject = DEFAULT_NATS_SUBJECT_BASE + "." + watchList
+		}
+		return newNatsSink(c.Url, c.Subject)
+	case SINK_WEBHOOK:
+		if c.Url == "" {
+			return nil, fmt.Errorf("%s sink requires a url", c.Type)
+		}
+		return &webhookSink{url: c.Url, client: &http.Client{Timeout: SINK_TIMEOUT}}, nil
+	}
+	return nil, fmt.Errorf("unsupported sink type %q", c.Type)
+}
+
+// Symbols returns the symbols of all the watch-lists,
+// the background worker reports them on top of its own targets
+func (lists WatchLists) Symbols() []string {
+	var symbols []string
+	seen := make(map[string]bool)
+	for _, l := range lists {
+		for s := range l.Symbols {
+			if !seen[s] {
+				seen[s] = true
+				symbols = append(symbols, s)
+			}
+		}
+	}
+	return symbols
+}
+
+// Publish writes the samples of every watch-list to its sinks, the sink
+// errors are logged and counted, so a broken sink doesn't affect the others
+func (lists WatchLists) Publish(ctx context.Context, timestamp time.Time, samples []*SpreadSample) {
+	type write struct {
+		list *WatchList
+		sink Sink
+	}
+	var writes []write
+	reports := make(map[string]*SpreadReport, len(lists))
+	for _, l := range lists {
+		report := &SpreadReport{WatchList: l.Name, Time: timestamp, Spreads: []*SpreadSample{}}
+		for _, s := range samples {
+			if len(l.Symbols) == 0 || l.Symbols[s.Symbol] {
+				report.Spreads = append(report.Spreads, s)
+			}
+		}
+		reports[l.Name] = report
+		for _, sink := range l.sinks {
+			writes = append(writes, write{list: l, sink: sink})
+		}
+	}
+
+	fanOut(len(writes), SINK_CONCURRENCY, func(i int) {
+		w := writes[i]
+		ctx, cancel := context.WithTimeout(ctx, SINK_TIMEOUT)
+		defer cancel()
+
+		err := w.sink.Write(ctx, reports[w.list.Name])
+		if err != nil {
+			sinkWrites.WithLabelValues(w.list.Name, w.sink.Name(), "error").Inc()
+			loggerFromContext(ctx).WithError(err).WithFields(log.Fields{
+				"watchList": w.list.Name,
+				"sink":      w.sink.Name(),
+			}).Error("Error occurred while writing spreads to the sink")
+			return
+		}
+		sinkWrites.WithLabelValues(w.list.Name, w.sink.Name(), "ok").Inc()
+	})
+}
+
+type stdoutSink struct {
+	mu sync.Mutex
+}
+
+func (s *stdoutSink) Name() string { return SINK_STDOUT }
+
+func (s *stdoutSink) Write(ctx context.Context, report *SpreadReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s %s\n", report.WatchList, report.Time.Format(time.RFC3339))
+	fmt.Fprintln(tw, "SYMBOL\tHIGHEST BID\tLOWEST ASK\tSPREAD\tDELTA")
+	for _, v := range report.Spreads {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", v.Symbol, v.HighestBid, v.LowestAsk, v.Spread, v.Delta)
+	}
+	return tw.Flush()
+}
+
+// fileSink appends a JSON line per report, the file is rotated
+// to path.1 ... path.N once it would exceed the max size
+type fileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu sync.Mutex
+}
+
+func (s *fileSink) Name() string { return SINK_FILE }
+
+func (s *fileSink) Write(ctx context.Context, report *SpreadReport) error {
+	line, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fi, err := os.Stat(s.path); err == nil && fi.Size() > 0 && fi.Size()+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *fileSink) rotate() error {
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		old := fmt.Sprintf("%s.%d", s.path, i)
+		if _, err := os.Stat(old); err == nil {
+			if err := os.Rename(old, fmt.Sprintf("%s.%d", s.path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(s.path, s.path+".1")
+}
+
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) Name() string { return SINK_WEBHOOK }
+
+func (s *webhookSink) Write(ctx context.Context, report *SpreadReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	ioutil.ReadAll(res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", res.Status)
+	}
+	return nil
+}
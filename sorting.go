@@ -1,18 +1,59 @@
 package main
 
-type symbols []*SymbolData
+import "container/heap"
 
-func (s symbols) Len() int      { return len(s) }
-func (s symbols) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+// SymbolOrder reports whether the symbol a ranks above the symbol b
+type SymbolOrder func(a, b *SymbolData) bool
 
-// ByVolume implements sort.Interface
-type ByVolume struct{ symbols }
+func ByVolume(a, b *SymbolData) bool { return a.Volume.GreaterThan(b.Volume) }
 
-func (s ByVolume) Less(i, j int) bool { return s.symbols[i].Volume.GreaterThan(s.symbols[j].Volume) }
+func ByQuoteVolume(a, b *SymbolData) bool { return a.QuoteVolume.GreaterThan(b.QuoteVolume) }
 
-// ByTradeCount implements sort.Interface
-type ByTradeCount struct{ symbols }
+func ByTradeCount(a, b *SymbolData) bool { return a.TradeCount > b.TradeCount }
 
-func (s ByTradeCount) Less(i, j int) bool {
-	return s.symbols[i].TradeCount > s.symbols[j].TradeCount
+// topSymbols keeps the k highest ranked symbols in a heap with the lowest
+// ranked of them on top, so a symbol is either dropped or replaces it
+type topSymbols struct {
+	k       int
+	order   SymbolOrder
+	symbols []*SymbolData
+}
+
+func newTopSymbols(k int, order SymbolOrder) *topSymbols {
+	return &topSymbols{k: k, order: order, symbols: make([]*SymbolData, 0, k)}
+}
+
+func (t *topSymbols) Len() int           { return len(t.symbols) }
+func (t *topSymbols) Less(i, j int) bool { return t.order(t.symbols[j], t.symbols[i]) }
+func (t *topSymbols) Swap(i, j int)      { t.symbols[i], t.symbols[j] = t.symbols[j], t.symbols[i] }
+func (t *topSymbols) Push(x interface{}) { t.symbols = append(t.symbols, x.(*SymbolData)) }
+
+func (t *topSymbols) Pop() interface{} {
+	n := len(t.symbols) - 1
+	s := t.symbols[n]
+	t.symbols = t.symbols[:n]
+	return s
+}
+
+func (t *topSymbols) Add(s *SymbolData) {
+	if t.k <= 0 {
+		return
+	}
+	if len(t.symbols) < t.k {
+		heap.Push(t, s)
+		return
+	}
+	if t.order(s, t.symbols[0]) {
+		t.symbols[0] = s
+		heap.Fix(t, 0)
+	}
+}
+
+// Sorted empties the heap and returns the symbols from the highest ranked
+func (t *topSymbols) Sorted() []*SymbolData {
+	sorted := make([]*SymbolData, len(t.symbols))
+	for i := len(sorted) - 1; i >= 0; i-- {
+		sorted[i] = heap.Pop(t).(*SymbolData)
+	}
+	return sorted
 }
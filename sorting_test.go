@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func testSymbols(n int) []*SymbolData {
+	symbols := make([]*SymbolData, n)
+	for i := range symbols {
+		symbols[i] = &SymbolData{
+			Symbol:      fmt.Sprintf("A%04dUSDT", i),
+			Volume:      decimal.NewFromInt(int64(i * 7919 % 100003)),
+			QuoteVolume: decimal.NewFromInt(int64(i * 104729 % 1000003)),
+			TradeCount:  i * 31 % 997,
+		}
+	}
+	return symbols
+}
+
+// sortedTop is the sort of all the symbols the top-k heap replaced
+func sortedTop(symbols []*SymbolData, k int, order SymbolOrder) []*SymbolData {
+	sorted := append([]*SymbolData{}, symbols...)
+	sort.SliceStable(sorted, func(i, j int) bool { return order(sorted[i], sorted[j]) })
+	if len(sorted) > k {
+		sorted = sorted[:k]
+	}
+	return sorted
+}
+
+func heapTop(symbols []*SymbolData, k int, order SymbolOrder) []*SymbolData {
+	top := newTopSymbols(k, order)
+	for _, s := range symbols {
+		top.Add(s)
+	}
+	return top.Sorted()
+}
+
+func TestTopSymbols(t *testing.T) {
+	symbols := testSymbols(2500)
+	for name, order := range map[string]SymbolOrder{
+		"volume":      ByVolume,
+		"quoteVolume": ByQuoteVolume,
+	} {
+		want, got := sortedTop(symbols, TOP_LIMIT, order), heapTop(symbols, TOP_LIMIT, order)
+		if len(got) != len(want) {
+			t.Fatalf("%s: got %d symbols, want %d", name, len(got), len(want))
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: top %d is %s, want %s", name, i, got[i].Symbol, want[i].Symbol)
+			}
+		}
+	}
+}
+
+// BenchmarkTopSymbols compares the top-k heap with the sort of all the symbols
+func BenchmarkTopSymbols(b *testing.B) {
+	symbols := testSymbols(2500)
+
+	b.Run("heap", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			heapTop(symbols, TOP_LIMIT, ByVolume)
+		}
+	})
+
+	b.Run("sort", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sortedTop(symbols, TOP_LIMIT, ByVolume)
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// SpreadSnapshot is the immutable result of a background run,
+// the version is incremented on every publish
+type SpreadSnapshot struct {
+	Version   uint64
+	UpdatedAt time.Time
+	Spreads   map[string]*SpreadMetric
+	Failures  []*SymbolFailure
+}
+
+// SpreadView is the json representation of the spread metric
+type SpreadView struct {
+	Symbol       string           `json:"symbol"`
+	Time         time.Time        `json:"time"`
+	HighestBid   decimal.Decimal  `json:"highestBid"`
+	LowestAsk    decimal.Decimal  `json:"lowestAsk"`
+	Spread       decimal.Decimal  `json:"spread"`
+	Delta        decimal.Decimal  `json:"delta"`
+	BidsNotional *decimal.Decimal `json:"bidsNotional,omitempty"`
+	AsksNotional *decimal.Decimal `json:"asksNotional,omitempty"`
+}
+
+// SpreadSnapshotView reports the prices and the notional values in the quote
+// asset of every symbol, or all of them in the currency when it's set
+type SpreadSnapshotView struct {
+	Version   uint64           `json:"version"`
+	UpdatedAt time.Time        `json:"updatedAt"`
+	Currency  string           `json:"currency,omitempty"`
+	Spreads   []*SpreadView    `json:"spreads"`
+	Failures  []*SymbolFailure `json:"failures"`
+}
+
+// Age is the time since the last publish, zero before the first one
+func (s *SpreadSnapshot) Age(now time.Time) time.Duration {
+	if s.Version == 0 {
+		return 0
+	}
+	return now.Sub(s.UpdatedAt)
+}
+
+// Symbols returns the symbols of the snapshot in the sorted order
+func (s *SpreadSnapshot) Symbols() []string {
+	symbols := make([]string, 0, len(s.Spreads))
+	for symbol := range s.Spreads {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+func (s *SpreadSnapshot) View() *SpreadSnapshotView {
+	view := &SpreadSnapshotView{
+		Version:   s.Version,
+		UpdatedAt: s.UpdatedAt,
+		Spreads:   []*SpreadView{},
+		Failures:  s.Failures,
+	}
+	if view.Failures == nil {
+		view.Failures = []*SymbolFailure{}
+	}
+	for _, symbol := range s.Symbols() {
+		m := s.Spreads[symbol]
+		v := &SpreadView{
+			Symbol:     symbol,
+			Time:       m.timestamp,
+			HighestBid: m.spread.HighestBid,
+			LowestAsk:  m.spread.LowestAsk,
+			Spread:     m.spread.Value,
+			Delta:      m.delta,
+		}
+		if m.notional != nil {
+			v.BidsNotional = &m.notional.BidsTotal
+			v.AsksNotional = &m.notional.AsksTotal
+		}
+		view.Spreads = append(view.Spreads, v)
+	}
+	return view
+}
+
+// StateStore hands the background results over to their readers:
+// the metrics collector, the index page and the streams
+type StateStore interface {
+	Publish(spreads map[string]*SpreadMetric, failures []*SymbolFailure) *SpreadSnapshot
+	Snapshot() *SpreadSnapshot
+	Subscribe() (<-chan *SpreadSnapshot, func())
+}
+
+type stateStore struct {
+	mu          sync.RWMutex
+	snapshot    *SpreadSnapshot
+	subscribers map[chan *SpreadSnapshot]bool
+}
+
+func NewStateStore() StateStore {
+	return &stateStore{
+		snapshot:    &SpreadSnapshot{Spreads: map[string]*SpreadMetric{}},
+		subscribers: make(map[chan *SpreadSnapshot]bool),
+	}
+}
+
+func (s *stateStore) Publish(spreads map[string]*SpreadMetric, failures []*SymbolFailure) *SpreadSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := &SpreadSnapshot{
+		Version:   s.snapshot.Version + 1,
+		UpdatedAt: time.Now(),
+		Spreads:   spreads,
+		Failures:  failures,
+	}
+	s.snapshot = snapshot
+
+	// a slow subscriber only gets the latest snapshot,
+	// the one it hasn't received yet is replaced
+	for ch := range s.subscribers {
+		select {
+		case ch <- snapshot:
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- snapshot
+		}
+	}
+
+	return snapshot
+}
+
+func (s *stateStore) Snapshot() *SpreadSnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.snapshot
+}
+
+// Subscribe returns the channel receiving every new snapshot and
+// the function to unsubscribe, which must be called when done
+func (s *stateStore) Subscribe() (<-chan *SpreadSnapshot, func()) {
+	ch := make(chan *SpreadSnapshot, 1)
+
+	s.mu.Lock()
+	s.subscribers[ch] = true
+	s.mu.Unlock()
+
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		s.mu.Unlock()
+	}
+}
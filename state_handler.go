@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const STREAM_KEEPALIVE = 30 * time.Second
+
+func (c *controller) spreads(w http.ResponseWriter, req *http.Request) {
+	conversions, err := c.reportingCurrency(req)
+	if err != nil {
+		writeJSONError(w, conversionStatus(err), err)
+		return
+	}
+
+	view := c.state.Snapshot().View()
+	if conversions != nil {
+		view = conversions.SpreadSnapshotView(view)
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+// spreadStream pushes every new snapshot as a server-sent event,
+// starting with the current one when it's already published
+func (c *controller) spreadStream(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	updates, unsubscribe := c.state.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// a snapshot published between subscribing and reading
+	// the current one must not be sent twice
+	var last uint64
+	send := func(s *SpreadSnapshot) error {
+		if s.Version <= last {
+			return nil
+		}
+		last = s.Version
+		data, err := json.Marshal(s.View())
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: spreads\ndata: %s\n\n", s.Version, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	if s := c.state.Snapshot(); s.Version > 0 {
+		if err := send(s); err != nil {
+			return
+		}
+	}
+
+	keepalive := time.NewTicker(STREAM_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case s := <-updates:
+			if err := send(s); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
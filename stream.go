@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	STREAM_MIN_BACKOFF = time.Second
+	STREAM_MAX_BACKOFF = time.Minute
+)
+
+type StreamClient interface {
+	SubscribeAggTrades(ctx context.Context, symbols []string, handler func(*AggTradeEvent)) error
+}
+
+type streamClient struct {
+	streamBaseUrl string
+}
+
+type streamMessage struct {
+	Stream string          `json:"stream"`
+	Data   json.RawMessage `json:"data"`
+}
+
+func NewStreamClient(baseUrl string) StreamClient {
+	return &streamClient{streamBaseUrl: baseUrl}
+}
+
+// SubscribeAggTrades blocks until the context is cancelled, reconnecting
+// the combined stream with exponential backoff when the connection drops
+func (c *streamClient) SubscribeAggTrades(
+	ctx context.Context, symbols []string, handler func(*AggTradeEvent),
+) error {
+	var streams []string
+	for _, s := range symbols {
+		streams = append(streams, strings.ToLower(s)+"@aggTrade")
+	}
+	url := c.streamBaseUrl + "/stream?streams=" + strings.Join(streams, "/")
+
+	backoff := STREAM_MIN_BACKOFF
+	for {
+		start := time.Now()
+		err := c.consume(ctx, url, handler)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if time.Since(start) > STREAM_MAX_BACKOFF {
+			backoff = STREAM_MIN_BACKOFF
+		}
+		log.WithError(err).WithField("url", url).Warnf(
+			"Stream disconnected, reconnecting in %s", backoff)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > STREAM_MAX_BACKOFF {
+			backoff = STREAM_MAX_BACKOFF
+		}
+	}
+}
+
+func (c *streamClient) consume(ctx context.Context, url string, handler func(*AggTradeEvent)) error {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	log.WithField("url", url).Info("Connected to stream")
+	for {
+		var msg streamMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+
+		var event AggTradeEvent
+		if err := json.Unmarshal(msg.Data, &event); err != nil {
+			log.WithError(err).WithField("stream", msg.Stream).Warn("Skipped malformed stream event")
+			continue
+		}
+		handler(&event)
+	}
+}
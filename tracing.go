@@ -1,16 +1,102 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	SERVICE_NAME      = "binance-home-task"
+	TRACING_NONE      = "none"
+	TRACING_STDOUT    = "stdout"
+	TRACING_OTLP      = "otlp"
+	REQUEST_ID_HEADER = "X-Request-Id"
 )
 
+var tracer = otel.Tracer("binance/home-task")
+
+type TracingConfig struct {
+	Exporter     string
+	OtlpEndpoint string
+	OtlpInsecure bool
+}
+
+func initTracing(cfg TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case TRACING_NONE, "":
+		return func(context.Context) error { return nil }, nil
+	case TRACING_STDOUT:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TRACING_OTLP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.OtlpEndpoint)}
+		if cfg.OtlpInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceNameKey.String(SERVICE_NAME))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
 func (c *controller) tracing(hdlr http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		requestID := req.Header.Get("X-Request-Id")
+		requestID := req.Header.Get(REQUEST_ID_HEADER)
 		if requestID == "" {
 			requestID = c.nextRequestID()
 		}
-		w.Header().Set("X-Request-Id", requestID)
-		hdlr.ServeHTTP(w, req)
+		w.Header().Set(REQUEST_ID_HEADER, requestID)
+
+		route := c.route(req)
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer.Start(ctx, req.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest(SERVICE_NAME, route, req)...),
+			trace.WithAttributes(attribute.String("http.request_id", requestID)),
+		)
+		defer span.End()
+
+		rec := newResponseRecorder(w)
+		hdlr.ServeHTTP(rec, req.WithContext(ctx))
+
+		status := rec.Status()
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(status, trace.SpanKindServer))
 	})
 }
+
+func recordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
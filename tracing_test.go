@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TestTracingPropagation follows a request traced by its caller through
+// the handler, the service and the API client, to the requests the
+// exchange receives
+func TestTracingPropagation(t *testing.T) {
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var mu sync.Mutex
+	received := make(map[string]trace.SpanContext)
+	exchange := fakeExchangeHandler([]Symbol{
+		testSymbol("BTCUSDT", "BTC", "USDT", SYMBOL_STATUS_TRADING),
+	}, []*BookTicker{
+		{Symbol: "BTCUSDT", BidPrice: "49999", BidQty: "3", AskPrice: "50000", AskQty: "2"},
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := propagation.TraceContext{}.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		mu.Lock()
+		received[req.URL.Path] = trace.SpanContextFromContext(ctx)
+		mu.Unlock()
+		exchange(w, req)
+	}))
+	defer srv.Close()
+
+	var client ApiClient = newTestClient(srv.URL)
+	router := http.NewServeMux()
+	c := &controller{
+		router:        router,
+		conversions:   NewConversionService(&client, &fixedClock{now: time.Unix(1767225600, 0)}),
+		nextRequestID: func() string { return "1" },
+	}
+	router.HandleFunc("/conversion", c.conversion)
+
+	caller, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	callerSpan, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	req := httptest.NewRequest(http.MethodGet, "/conversion?from=BTC&to=USDT", nil)
+	req.Header.Set("traceparent", "00-"+caller.String()+"-"+callerSpan.String()+"-01")
+	rec := httptest.NewRecorder()
+	c.tracing(router).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+	// every span is a child of the previous one
+	chain := []struct {
+		name string
+		kind trace.SpanKind
+	}{
+		{"GET /conversion", trace.SpanKindServer},
+		{"ConversionService.GetConversions", trace.SpanKindInternal},
+		{"GET /api/v3/exchangeInfo", trace.SpanKindClient},
+	}
+	parent := callerSpan
+	for _, link := range chain {
+		s, found := spans[link.name]
+		if !found {
+			t.Fatalf("no span %q", link.name)
+		}
+		if s.SpanContext().TraceID() != caller {
+			t.Errorf("span %q of trace %s, want %s", link.name, s.SpanContext().TraceID(), caller)
+		}
+		if s.Parent().SpanID() != parent {
+			t.Errorf("span %q is a child of %s, want %s", link.name, s.Parent().SpanID(), parent)
+		}
+		if s.SpanKind() != link.kind {
+			t.Errorf("span %q is %s, want %s", link.name, s.SpanKind(), link.kind)
+		}
+		parent = s.SpanContext().SpanID()
+	}
+	if !spans["GET /conversion"].Parent().IsRemote() {
+		t.Error("the server span is not a child of the remote caller span")
+	}
+
+	// the exchange receives the context of the client span of the request
+	for _, path := range []string{"/api/v3/exchangeInfo", "/api/v3/ticker/bookTicker"} {
+		s, found := spans["GET "+path]
+		if !found {
+			t.Fatalf("no client span of %s", path)
+		}
+		if s.Parent().SpanID() != spans["ConversionService.GetConversions"].SpanContext().SpanID() {
+			t.Errorf("the client span of %s is not a child of the service span", path)
+		}
+		if got := received[path]; got.TraceID() != caller || got.SpanID() != s.SpanContext().SpanID() {
+			t.Errorf("%s received the span %s of trace %s, want %s of %s",
+				path, got.SpanID(), got.TraceID(), s.SpanContext().SpanID(), caller)
+		}
+	}
+}
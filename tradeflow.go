@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	SIDE_BUY  = "buy"
+	SIDE_SELL = "sell"
+
+	TRADE_FLOW_SOURCE_STREAM = "stream"
+	TRADE_FLOW_SOURCE_REST   = "rest"
+
+	AGG_TRADES_LIMIT     = 1000
+	AGG_TRADES_MAX_RANGE = time.Hour
+	RECENT_TRADES_LIMIT  = 1000
+	LARGE_TRADES_LIMIT   = 20
+)
+
+// trade sizes are bucketed by the lower bound of their notional value in the quote asset
+var tradeSizeBuckets = []float64{0, 10, 100, 1000, 10000, 100000, 1000000}
+
+type TradeFlowConfig struct {
+	Symbols            []string
+	Window             time.Duration
+	LargeTradeMultiple int64
+}
+
+// validate keeps the window within the time range of
+// a single aggregate trades query
+func (c TradeFlowConfig) validate() error {
+	if c.Window <= 0 || c.Window > AGG_TRADES_MAX_RANGE {
+		return fmt.Errorf("invalid trade flow window %s, the max is %s", c.Window, AGG_TRADES_MAX_RANGE)
+	}
+	return nil
+}
+
+type FlowTrade struct {
+	Time     time.Time       `json:"time"`
+	Side     string          `json:"side"`
+	Price    decimal.Decimal `json:"price"`
+	Qty      decimal.Decimal `json:"qty"`
+	QuoteQty decimal.Decimal `json:"quoteQty"`
+}
+
+type TradeSizeBucket struct {
+	From   float64         `json:"from"`
+	Count  int             `json:"count"`
+	Volume decimal.Decimal `json:"volume"`
+}
+
+type TradeFlow struct {
+	Symbol           string             `json:"symbol"`
+	Source           string             `json:"source"`
+	From             time.Time          `json:"from"`
+	To               time.Time          `json:"to"`
+	Trades           int                `json:"trades"`
+	TradesPerSecond  float64            `json:"tradesPerSecond"`
+	BuyVolume        decimal.Decimal    `json:"buyVolume"`
+	SellVolume       decimal.Decimal    `json:"sellVolume"`
+	BuyQuoteVolume   decimal.Decimal    `json:"buyQuoteVolume"`
+	SellQuoteVolume  decimal.Decimal    `json:"sellQuoteVolume"`
+	BuyRatio         float64            `json:"buyRatio"`
+	MedianQuoteQty   decimal.Decimal    `json:"medianQuoteQty"`
+	SizeDistribution []*TradeSizeBucket `json:"sizeDistribution"`
+	LargeTrades      []*FlowTrade       `json:"largeTrades"`
+	LargeTradesTotal map[string]int64   `json:"largeTradesTotal,omitempty"`
+}
+
+type TradeFlowService interface {
+	Start(ctx context.Context)
+	GetTradeFlow(ctx context.Context, symbol string) (*TradeFlow, error)
+	GetRecentTrades(ctx context.Context, symbol string, limit int) ([]*FlowTrade, error)
+	GetTrackedTradeFlows() []*TradeFlow
+}
+
+type symbolTrades struct {
+	trades     []*FlowTrade
+	lastID     int64
+	largeTotal map[string]int64
+	median     decimal.Decimal
+	medianAt   time.Time
+}
+
+type tradeFlow struct {
+	client ApiClient
+	stream StreamClient
+	config TradeFlowConfig
+
+	mu      sync.RWMutex
+	symbols map[string]*symbolTrades
+}
+
+func NewTradeFlowService(c *ApiClient, s *StreamClient, config TradeFlowConfig) TradeFlowService {
+	symbols := make(map[string]*symbolTrades, len(config.Symbols))
+	for _, symbol := range config.Symbols {
+		symbols[symbol] = &symbolTrades{largeTotal: map[string]int64{SIDE_BUY: 0, SIDE_SELL: 0}}
+	}
+
+	return &tradeFlow{
+		client:  *c,
+		stream:  *s,
+		config:  config,
+		symbols: symbols,
+	}
+}
+
+// Start backfills the window of the tracked symbols from the aggregate
+// trades and keeps it up to date from the @aggTrade stream
+func (f *tradeFlow) Start(ctx context.Context) {
+	if len(f.config.Symbols) == 0 {
+		return
+	}
+
+	for _, symbol := range f.config.Symbols {
+		trades, err := f.fetchAggTrades(ctx, symbol)
+		if err != nil {
+			log.WithField("symbol", symbol).WithError(err).Error(
+				"Error occurred while backfilling aggregate trades")
+			continue
+		}
+		f.mu.Lock()
+		for _, t := range trades {
+			f.ingest(symbol, t)
+		}
+		f.mu.Unlock()
+	}
+
+	err := f.stream.SubscribeAggTrades(ctx, f.config.Symbols, func(e *AggTradeEvent) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.ingest(e.Symbol, &e.AggTrade)
+	})
+	if err != nil && err != context.Canceled {
+		log.WithError(err).Error("Aggregate trades stream stopped")
+	}
+}
+
+func (f *tradeFlow) GetTradeFlow(ctx context.Context, symbol string) (*TradeFlow, error) {
+	ctx, span := tracer.Start(ctx, "TradeFlowService.GetTradeFlow",
+		trace.WithAttributes(attribute.String("symbol", symbol)))
+	defer span.End()
+
+	now := time.Now()
+	f.mu.RLock()
+	st, tracked := f.symbols[symbol]
+	if tracked {
+		flow := f.summarize(symbol, TRADE_FLOW_SOURCE_STREAM, st.trades, now)
+		flow.LargeTradesTotal = copyCounts(st.largeTotal)
+		f.mu.RUnlock()
+		return flow, nil
+	}
+	f.mu.RUnlock()
+
+	aggTrades, err := f.fetchAggTrades(ctx, symbol)
+	if err != nil {
+		recordError(span, err)
+		loggerFromContext(ctx).WithField("symbol", symbol).Errorf(
+			"Error occurred while getting aggregate trades for %s", symbol)
+		return nil, err
+	}
+
+	var trades []*FlowTrade
+	for _, t := range aggTrades {
+		trade, err := newFlowTrade(symbol, t)
+		if err != nil {
+			quarantine(ctx, err)
+			continue
+		}
+		trades = append(trades, trade)
+	}
+	return f.summarize(symbol, TRADE_FLOW_SOURCE_REST, trades, now), nil
+}
+
+// GetRecentTrades returns the last individual trades of the symbol from
+// the recent trades, the newest first
+func (f *tradeFlow) GetRecentTrades(ctx context.Context, symbol string, limit int) ([]*FlowTrade, error) {
+	ctx, span := tracer.Start(ctx, "TradeFlowService.GetRecentTrades",
+		trace.WithAttributes(attribute.String("symbol", symbol)))
+	defer span.End()
+
+	recent, err := f.client.GetRecentTrades(ctx, symbol, limit)
+	if err != nil {
+		recordError(span, err)
+		loggerFromContext(ctx).WithField("symbol", symbol).Errorf(
+			"Error occurred while getting recent trades for %s", symbol)
+		return nil, err
+	}
+
+	trades := make([]*FlowTrade, 0, len(recent))
+	for i := len(recent) - 1; i >= 0; i-- {
+		t := recent[i]
+		trade, err := parseFlowTrade(symbol, t.ID, t.Price, t.Qty, t.Time, t.IsBuyerMaker)
+		if err != nil {
+			quarantine(ctx, err)
+			continue
+		}
+		trades = append(trades, trade)
+	}
+	return trades, nil
+}
+
+func (f *tradeFlow) GetTrackedTradeFlows() []*TradeFlow {
+	now := time.Now()
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	var flows []*TradeFlow
+	for _, symbol := range f.config.Symbols {
+		st := f.symbols[symbol]
+		flow := f.summarize(symbol, TRADE_FLOW_SOURCE_STREAM, st.trades, now)
+		flow.LargeTradesTotal = copyCounts(st.largeTotal)
+		flows = append(flows, flow)
+	}
+	return flows
+}
+
+// fetchAggTrades pages through the aggregate trades of the window, the
+// first page is queried by time and the next ones by the id following the
+// last trade received, until a trade after the end or a short page
+func (f *tradeFlow) fetchAggTrades(ctx context.Context, symbol string) ([]*AggTrade, error) {
+	end := time.Now()
+	query := &AggTradesQuery{
+		Symbol:    symbol,
+		StartTime: end.Add(-f.config.Window),
+		EndTime:   end,
+		Limit:     AGG_TRADES_LIMIT,
+	}
+
+	var trades []*AggTrade
+	for {
+		page, err := f.client.GetAggTrades(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range page {
+			if fromMillis(t.Time).After(end) {
+				return trades, nil
+			}
+			trades = append(trades, t)
+		}
+		if len(page) < AGG_TRADES_LIMIT {
+			return trades, nil
+		}
+		query = &AggTradesQuery{
+			Symbol: symbol,
+			FromID: page[len(page)-1].AggTradeID + 1,
+			Limit:  AGG_TRADES_LIMIT,
+		}
+	}
+}
+
+// ingest must be called with the write lock held
+func (f *tradeFlow) ingest(symbol string, t *AggTrade) {
+	st, ok := f.symbols[symbol]
+	if !ok || t.AggTradeID <= st.lastID {
+		return
+	}
+	st.lastID = t.AggTradeID
+
+	trade, err := newFlowTrade(symbol, t)
+	if err != nil {
+		quarantine(context.Background(), err)
+		return
+	}
+	if f.isLarge(st, trade) {
+		st.largeTotal[trade.Side]++
+		log.WithFields(log.Fields{
+			"symbol":   symbol,
+			"side":     trade.Side,
+			"quoteQty": trade.QuoteQty,
+		}).Info("Large trade detected")
+	}
+
+	cutoff := trade.Time.Add(-f.config.Window)
+	i := sort.Search(len(st.trades), func(i int) bool { return !st.trades[i].Time.Before(cutoff) })
+	st.trades = append(st.trades[i:], trade)
+}
+
+// isLarge compares the trade with the median of the window,
+// recalculated at most once a second on busy symbols
+func (f *tradeFlow) isLarge(st *symbolTrades, trade *FlowTrade) bool {
+	if f.config.LargeTradeMultiple <= 0 {
+		return false
+	}
+	if trade.Time.Sub(st.medianAt) >= time.Second {
+		st.median = medianQuoteQty(st.trades)
+		st.medianAt = trade.Time
+	}
+	if st.median.IsZero() {
+		return false
+	}
+	return trade.QuoteQty.GreaterThanOrEqual(st.median.Mul(decimal.NewFromInt(f.config.LargeTradeMultiple)))
+}
+
+func (f *tradeFlow) summarize(symbol string, source string, trades []*FlowTrade, now time.Time) *TradeFlow {
+	from := now.Add(-f.config.Window)
+	flow := &TradeFlow{
+		Symbol:      symbol,
+		Source:      source,
+		From:        from,
+		To:          now,
+		LargeTrades: []*FlowTrade{},
+	}
+
+	var window []*FlowTrade
+	for _, t := range trades {
+		if !t.Time.Before(from) {
+			window = append(window, t)
+		}
+	}
+	flow.Trades = len(window)
+	flow.TradesPerSecond = float64(len(window)) / f.config.Window.Seconds()
+	flow.MedianQuoteQty = medianQuoteQty(window)
+
+	flow.SizeDistribution = make([]*TradeSizeBucket, len(tradeSizeBuckets))
+	for i, from := range tradeSizeBuckets {
+		flow.SizeDistribution[i] = &TradeSizeBucket{From: from}
+	}
+
+	large := flow.MedianQuoteQty.Mul(decimal.NewFromInt(f.config.LargeTradeMultiple))
+	for _, t := range window {
+		if t.Side == SIDE_BUY {
+			flow.BuyVolume = flow.BuyVolume.Add(t.Qty)
+			flow.BuyQuoteVolume = flow.BuyQuoteVolume.Add(t.QuoteQty)
+		} else {
+			flow.SellVolume = flow.SellVolume.Add(t.Qty)
+			flow.SellQuoteVolume = flow.SellQuoteVolume.Add(t.QuoteQty)
+		}
+
+		qq, _ := t.QuoteQty.Float64()
+		for i := len(flow.SizeDistribution) - 1; i >= 0; i-- {
+			if b := flow.SizeDistribution[i]; qq >= b.From {
+				b.Count++
+				b.Volume = b.Volume.Add(t.Qty)
+				break
+			}
+		}
+
+		if f.config.LargeTradeMultiple > 0 && !large.IsZero() && t.QuoteQty.GreaterThanOrEqual(large) {
+			flow.LargeTrades = append(flow.LargeTrades, t)
+		}
+	}
+
+	sort.Slice(flow.LargeTrades, func(i, j int) bool {
+		return flow.LargeTrades[i].QuoteQty.GreaterThan(flow.LargeTrades[j].QuoteQty)
+	})
+	if len(flow.LargeTrades) > LARGE_TRADES_LIMIT {
+		flow.LargeTrades = flow.LargeTrades[:LARGE_TRADES_LIMIT]
+	}
+
+	total := flow.BuyQuoteVolume.Add(flow.SellQuoteVolume)
+	if !total.IsZero() {
+		flow.BuyRatio, _ = flow.BuyQuoteVolume.Div(total).Float64()
+	}
+
+	return flow
+}
+
+func newFlowTrade(symbol string, t *AggTrade) (*FlowTrade, error) {
+	return parseFlowTrade(symbol, t.AggTradeID, t.Price, t.Qty, t.Time, t.IsBuyerMaker)
+}
+
+// parseFlowTrade classifies the taker side, the buyer being
+// the maker means the trade was initiated by a seller
+func parseFlowTrade(symbol string, id int64, rawPrice, rawQty string, millis int64, isBuyerMaker bool) (*FlowTrade, error) {
+	var errs []error
+	price, err := parseDecimalField("price", rawPrice)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	qty, err := parseDecimalField("qty", rawQty)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, &ValidationError{Symbol: symbol, Reason: REASON_MALFORMED, Errors: errs}
+	}
+	if !price.IsPositive() || !qty.IsPositive() {
+		return nil, &ValidationError{Symbol: symbol, Reason: REASON_NON_POSITIVE,
+			Errors: []error{fmt.Errorf("trade %d price %s or quantity %s", id, price, qty)}}
+	}
+
+	side := SIDE_BUY
+	if isBuyerMaker {
+		side = SIDE_SELL
+	}
+	return &FlowTrade{
+		Time:     fromMillis(millis),
+		Side:     side,
+		Price:    price,
+		Qty:      qty,
+		QuoteQty: price.Mul(qty),
+	}, nil
+}
+
+func medianQuoteQty(trades []*FlowTrade) decimal.Decimal {
+	if len(trades) == 0 {
+		return decimal.Zero
+	}
+	values := make([]decimal.Decimal, len(trades))
+	for i, t := range trades {
+		values[i] = t.QuoteQty
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].LessThan(values[j]) })
+	return values[len(values)/2]
+}
+
+func copyCounts(m map[string]int64) map[string]int64 {
+	c := make(map[string]int64, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
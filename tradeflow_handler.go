@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+func (c *controller) tradeFlow(w http.ResponseWriter, req *http.Request) {
+	symbols := parseSymbols(req.URL.Query().Get("symbol"))
+	if len(symbols) != 1 {
+		writeJSONError(w, http.StatusBadRequest, errors.New("exactly one symbol is required"))
+		return
+	}
+
+	flow, err := c.flows.GetTradeFlow(req.Context(), symbols[0])
+	if err != nil {
+		writeJSONError(w, upstreamStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, flow)
+}
+
+func (c *controller) recentTrades(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	symbols := parseSymbols(params.Get("symbol"))
+	if len(symbols) != 1 {
+		writeJSONError(w, http.StatusBadRequest, errors.New("exactly one symbol is required"))
+		return
+	}
+
+	limit := RECENT_TRADES_LIMIT
+	if v := params.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > RECENT_TRADES_LIMIT {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q, at most %d", v, RECENT_TRADES_LIMIT))
+			return
+		}
+	}
+
+	trades, err := c.flows.GetRecentTrades(req.Context(), symbols[0], limit)
+	if err != nil {
+		writeJSONError(w, upstreamStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, trades)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNewFlowTrade(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		trade  AggTrade
+		reason string
+	}{
+		{"buy", AggTrade{AggTradeID: 1, Price: "100.5", Qty: "2"}, ""},
+		{"sell", AggTrade{AggTradeID: 2, Price: "100.5", Qty: "2", IsBuyerMaker: true}, ""},
+		{"malformed price", AggTrade{AggTradeID: 3, Price: "1e", Qty: "2"}, REASON_MALFORMED},
+		{"empty quantity", AggTrade{AggTradeID: 4, Price: "100.5", Qty: ""}, REASON_MALFORMED},
+		{"zero price", AggTrade{AggTradeID: 5, Price: "0", Qty: "2"}, REASON_NON_POSITIVE},
+		{"negative quantity", AggTrade{AggTradeID: 6, Price: "100.5", Qty: "-2"}, REASON_NON_POSITIVE},
+	} {
+		trade, err := newFlowTrade("BTCUSDT", &tt.trade)
+		if tt.reason != "" {
+			var verr *ValidationError
+			if !errors.As(err, &verr) || verr.Reason != tt.reason || verr.Symbol != "BTCUSDT" {
+				t.Errorf("%s: got %v, want the %s validation error", tt.name, err, tt.reason)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		side := SIDE_BUY
+		if tt.trade.IsBuyerMaker {
+			side = SIDE_SELL
+		}
+		if trade.Side != side || trade.QuoteQty.String() != "201" {
+			t.Errorf("%s: got %s of %s, want %s of 201", tt.name, trade.Side, trade.QuoteQty, side)
+		}
+	}
+}
+
+// TestGetRecentTrades returns the recent trades newest first and drops
+// the malformed one
+func TestGetRecentTrades(t *testing.T) {
+	var query url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v3/trades" {
+			http.NotFound(w, req)
+			return
+		}
+		query = req.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[
+			{"id":1,"price":"100","qty":"1","quoteQty":"100","time":1767225600000,"isBuyerMaker":false},
+			{"id":2,"price":"1e","qty":"1","quoteQty":"100","time":1767225601000,"isBuyerMaker":false},
+			{"id":3,"price":"101","qty":"2","quoteQty":"202","time":1767225602000,"isBuyerMaker":true}
+		]`))
+	}))
+	defer srv.Close()
+
+	var c ApiClient = newTestClient(srv.URL)
+	var s StreamClient
+	flows := NewTradeFlowService(&c, &s, TradeFlowConfig{Window: time.Minute})
+	trades, err := flows.GetRecentTrades(context.Background(), "BTCUSDT", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query.Get("symbol") != "BTCUSDT" || query.Get("limit") != "3" {
+		t.Errorf("got query %s", query.Encode())
+	}
+	if len(trades) != 2 {
+		t.Fatalf("got %d trades, want 2", len(trades))
+	}
+	if trades[0].Side != SIDE_SELL || trades[0].QuoteQty.String() != "202" || trades[1].Side != SIDE_BUY {
+		t.Errorf("got %s of %s then %s, want the sell of 202 then the buy", trades[0].Side, trades[0].QuoteQty, trades[1].Side)
+	}
+}
+
+// TestFetchAggTrades pages by id after the first page queried by time and
+// stops at the first trade after the end of the window
+func TestFetchAggTrades(t *testing.T) {
+	const total, inWindow = 2500, 2400
+	var queries []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		queries = append(queries, q)
+		from := int64(1)
+		if v := q.Get("fromId"); v != "" {
+			from, _ = strconv.ParseInt(v, 10, 64)
+		}
+		start := time.Now().Add(-time.Minute)
+		trades := []*AggTrade{}
+		for id := from; id <= total && len(trades) < AGG_TRADES_LIMIT; id++ {
+			at := start.Add(time.Duration(id) * time.Millisecond)
+			if id > inWindow {
+				at = at.Add(time.Hour)
+			}
+			trades = append(trades, &AggTrade{AggTradeID: id, Price: "100", Qty: "1", Time: toMillis(at)})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(trades)
+	}))
+	defer srv.Close()
+
+	var c ApiClient = newTestClient(srv.URL)
+	f := &tradeFlow{client: c, config: TradeFlowConfig{Window: time.Minute}}
+	trades, err := f.fetchAggTrades(context.Background(), "BTCUSDT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != inWindow || trades[len(trades)-1].AggTradeID != inWindow {
+		t.Errorf("got %d trades, want %d", len(trades), inWindow)
+	}
+	if len(queries) != 3 {
+		t.Fatalf("got %d queries, want 3", len(queries))
+	}
+	if queries[0].Get("startTime") == "" || queries[0].Get("fromId") != "" {
+		t.Errorf("the first query %s is not by time", queries[0].Encode())
+	}
+	for i, fromID := range []string{"1001", "2001"} {
+		if q := queries[i+1]; q.Get("fromId") != fromID || q.Get("startTime") != "" {
+			t.Errorf("query %d is %s, want from id %s", i+1, q.Encode(), fromID)
+		}
+	}
+}
+
+func TestTradeFlowConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		window time.Duration
+		valid  bool
+	}{
+		{time.Minute, true},
+		{time.Hour, true},
+		{time.Hour + time.Second, false},
+		{0, false},
+	} {
+		if err := (TradeFlowConfig{Window: tt.window}).validate(); (err == nil) != tt.valid {
+			t.Errorf("window %s: got %v", tt.window, err)
+		}
+	}
+}
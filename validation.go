@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	REASON_MALFORMED     = "malformed"
+	REASON_EMPTY_BOOK    = "empty_book"
+	REASON_CROSSED_BOOK  = "crossed_book"
+	REASON_NEGATIVE_QTY  = "negative_quantity"
+	REASON_NON_POSITIVE  = "non_positive_price"
+	REASON_UNSORTED      = "unsorted_levels"
+	REASON_STALE_SAMPLE  = "stale"
+	TICKER_MAX_STALENESS = 10 * time.Minute
+)
+
+type FieldError struct {
+	Field string
+	Value string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("invalid %s %q: %v", e.Field, e.Value, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError reports why the sample of the symbol was rejected,
+// the reason is used as a label of the quarantine counter
+type ValidationError struct {
+	Symbol string
+	Reason string
+	Errors []error
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%s sample rejected (%s): %s", e.Symbol, e.Reason, strings.Join(msgs, "; "))
+}
+
+type PriceLevel struct {
+	Price decimal.Decimal
+	Qty   decimal.Decimal
+}
+
+type ValidatedOrderBook struct {
+	Symbol string
+	Bids   []PriceLevel
+	Asks   []PriceLevel
+}
+
+func parseDecimalField(field string, value string) (decimal.Decimal, error) {
+	d, err := decimal.NewFromString(value)
+	if err != nil {
+		return decimal.Zero, &FieldError{Field: field, Value: value, Err: err}
+	}
+	return d, nil
+}
+
+func validateOrderBook(symbol string, book *OrderBook) (*ValidatedOrderBook, error) {
+	bids, err := parseLevels(symbol, "bids", book.Bids, func(prev, next decimal.Decimal) bool {
+		return next.LessThan(prev)
+	})
+	if err != nil {
+		return nil, err
+	}
+	asks, err := parseLevels(symbol, "asks", book.Asks, func(prev, next decimal.Decimal) bool {
+		return next.GreaterThan(prev)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bids) == 0 || len(asks) == 0 {
+		return nil, &ValidationError{Symbol: symbol, Reason: REASON_EMPTY_BOOK,
+			Errors: []error{errors.New("empty bids or asks in order book")}}
+	}
+	if bids[0].Price.GreaterThanOrEqual(asks[0].Price) {
+		return nil, &ValidationError{Symbol: symbol, Reason: REASON_CROSSED_BOOK,
+			Errors: []error{fmt.Errorf("best bid %s is not below best ask %s", bids[0].Price, asks[0].Price)}}
+	}
+
+	return &ValidatedOrderBook{Symbol: symbol, Bids: bids, Asks: asks}, nil
+}
+
+// parseLevels parses the price levels of one side of the book,
+// ordered tells whether the next level price follows the previous one
+func parseLevels(
+	symbol string, side string, levels [][]string, ordered func(prev, next decimal.Decimal) bool,
+) ([]PriceLevel, error) {
+	parsed := make([]PriceLevel, 0, len(levels))
+	var errs []error
+	for i, v := range levels {
+		if len(v) < 2 {
+			errs = append(errs, fmt.Errorf("%s[%d] has %d fields", side, i, len(v)))
+			continue
+		}
+		price, perr := parseDecimalField(fmt.Sprintf("%s[%d].price", side, i), v[0])
+		qty, qerr := parseDecimalField(fmt.Sprintf("%s[%d].qty", side, i), v[1])
+		if perr != nil || qerr != nil {
+			for _, err := range []error{perr, qerr} {
+				if err != nil {
+					errs = append(errs, err)
+				}
+			}
+			continue
+		}
+		parsed = append(parsed, PriceLevel{Price: price, Qty: qty})
+	}
+	if len(errs) > 0 {
+		return nil, &ValidationError{Symbol: symbol, Reason: REASON_MALFORMED, Errors: errs}
+	}
+
+	for i, l := range parsed {
+		if !l.Price.IsPositive() {
+			return nil, &ValidationError{Symbol: symbol, Reason: REASON_NON_POSITIVE,
+				Errors: []error{fmt.Errorf("%s[%d] price is %s", side, i, l.Price)}}
+		}
+		if l.Qty.IsNegative() {
+			return nil, &ValidationError{Symbol: symbol, Reason: REASON_NEGATIVE_QTY,
+				Errors: []error{fmt.Errorf("%s[%d] quantity is %s", side, i, l.Qty)}}
+		}
+		if i > 0 && !ordered(parsed[i-1].Price, l.Price) {
+			return nil, &ValidationError{Symbol: symbol, Reason: REASON_UNSORTED,
+				Errors: []error{fmt.Errorf("%s[%d] price %s is out of order after %s", side, i, l.Price, parsed[i-1].Price)}}
+		}
+	}
+
+	return parsed, nil
+}
+
+// validateBookTicker returns the spread of the top level of the book
+func validateBookTicker(t *BookTicker) (*Spread, error) {
+	var errs []error
+	bid, err := parseDecimalField("bidPrice", t.BidPrice)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	bidQty, err := parseDecimalField("bidQty", t.BidQty)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	ask, err := parseDecimalField("askPrice", t.AskPrice)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	askQty, err := parseDecimalField("askQty", t.AskQty)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, &ValidationError{Symbol: t.Symbol, Reason: REASON_MALFORMED, Errors: errs}
+	}
+
+	if bidQty.IsNegative() || askQty.IsNegative() {
+		return nil, &ValidationError{Symbol: t.Symbol, Reason: REASON_NEGATIVE_QTY,
+			Errors: []error{fmt.Errorf("bid quantity %s or ask quantity %s", bidQty, askQty)}}
+	}
+	// an empty side of the book is reported with zero price and quantity
+	if bidQty.IsZero() || askQty.IsZero() {
+		return nil, &ValidationError{Symbol: t.Symbol, Reason: REASON_EMPTY_BOOK,
+			Errors: []error{errors.New("empty bids or asks in book ticker")}}
+	}
+	if !bid.IsPositive() || !ask.IsPositive() {
+		return nil, &ValidationError{Symbol: t.Symbol, Reason: REASON_NON_POSITIVE,
+			Errors: []error{fmt.Errorf("bid price %s or ask price %s", bid, ask)}}
+	}
+	if bid.GreaterThanOrEqual(ask) {
+		return nil, &ValidationError{Symbol: t.Symbol, Reason: REASON_CROSSED_BOOK,
+			Errors: []error{fmt.Errorf("best bid %s is not below best ask %s", bid, ask)}}
+	}
+
+	return &Spread{
+		Symbol:     t.Symbol,
+		HighestBid: bid,
+		LowestAsk:  ask,
+		BidQty:     bidQty,
+		AskQty:     askQty,
+		Value:      ask.Sub(bid),
+	}, nil
+}
+
+func validateTicker(t *TickerRow, maxStaleness time.Duration) (*SymbolData, error) {
+	var errs []error
+	vol, err := parseDecimalField("volume", t.Volume)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	qvol, err := parseDecimalField("quoteVolume", t.QuoteVolume)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, &ValidationError{Symbol: t.Symbol, Reason: REASON_MALFORMED, Errors: errs}
+	}
+
+	if vol.IsNegative() || qvol.IsNegative() || t.TradeCount < 0 {
+		return nil, &ValidationError{Symbol: t.Symbol, Reason: REASON_NEGATIVE_QTY,
+			Errors: []error{fmt.Errorf("negative volume %s, quote volume %s or trade count %d", vol, qvol, t.TradeCount)}}
+	}
+
+	if maxStaleness > 0 {
+		if age := time.Since(fromMillis(t.CloseTime)); age > maxStaleness {
+			return nil, &ValidationError{Symbol: t.Symbol, Reason: REASON_STALE_SAMPLE,
+				Errors: []error{fmt.Errorf("close time is %s old", age.Truncate(time.Second))}}
+		}
+	}
+
+	return &SymbolData{
+		Symbol:      t.Symbol,
+		Volume:      vol,
+		QuoteVolume: qvol,
+		TradeCount:  t.TradeCount,
+	}, nil
+}
+
+// validateBalance parses the free and locked amounts of the account asset
+func validateBalance(b *Balance) (*AssetValue, error) {
+	var errs []error
+	free, err := parseDecimalField("free", b.Free)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	locked, err := parseDecimalField("locked", b.Locked)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, &ValidationError{Symbol: b.Asset, Reason: REASON_MALFORMED, Errors: errs}
+	}
+
+	if free.IsNegative() || locked.IsNegative() {
+		return nil, &ValidationError{Symbol: b.Asset, Reason: REASON_NEGATIVE_QTY,
+			Errors: []error{fmt.Errorf("free %s or locked %s", free, locked)}}
+	}
+
+	return &AssetValue{Asset: b.Asset, Free: free, Locked: locked, Total: free.Add(locked)}, nil
+}
+
+func isValidationError(err error) bool {
+	var verr *ValidationError
+	return errors.As(err, &verr)
+}
+
+// quarantine counts and logs the rejected sample,
+// so it's excluded from the results instead of being published
+func quarantine(ctx context.Context, err error) {
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		return
+	}
+	quarantinedSamples.WithLabelValues(verr.Symbol, verr.Reason).Inc()
+	loggerFromContext(ctx).WithField("symbol", verr.Symbol).WithField("reason", verr.Reason).Warn(verr.Error())
+}